@@ -0,0 +1,49 @@
+package main
+
+// the asm subcommand
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func asmMain(args []string) {
+	flags := flag.NewFlagSet("asm", flag.ExitOnError)
+	spec := core.Spec11
+	flags.Var(&spec, "spec", "DCPU-16 spec version to assemble for (1.1 or 1.7)")
+	output := flags.String("o", "", "Output file (defaults to the input with a .obj extension)")
+	littleEndian := flags.Bool("littleEndian", false, "Write the output as little endian")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s asm [flags] input.asm\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	input := flags.Arg(0)
+	src, err := ioutil.ReadFile(input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	prog, err := asm.Assemble(src, spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s:%v\n", input, err)
+		os.Exit(1)
+	}
+	path := *output
+	if path == "" {
+		path = strings.TrimSuffix(input, ".asm") + ".obj"
+	}
+	if err := ioutil.WriteFile(path, encodeWords(prog.Words, *littleEndian), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
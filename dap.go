@@ -0,0 +1,52 @@
+package main
+
+// the dap subcommand
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"github.com/kballard/dcpu16/dcpu/dap"
+	"github.com/kballard/dcpu16/dcpu/gdb"
+	"os"
+)
+
+func dapMain(args []string) {
+	flags := flag.NewFlagSet("dap", flag.ExitOnError)
+	rate := dcpu.DefaultClockRate
+	flags.Var(&rate, "rate", "Clock rate to run programs at")
+	listen := flags.String("listen", "", "Serve a single client on this address (host:port or unix:path) instead of stdin and stdout")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s dap [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	server := &dap.Server{Load: loadProgram, Rate: rate}
+	var err error
+	if *listen == "" {
+		err = server.Serve(os.Stdin, os.Stdout)
+	} else {
+		// the GDB stub listens on the same kinds of addresses
+		l, lerr := gdb.Listen(*listen)
+		if lerr != nil {
+			fmt.Fprintln(os.Stderr, lerr)
+			os.Exit(1)
+		}
+		conn, aerr := l.Accept()
+		l.Close()
+		if aerr != nil {
+			fmt.Fprintln(os.Stderr, aerr)
+			os.Exit(1)
+		}
+		err = server.Serve(conn, conn)
+		conn.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
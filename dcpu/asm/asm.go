@@ -0,0 +1,647 @@
+// Package asm implements an assembler for Notch-style DCPU-16 assembly.
+//
+// Labels are defined with a leading colon (:label) and may be referenced
+// anywhere a value is expected. Comments start with a semicolon. Data is
+// emitted with DAT, which accepts numbers, labels, character literals and
+// string literals. Values may be written in decimal, hexadecimal (0x) or
+// binary (0b), and combined with + and -. Both the 1.1 and 1.7 instruction
+// sets are supported.
+//
+// Literals that fit are encoded in the operand itself rather than the next
+// word. Values that involve labels always use the next word, which means the
+// size of every instruction is known before labels are resolved.
+package asm
+
+import (
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"sort"
+	"strings"
+)
+
+// Error describes a problem at a specific location in the source
+type Error struct {
+	Line   int // 1-based line number
+	Column int // 1-based column number
+	Msg    string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", err.Line, err.Column, err.Msg)
+}
+
+// Program is the result of assembling a source file
+type Program struct {
+	Words  []core.Word          // the assembled program, starting at address 0
+	Labels map[string]core.Word // the address of every label
+	Lines  []LineInfo           // where every statement came from, in address order
+}
+
+// LineInfo maps a statement in the program back to the source
+type LineInfo struct {
+	Address core.Word // the address of the first word of the statement
+	Size    int       // the number of words in the statement
+	Line    int       // 1-based line number
+	Data    bool      // whether the statement is DAT rather than an instruction
+}
+
+// LineForAddress returns the line of the statement that contains address
+func (p *Program) LineForAddress(address core.Word) (int, bool) {
+	i := sort.Search(len(p.Lines), func(i int) bool {
+		return int(p.Lines[i].Address)+p.Lines[i].Size > int(address)
+	})
+	if i < len(p.Lines) && p.Lines[i].Address <= address {
+		return p.Lines[i].Line, true
+	}
+	return 0, false
+}
+
+// AddressForLine returns the address of the first instruction on the given
+// line, or on the closest line after it that has one. It also returns the line
+// the instruction is actually on.
+func (p *Program) AddressForLine(line int) (address core.Word, actual int, ok bool) {
+	for _, info := range p.Lines {
+		if info.Line >= line && !info.Data {
+			return info.Address, info.Line, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Assemble assembles the source into a program for the given spec version
+func Assemble(src []byte, spec core.SpecVersion) (*Program, error) {
+	a := &assembler{spec: spec, labels: make(map[string]core.Word)}
+	// first pass: parse, lay out the program and define the labels
+	var address int
+	for i, line := range strings.Split(string(src), "\n") {
+		lineno := i + 1
+		tokens, err := lexLine(strings.TrimRight(line, "\r"), lineno)
+		if err != nil {
+			return nil, err
+		}
+		tokens, err = a.defineLabels(tokens, lineno, address)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		stmt, err := a.parseStatement(tokens, lineno)
+		if err != nil {
+			return nil, err
+		}
+		stmt.address = address
+		address += a.size(stmt)
+		if address > 0x10000 {
+			return nil, &Error{lineno, tokens[0].column, "program does not fit in memory"}
+		}
+		a.statements = append(a.statements, stmt)
+	}
+	// second pass: encode, now that every label is known
+	prog := &Program{Words: make([]core.Word, 0, address), Labels: a.labels}
+	for _, stmt := range a.statements {
+		words, err := a.encode(stmt)
+		if err != nil {
+			return nil, err
+		}
+		prog.Words = append(prog.Words, words...)
+		prog.Lines = append(prog.Lines, LineInfo{
+			Address: core.Word(stmt.address),
+			Size:    len(words),
+			Line:    stmt.line,
+			Data:    stmt.mnemonic == "DAT",
+		})
+	}
+	return prog, nil
+}
+
+type assembler struct {
+	spec       core.SpecVersion
+	labels     map[string]core.Word
+	statements []*statement
+}
+
+type statement struct {
+	line     int
+	column   int
+	address  int
+	mnemonic string     // upper-cased
+	operands []*operand // for instructions
+	data     []dataItem // for DAT
+}
+
+type dataItem struct {
+	str  []rune // a string literal, or nil
+	expr *expr  // otherwise, a value
+}
+
+type operandKind int
+
+const (
+	operandRegister        operandKind = iota // A, B, C, X, Y, Z, I, J
+	operandIndirect                           // [register]
+	operandIndirectOffset                     // [register + next word]
+	operandPop                                // POP / [SP++]
+	operandPeek                               // PEEK / [SP]
+	operandPush                               // PUSH / [--SP]
+	operandPick                               // PICK n / [SP + n], 1.7 only
+	operandSpecial                            // SP, PC, O / EX
+	operandIndirectLiteral                    // [next word]
+	operandLiteral                            // literal value
+)
+
+type operand struct {
+	kind   operandKind
+	reg    int   // register index, or special register offset from SP
+	expr   *expr // offset or value
+	column int
+}
+
+// expr is a value of the form constant + label - label ...
+// Inside brackets it may also include one register.
+type expr struct {
+	value  int
+	labels []labelRef
+	reg    string // upper-cased register name, or "" for none
+	column int
+}
+
+type labelRef struct {
+	name   string
+	negate bool
+	column int
+}
+
+var generalRegisters = map[string]int{
+	"A": 0, "B": 1, "C": 2, "X": 3, "Y": 4, "Z": 5, "I": 6, "J": 7,
+}
+
+// specialRegister returns the offset of SP, PC and O / EX from SP
+func (a *assembler) specialRegister(name string) (int, bool) {
+	switch name {
+	case "SP":
+		return 0, true
+	case "PC":
+		return 1, true
+	case "O":
+		return 2, a.spec == core.Spec11
+	case "EX":
+		return 2, a.spec == core.Spec17
+	}
+	return 0, false
+}
+
+func (a *assembler) isRegister(name string) bool {
+	name = strings.ToUpper(name)
+	_, ok := generalRegisters[name]
+	_, special := a.specialRegister(name)
+	return ok || special
+}
+
+// defineLabels consumes any label definitions at the start of the line
+func (a *assembler) defineLabels(tokens []token, lineno, address int) ([]token, error) {
+	for {
+		var name token
+		switch {
+		case len(tokens) >= 2 && tokens[0].text == ":" && tokens[0].kind == tokenPunct && tokens[1].kind == tokenIdent:
+			name, tokens = tokens[1], tokens[2:]
+		case len(tokens) >= 2 && tokens[0].kind == tokenIdent && tokens[1].text == ":" && tokens[1].kind == tokenPunct:
+			name, tokens = tokens[0], tokens[2:]
+		default:
+			return tokens, nil
+		}
+		if a.isRegister(name.text) {
+			return nil, &Error{lineno, name.column, fmt.Sprintf("label %#v is a register name", name.text)}
+		}
+		if _, ok := a.labels[name.text]; ok {
+			return nil, &Error{lineno, name.column, fmt.Sprintf("label %#v is already defined", name.text)}
+		}
+		a.labels[name.text] = core.Word(address)
+	}
+}
+
+func (a *assembler) parseStatement(tokens []token, lineno int) (*statement, error) {
+	if tokens[0].kind != tokenIdent {
+		return nil, &Error{lineno, tokens[0].column, "expected an instruction"}
+	}
+	stmt := &statement{line: lineno, column: tokens[0].column, mnemonic: strings.ToUpper(tokens[0].text)}
+	args := splitOperands(tokens[1:])
+	for _, arg := range args {
+		if len(arg) == 0 {
+			return nil, &Error{lineno, stmt.column, "missing operand"}
+		}
+	}
+	if stmt.mnemonic == "DAT" {
+		if len(args) == 0 {
+			return nil, &Error{lineno, stmt.column, "DAT requires at least one value"}
+		}
+		for _, arg := range args {
+			if len(arg) == 1 && arg[0].kind == tokenString {
+				stmt.data = append(stmt.data, dataItem{str: []rune(arg[0].text)})
+				continue
+			}
+			e, err := a.parseExpr(arg, lineno, false)
+			if err != nil {
+				return nil, err
+			}
+			stmt.data = append(stmt.data, dataItem{expr: e})
+		}
+		return stmt, nil
+	}
+	count, ok := a.operandCount(stmt.mnemonic)
+	if !ok {
+		return nil, &Error{lineno, stmt.column, fmt.Sprintf("unknown instruction %#v", tokens[0].text)}
+	}
+	if len(args) != count {
+		return nil, &Error{lineno, stmt.column, fmt.Sprintf("%s takes %d operand(s), found %d", stmt.mnemonic, count, len(args))}
+	}
+	for _, arg := range args {
+		op, err := a.parseOperand(arg, lineno)
+		if err != nil {
+			return nil, err
+		}
+		stmt.operands = append(stmt.operands, op)
+	}
+	return stmt, nil
+}
+
+// splitOperands splits the tokens at commas
+func splitOperands(tokens []token) [][]token {
+	if len(tokens) == 0 {
+		return nil
+	}
+	var args [][]token
+	start := 0
+	for i, tok := range tokens {
+		if tok.kind == tokenPunct && tok.text == "," {
+			args = append(args, tokens[start:i])
+			start = i + 1
+		}
+	}
+	return append(args, tokens[start:])
+}
+
+func (a *assembler) parseOperand(tokens []token, lineno int) (*operand, error) {
+	first := tokens[0]
+	op := &operand{column: first.column}
+	if first.kind == tokenPunct && first.text == "[" {
+		last := tokens[len(tokens)-1]
+		if last.kind != tokenPunct || last.text != "]" || len(tokens) < 3 {
+			return nil, &Error{lineno, first.column, "expected ]"}
+		}
+		inner := tokens[1 : len(tokens)-1]
+		// [SP++] and [--SP]
+		if len(inner) == 2 && inner[0].kind == tokenIdent && strings.ToUpper(inner[0].text) == "SP" && inner[1].text == "++" {
+			op.kind = operandPop
+			return op, nil
+		}
+		if len(inner) == 2 && inner[0].text == "--" && inner[1].kind == tokenIdent && strings.ToUpper(inner[1].text) == "SP" {
+			op.kind = operandPush
+			return op, nil
+		}
+		e, err := a.parseExpr(inner, lineno, true)
+		if err != nil {
+			return nil, err
+		}
+		isConst := e.value == 0 && len(e.labels) == 0
+		switch {
+		case e.reg == "SP" && isConst:
+			op.kind = operandPeek
+		case e.reg == "SP":
+			if a.spec != core.Spec17 {
+				return nil, &Error{lineno, first.column, "[SP + n] requires the 1.7 spec"}
+			}
+			op.kind = operandPick
+		case e.reg == "":
+			op.kind = operandIndirectLiteral
+		case isConst:
+			op.kind = operandIndirect
+		default:
+			op.kind = operandIndirectOffset
+		}
+		if e.reg != "" && e.reg != "SP" {
+			reg, ok := generalRegisters[e.reg]
+			if !ok {
+				return nil, &Error{lineno, first.column, fmt.Sprintf("register %s cannot be used indirectly", e.reg)}
+			}
+			op.reg = reg
+		}
+		e.reg = ""
+		op.expr = e
+		return op, nil
+	}
+	if first.kind == tokenIdent {
+		name := strings.ToUpper(first.text)
+		if len(tokens) == 1 {
+			if reg, ok := generalRegisters[name]; ok {
+				op.kind, op.reg = operandRegister, reg
+				return op, nil
+			}
+			if reg, ok := a.specialRegister(name); ok {
+				op.kind, op.reg = operandSpecial, reg
+				return op, nil
+			}
+			switch name {
+			case "POP":
+				op.kind = operandPop
+				return op, nil
+			case "PEEK":
+				op.kind = operandPeek
+				return op, nil
+			case "PUSH":
+				op.kind = operandPush
+				return op, nil
+			}
+		} else if name == "PICK" && a.spec == core.Spec17 {
+			e, err := a.parseExpr(tokens[1:], lineno, false)
+			if err != nil {
+				return nil, err
+			}
+			op.kind, op.expr = operandPick, e
+			return op, nil
+		}
+	}
+	e, err := a.parseExpr(tokens, lineno, false)
+	if err != nil {
+		return nil, err
+	}
+	op.kind, op.expr = operandLiteral, e
+	return op, nil
+}
+
+// parseExpr parses terms joined by + and -. If allowReg is true,
+// one register may be added, as in [register + offset].
+func (a *assembler) parseExpr(tokens []token, lineno int, allowReg bool) (*expr, error) {
+	e := &expr{column: tokens[0].column}
+	expectTerm := true
+	negate := false
+	for _, tok := range tokens {
+		if !expectTerm {
+			if tok.kind != tokenPunct || (tok.text != "+" && tok.text != "-") {
+				return nil, &Error{lineno, tok.column, fmt.Sprintf("unexpected %#v", tok.text)}
+			}
+			negate = tok.text == "-"
+			expectTerm = true
+			continue
+		}
+		switch tok.kind {
+		case tokenNumber:
+			if negate {
+				e.value -= tok.value
+			} else {
+				e.value += tok.value
+			}
+		case tokenIdent:
+			if a.isRegister(tok.text) {
+				if !allowReg || negate || e.reg != "" {
+					return nil, &Error{lineno, tok.column, fmt.Sprintf("unexpected register %s", tok.text)}
+				}
+				e.reg = strings.ToUpper(tok.text)
+			} else {
+				e.labels = append(e.labels, labelRef{tok.text, negate, tok.column})
+			}
+		case tokenPunct:
+			if tok.text == "-" && !negate {
+				negate = true
+				continue
+			}
+			return nil, &Error{lineno, tok.column, fmt.Sprintf("unexpected %#v", tok.text)}
+		default:
+			return nil, &Error{lineno, tok.column, "unexpected string literal"}
+		}
+		expectTerm = false
+		negate = false
+	}
+	if expectTerm {
+		return nil, &Error{lineno, tokens[len(tokens)-1].column, "expected a value"}
+	}
+	return e, nil
+}
+
+// resolve evaluates the expression, which must not contain a register
+func (a *assembler) resolve(e *expr, lineno int) (core.Word, error) {
+	value := e.value
+	for _, ref := range e.labels {
+		addr, ok := a.labels[ref.name]
+		if !ok {
+			return 0, &Error{lineno, ref.column, fmt.Sprintf("undefined label %#v", ref.name)}
+		}
+		if ref.negate {
+			value -= int(addr)
+		} else {
+			value += int(addr)
+		}
+	}
+	return core.Word(value), nil
+}
+
+// shortLiteral returns the operand code for a literal that can be embedded
+// in the instruction, or false if it needs the next word
+func (a *assembler) shortLiteral(op *operand, isA bool) (core.Word, bool) {
+	if op.kind != operandLiteral || len(op.expr.labels) > 0 {
+		return 0, false
+	}
+	value := core.Word(op.expr.value)
+	if a.spec == core.Spec17 {
+		// only a may hold a short literal, for values -1 through 30
+		if !isA {
+			return 0, false
+		}
+		if value == 0xffff || value <= 0x1e {
+			return value + 0x21, true
+		}
+		return 0, false
+	}
+	if value <= 0x1f {
+		return value + 0x20, true
+	}
+	return 0, false
+}
+
+// hasNextWord returns whether the operand is followed by a word
+func (a *assembler) hasNextWord(op *operand, isA bool) bool {
+	switch op.kind {
+	case operandIndirectOffset, operandPick, operandIndirectLiteral:
+		return true
+	case operandLiteral:
+		_, short := a.shortLiteral(op, isA)
+		return !short
+	}
+	return false
+}
+
+// encodeOperand returns the operand code and the next word, if any.
+// isA indicates the operand is in the a position (the source in 1.7,
+// and the destination in 1.1).
+func (a *assembler) encodeOperand(op *operand, isA bool, lineno int) (code core.Word, next []core.Word, err error) {
+	if code, ok := a.shortLiteral(op, isA); ok {
+		return code, nil, nil
+	}
+	if op.expr != nil && a.hasNextWord(op, isA) {
+		val, err := a.resolve(op.expr, lineno)
+		if err != nil {
+			return 0, nil, err
+		}
+		next = []core.Word{val}
+	}
+	switch op.kind {
+	case operandRegister:
+		code = core.Word(op.reg)
+	case operandIndirect:
+		code = 0x08 + core.Word(op.reg)
+	case operandIndirectOffset:
+		code = 0x10 + core.Word(op.reg)
+	case operandPop:
+		if a.spec == core.Spec17 && !isA {
+			return 0, nil, &Error{lineno, op.column, "POP can only be used as the source operand"}
+		}
+		code = 0x18
+	case operandPeek:
+		code = 0x19
+	case operandPush:
+		if a.spec == core.Spec17 {
+			if isA {
+				return 0, nil, &Error{lineno, op.column, "PUSH can only be used as the destination operand"}
+			}
+			code = 0x18
+		} else {
+			code = 0x1a
+		}
+	case operandPick:
+		code = 0x1a
+	case operandSpecial:
+		code = 0x1b + core.Word(op.reg)
+	case operandIndirectLiteral:
+		code = 0x1e
+	case operandLiteral:
+		code = 0x1f
+	}
+	return code, next, nil
+}
+
+// size returns the number of words the statement assembles to
+func (a *assembler) size(stmt *statement) int {
+	if stmt.mnemonic == "DAT" {
+		size := 0
+		for _, item := range stmt.data {
+			if item.str != nil {
+				size += len(item.str)
+			} else {
+				size++
+			}
+		}
+		return size
+	}
+	size := 1
+	for i, op := range stmt.operands {
+		if a.hasNextWord(op, a.isAPosition(stmt, i)) {
+			size++
+		}
+	}
+	return size
+}
+
+// isAPosition returns whether the nth operand of the statement is encoded
+// in the a position
+func (a *assembler) isAPosition(stmt *statement, n int) bool {
+	if len(stmt.operands) == 1 {
+		return true
+	}
+	if a.spec == core.Spec17 {
+		return n == 1
+	}
+	return n == 0
+}
+
+func (a *assembler) encode(stmt *statement) ([]core.Word, error) {
+	if stmt.mnemonic == "DAT" {
+		var words []core.Word
+		for _, item := range stmt.data {
+			if item.str != nil {
+				for _, r := range item.str {
+					words = append(words, core.Word(r))
+				}
+				continue
+			}
+			val, err := a.resolve(item.expr, stmt.line)
+			if err != nil {
+				return nil, err
+			}
+			words = append(words, val)
+		}
+		return words, nil
+	}
+	// operands are encoded in spec order, so their next words come out in order
+	var codes [2]core.Word
+	var next []core.Word
+	order := []int{0, 1}
+	if a.spec == core.Spec17 {
+		order = []int{1, 0}
+	}
+	for _, i := range order {
+		if i >= len(stmt.operands) {
+			continue
+		}
+		code, words, err := a.encodeOperand(stmt.operands[i], a.isAPosition(stmt, i), stmt.line)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		next = append(next, words...)
+	}
+	var word core.Word
+	if a.spec == core.Spec17 {
+		if op, ok := basicOpcodes17[stmt.mnemonic]; ok {
+			word = op | codes[0]<<5 | codes[1]<<10
+		} else {
+			word = specialOpcodes17[stmt.mnemonic]<<5 | codes[0]<<10
+		}
+	} else {
+		if op, ok := basicOpcodes11[stmt.mnemonic]; ok {
+			word = op | codes[0]<<4 | codes[1]<<10
+		} else {
+			word = specialOpcodes11[stmt.mnemonic]<<4 | codes[0]<<10
+		}
+	}
+	return append([]core.Word{word}, next...), nil
+}
+
+// operandCount returns the number of operands the instruction takes,
+// or false if it's not a valid instruction
+func (a *assembler) operandCount(mnemonic string) (int, bool) {
+	basic, special := basicOpcodes11, specialOpcodes11
+	if a.spec == core.Spec17 {
+		basic, special = basicOpcodes17, specialOpcodes17
+	}
+	if _, ok := basic[mnemonic]; ok {
+		return 2, true
+	}
+	if _, ok := special[mnemonic]; ok {
+		return 1, true
+	}
+	return 0, false
+}
+
+var basicOpcodes11 = map[string]core.Word{
+	"SET": 0x1, "ADD": 0x2, "SUB": 0x3, "MUL": 0x4, "DIV": 0x5,
+	"MOD": 0x6, "SHL": 0x7, "SHR": 0x8, "AND": 0x9, "BOR": 0xa,
+	"XOR": 0xb, "IFE": 0xc, "IFN": 0xd, "IFG": 0xe, "IFB": 0xf,
+}
+
+var specialOpcodes11 = map[string]core.Word{
+	"JSR": 0x01,
+}
+
+var basicOpcodes17 = map[string]core.Word{
+	"SET": 0x01, "ADD": 0x02, "SUB": 0x03, "MUL": 0x04, "MLI": 0x05,
+	"DIV": 0x06, "DVI": 0x07, "MOD": 0x08, "MDI": 0x09, "AND": 0x0a,
+	"BOR": 0x0b, "XOR": 0x0c, "SHR": 0x0d, "ASR": 0x0e, "SHL": 0x0f,
+	"IFB": 0x10, "IFC": 0x11, "IFE": 0x12, "IFN": 0x13, "IFG": 0x14,
+	"IFA": 0x15, "IFL": 0x16, "IFU": 0x17, "ADX": 0x1a, "SBX": 0x1b,
+	"STI": 0x1e, "STD": 0x1f,
+}
+
+var specialOpcodes17 = map[string]core.Word{
+	"JSR": 0x01, "INT": 0x08, "IAG": 0x09, "IAS": 0x0a, "RFI": 0x0b,
+	"IAQ": 0x0c, "HWN": 0x10, "HWQ": 0x11, "HWI": 0x12,
+}
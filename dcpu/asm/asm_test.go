@@ -0,0 +1,140 @@
+package asm
+
+import (
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io/ioutil"
+	"testing"
+)
+
+// The samples were built with an external 1.1 assembler,
+// so we should produce exactly the same output.
+func TestSamples(t *testing.T) {
+	for _, name := range []string{"fizzbuzz", "keycodes"} {
+		src, err := ioutil.ReadFile("../../_samples/" + name + ".asm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj, err := ioutil.ReadFile("../../_samples/" + name + ".obj")
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog, err := Assemble(src, core.Spec11)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(prog.Words) != len(obj)/2 {
+			t.Errorf("%s: expected %d words, found %d", name, len(obj)/2, len(prog.Words))
+			continue
+		}
+		for i, w := range prog.Words {
+			expected := core.Word(obj[i*2])<<8 | core.Word(obj[i*2+1])
+			if w != expected {
+				t.Errorf("%s: unexpected word at offset %#x; expected %#04x, found %#04x", name, i, expected, w)
+				break
+			}
+		}
+	}
+}
+
+func TestAssemble17(t *testing.T) {
+	src := `
+; 1.7 syntax
+:start  SET A, 0x30             ; short literals cover -1 through 30
+        SET [0x1000 + B], -1
+        ADD PUSH, POP
+        SET B, PICK 2
+        SET [SP + 1], EX
+        IFU A, start
+        HWI 0
+        JSR start
+        DAT "hi", 'c', start, 0b101
+`
+	expected := []core.Word{
+		0x7c01, 0x0030, // SET A, 0x30
+		0x8221, 0x1000, // SET [0x1000 + B], -1
+		0x6302,         // ADD PUSH, POP
+		0x6821, 0x0002, // SET B, PICK 2
+		0x7741, 0x0001, // SET [SP + 1], EX
+		0x7c17, 0x0000, // IFU A, start
+		0x8640,         // HWI 0
+		0x7c20, 0x0000, // JSR start
+		'h', 'i', 'c', 0x0000, 0x0005,
+	}
+	prog, err := Assemble([]byte(src), core.Spec17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prog.Words) != len(expected) {
+		t.Fatalf("Expected %d words, found %d: %04x", len(expected), len(prog.Words), prog.Words)
+	}
+	for i, w := range expected {
+		if prog.Words[i] != w {
+			t.Errorf("Unexpected word at offset %#x; expected %#04x, found %#04x", i, w, prog.Words[i])
+		}
+	}
+	if prog.Labels["start"] != 0 {
+		t.Errorf("Unexpected address for start: %#x", prog.Labels["start"])
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		src          string
+		spec         core.SpecVersion
+		line, column int
+	}{
+		{"SET A, 1\n  FOO A, 1", core.Spec11, 2, 3},
+		{"SET A, missing", core.Spec11, 1, 8},
+		{"SET A", core.Spec11, 1, 1},
+		{":a SET A, 1", core.Spec11, 1, 2},
+		{":foo\n:foo", core.Spec11, 2, 2},
+		{"SET POP, 1", core.Spec17, 1, 5},
+		{"SET A, PUSH", core.Spec17, 1, 8},
+		{"SET A, [SP + 1]", core.Spec11, 1, 8},
+		{"DAT \"open", core.Spec11, 1, 5},
+		{"SET A, 0x10000", core.Spec11, 1, 8},
+		{"SET A, [-B]", core.Spec11, 1, 10},
+	}
+	for _, test := range tests {
+		_, err := Assemble([]byte(test.src), test.spec)
+		asmErr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%q: expected an *Error, found %v", test.src, err)
+			continue
+		}
+		if asmErr.Line != test.line || asmErr.Column != test.column {
+			t.Errorf("%q: expected an error at %d:%d, found %v", test.src, test.line, test.column, asmErr)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	src := `; comment
+:start  SET A, 0x30
+
+        DAT 1, 2
+        SUB A, 1
+`
+	prog, err := Assemble([]byte(src), core.Spec11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, line := range map[core.Word]int{0: 2, 1: 2, 2: 4, 3: 4, 4: 5} {
+		if found, ok := prog.LineForAddress(addr); !ok || found != line {
+			t.Errorf("Expected address %#x to be on line %d, found %d (%v)", addr, line, found, ok)
+		}
+	}
+	if _, ok := prog.LineForAddress(5); ok {
+		t.Error("Expected no line for an address past the end")
+	}
+	// breakpoints on blank lines and data move to the next instruction
+	for line, expected := range map[int]core.Word{1: 0, 3: 4, 4: 4, 5: 4} {
+		if addr, _, ok := prog.AddressForLine(line); !ok || addr != expected {
+			t.Errorf("Expected line %d to map to %#x, found %#x (%v)", line, expected, addr, ok)
+		}
+	}
+	if _, _, ok := prog.AddressForLine(6); ok {
+		t.Error("Expected no address for a line past the end")
+	}
+}
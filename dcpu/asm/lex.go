@@ -0,0 +1,154 @@
+package asm
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenIdent  tokenKind = iota // mnemonics, registers and labels
+	tokenNumber                  // numbers and character literals
+	tokenString                  // string literals, only valid in DAT
+	tokenPunct                   // , [ ] + - : ++ --
+)
+
+type token struct {
+	kind   tokenKind
+	text   string // the identifier, punctuation, or string contents
+	value  int    // the value of a number
+	column int    // 1-based column the token starts at
+}
+
+// lexLine splits one line of source into tokens, stopping at a comment
+func lexLine(line string, lineno int) ([]token, error) {
+	var tokens []token
+	runes := []rune(line)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		column := i + 1
+		switch {
+		case r == ';':
+			return tokens, nil
+		case unicode.IsSpace(r):
+			i++
+		case r == '+' || r == '-':
+			if i+1 < len(runes) && runes[i+1] == r {
+				tokens = append(tokens, token{kind: tokenPunct, text: string([]rune{r, r}), column: column})
+				i += 2
+			} else {
+				tokens = append(tokens, token{kind: tokenPunct, text: string(r), column: column})
+				i++
+			}
+		case strings.ContainsRune(",[]:", r):
+			tokens = append(tokens, token{kind: tokenPunct, text: string(r), column: column})
+			i++
+		case r == '"' || r == '\'':
+			str, n, err := lexQuoted(runes[i:])
+			if err != nil {
+				return nil, &Error{lineno, column, err.Error()}
+			}
+			i += n
+			if r == '"' {
+				tokens = append(tokens, token{kind: tokenString, text: str, column: column})
+			} else {
+				if len([]rune(str)) != 1 {
+					return nil, &Error{lineno, column, "character literal must contain exactly one character"}
+				}
+				tokens = append(tokens, token{kind: tokenNumber, text: str, value: int([]rune(str)[0]), column: column})
+			}
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && isIdentRune(runes[i]) {
+				i++
+			}
+			text := string(runes[start:i])
+			value, err := parseNumber(text)
+			if err != nil {
+				return nil, &Error{lineno, column, err.Error()}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: text, value: value, column: column})
+		case isIdentRune(r):
+			start := i
+			for i < len(runes) && isIdentRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[start:i]), column: column})
+		default:
+			return nil, &Error{lineno, column, fmt.Sprintf("unexpected character %q", r)}
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// parseNumber parses decimal, 0x hexadecimal, and 0b binary numbers
+func parseNumber(text string) (int, error) {
+	base, digits := 10, text
+	lower := strings.ToLower(text)
+	if strings.HasPrefix(lower, "0x") {
+		base, digits = 16, text[2:]
+	} else if strings.HasPrefix(lower, "0b") {
+		base, digits = 2, text[2:]
+	}
+	if digits == "" {
+		return 0, fmt.Errorf("invalid number %#v", text)
+	}
+	value := 0
+	for _, r := range strings.ToLower(digits) {
+		var digit int
+		switch {
+		case r >= '0' && r <= '9':
+			digit = int(r - '0')
+		case r >= 'a' && r <= 'f':
+			digit = int(r-'a') + 10
+		default:
+			digit = base
+		}
+		if digit >= base {
+			return 0, fmt.Errorf("invalid number %#v", text)
+		}
+		value = value*base + digit
+		if value > 0xffff {
+			return 0, fmt.Errorf("number %#v does not fit in a word", text)
+		}
+	}
+	return value, nil
+}
+
+// lexQuoted reads a quoted literal starting at runes[0], which is the quote.
+// It returns the unescaped contents and the number of runes consumed.
+func lexQuoted(runes []rune) (string, int, error) {
+	quote := runes[0]
+	var out []rune
+	for i := 1; i < len(runes); i++ {
+		r := runes[i]
+		switch r {
+		case quote:
+			return string(out), i + 1, nil
+		case '\\':
+			i++
+			if i >= len(runes) {
+				break
+			}
+			switch runes[i] {
+			case 'n':
+				out = append(out, '\n')
+			case 't':
+				out = append(out, '\t')
+			case '0':
+				out = append(out, 0)
+			default:
+				out = append(out, runes[i])
+			}
+		default:
+			out = append(out, r)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated literal")
+}
@@ -0,0 +1,82 @@
+// DCPU-16 Generic Clock implementation
+// The clock ticks at 60Hz divided by a programmable divisor. Time is derived
+// from the machine's cycle counter and clock rate rather than from the host's
+// clock, so a program sees the same number of ticks no matter how fast the
+// emulator actually runs.
+
+package dcpu
+
+import (
+	"github.com/kballard/dcpu16/dcpu/core"
+)
+
+const (
+	clockHardwareID      = 0x12d0b402
+	clockHardwareVersion = 1
+	clockBaseRate        = 60 // ticks per second with a divisor of 1
+)
+
+// HWI messages understood by the clock, passed in register A
+const (
+	clockSetDivisor   = 0
+	clockGetTicks     = 1
+	clockSetInterrupt = 2
+)
+
+type Clock struct {
+	divisor core.Word // the clock ticks at 60/divisor Hz, or not at all if 0
+	start   uint      // the cycle the divisor was last set at
+	ticks   uint      // ticks since the divisor was last set
+	message core.Word // interrupt message, or 0 if interrupts are off
+	cycle   uint      // the current cycle, as of the last Tick
+	rate    ClockRate // the clock rate of the machine
+}
+
+func (c *Clock) HardwareID() uint32 {
+	return clockHardwareID
+}
+
+func (c *Clock) HardwareVersion() core.Word {
+	return clockHardwareVersion
+}
+
+func (c *Clock) Manufacturer() uint32 {
+	return 0
+}
+
+func (c *Clock) HandleInterrupt(s *core.State) (uint, error) {
+	switch s.A() {
+	case clockSetDivisor:
+		c.divisor = s.B()
+		c.start = c.cycle
+		c.ticks = 0
+	case clockGetTicks:
+		s.SetC(core.Word(c.ticks))
+	case clockSetInterrupt:
+		c.message = s.B()
+	}
+	return 0, nil
+}
+
+// Tick advances the clock to the machine's current cycle,
+// raising an interrupt for each tick if interrupts are enabled.
+func (c *Clock) Tick(m *Machine) error {
+	c.cycle, c.rate = m.cycleCount, m.rate
+	if c.cycle < c.start {
+		// the machine was run backwards to before the divisor was set
+		c.start, c.ticks = c.cycle, 0
+	}
+	if c.divisor == 0 || c.rate <= 0 {
+		return nil
+	}
+	// ticks = elapsed seconds * 60 / divisor
+	ticks := (c.cycle - c.start) * clockBaseRate / (uint(c.rate) * uint(c.divisor))
+	for ; c.ticks < ticks; c.ticks++ {
+		if c.message != 0 {
+			if err := m.State.Interrupt(c.message); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package dcpu
+
+import (
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	// tick at 30Hz with interrupts, reading the ticks as fast as possible
+	prog, err := asm.Assemble([]byte(`
+		      IAS handler
+		      SET A, 2
+		      SET B, 0x42
+		      HWI 1
+		      SET A, 0
+		      SET B, 2
+		      HWI 1
+		:loop SET A, 1
+		      HWI 1
+		      SET [0x1000], C
+		      SET PC, loop
+		:handler
+		      ADD [0x1001], 1
+		      SET [0x1002], A
+		      RFI 0`), core.Spec17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// at 600Hz, the clock ticks every 20 cycles once the divisor is set
+	machine := &Machine{Headless: true, VirtualTime: true, CycleLimit: 1000}
+	machine.State.Spec = core.Spec17
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-machine.ErrorC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the cycle limit")
+	}
+	if err := machine.Stop(); err != ErrCycleLimit {
+		t.Errorf("Expected ErrCycleLimit, found %v", err)
+	}
+
+	// the divisor is set within the first 20 cycles
+	if ticks := machine.Clock.ticks; ticks != 49 {
+		t.Errorf("Expected 49 ticks, found %d", ticks)
+	}
+	// the program may not have seen the last tick yet
+	results := machine.State.Ram.GetSlice(0x1000, 0x1003)
+	if results[0] != 48 && results[0] != 49 {
+		t.Errorf("Expected to read 48 or 49 ticks, found %d", results[0])
+	}
+	if results[1] != 48 && results[1] != 49 {
+		t.Errorf("Expected 48 or 49 interrupts, found %d", results[1])
+	}
+	if results[2] != 0x42 {
+		t.Errorf("Expected interrupt message 0x42, found %#x", results[2])
+	}
+}
+
+func TestClockDivisor(t *testing.T) {
+	var clock Clock
+	machine := &Machine{rate: 600}
+	state := &machine.State
+	state.SetA(clockSetDivisor)
+	state.SetB(3)
+	clock.HandleInterrupt(state)
+	// 20Hz is a tick every 30 cycles
+	machine.cycleCount = 89
+	clock.Tick(machine)
+	state.SetA(clockGetTicks)
+	clock.HandleInterrupt(state)
+	if state.C() != 2 {
+		t.Errorf("Expected 2 ticks, found %d", state.C())
+	}
+	// setting the divisor starts counting again
+	state.SetA(clockSetDivisor)
+	state.SetB(1)
+	clock.HandleInterrupt(state)
+	machine.cycleCount = 99
+	clock.Tick(machine)
+	state.SetA(clockGetTicks)
+	clock.HandleInterrupt(state)
+	if state.C() != 1 {
+		t.Errorf("Expected 1 tick, found %d", state.C())
+	}
+	// a divisor of 0 stops the clock
+	state.SetA(clockSetDivisor)
+	state.SetB(0)
+	clock.HandleInterrupt(state)
+	machine.cycleCount = 1000
+	clock.Tick(machine)
+	state.SetA(clockGetTicks)
+	clock.HandleInterrupt(state)
+	if state.C() != 0 {
+		t.Errorf("Expected no ticks, found %d", state.C())
+	}
+}
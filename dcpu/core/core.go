@@ -14,15 +14,69 @@ func (err *OpcodeError) Error() string {
 	return fmt.Sprintf("invalid opcode %#04x", err.Opcode)
 }
 
+// OnFireError is returned when more than 256 interrupts are queued,
+// which causes the DCPU-16 to catch fire.
+type OnFireError struct {
+	Message Word // the message of the interrupt that overflowed the queue
+}
+
+func (err *OnFireError) Error() string {
+	return fmt.Sprintf("interrupt queue overflowed by message %#04x; the DCPU-16 is on fire", err.Message)
+}
+
+// maxQueuedInterrupts is the number of interrupts that may be queued
+// before the DCPU-16 catches fire
+const maxQueuedInterrupts = 256
+
+// SpecVersion identifies the revision of the DCPU-16 specification
+// that a State executes.
+type SpecVersion int
+
+const (
+	Spec11 SpecVersion = iota // DCPU-16 1.1, the zero value
+	Spec17                    // DCPU-16 1.7
+)
+
+func (v SpecVersion) String() string {
+	switch v {
+	case Spec11:
+		return "1.1"
+	case Spec17:
+		return "1.7"
+	}
+	return fmt.Sprintf("SpecVersion(%d)", int(v))
+}
+
+func (v *SpecVersion) Set(str string) error {
+	switch str {
+	case "1.1":
+		*v = Spec11
+	case "1.7":
+		*v = Spec17
+	default:
+		return fmt.Errorf("unknown spec version %#v", str)
+	}
+	return nil
+}
+
 type State struct {
 	Registers
 	Ram       Memory
-	lastError error   // once set, will be returned always
-	step      int     // fetch, decode, execute
-	cycleCost uint    // remaining cost of the opcode to execute
-	op, a, b  uint32  // operands and opcode (uint32 datatype used for math)
-	delayed   bool    // indicates whether we've already delayed the operand fetch
-	address   Address // location to store the result
+	Spec      SpecVersion // the spec revision to execute
+	Devices   []Device    // attached hardware, in the order HWN/HWQ/HWI see it
+	lastError error       // once set, will be returned always
+	step      int         // fetch, decode, execute
+	cycleCost uint        // remaining cost of the opcode to execute
+	op, a, b  uint32      // operands and opcode (uint32 datatype used for math)
+	delayed   bool        // indicates whether we've already delayed the operand fetch
+	address   Address     // location to store the result
+	queue     []Word      // queued interrupt messages
+	queueing  bool        // whether interrupts are queued instead of triggered
+	stall     uint        // extra cycles requested by the executing instruction
+	pc        Word        // address of the executing instruction
+	halted    bool        // whether the last instruction jumped to itself
+	record    Instruction // record of the executing instruction
+	history   *history    // undo information, if enabled with EnableHistory
 }
 
 const (
@@ -51,32 +105,72 @@ func (s *State) StepCycle() error {
 	if s.lastError != nil {
 		return s.lastError
 	}
+	if s.history != nil {
+		if s.step == stateStepFetch {
+			s.history.begin(s)
+		}
+		s.history.entry(s.history.count-1).cycles++
+	}
+	// memory notices what the CPU does, but not anybody else
+	s.Ram.journal, s.Ram.cpu = s.history, &s.pc
+	err := s.stepCycle()
+	s.Ram.journal, s.Ram.cpu = nil, nil
+	return err
+}
+
+func (s *State) stepCycle() error {
+	if s.step == stateStepFetch {
+		s.record.Cycles = 0
+	}
+	s.record.Cycles++
 
-step:
+	// The operands are processed in the order they're named by the spec.
+	// In 1.1 that means the destination a followed by the source b, whereas
+	// in 1.7 the source a is processed before the destination b. Special opcodes
+	// only have the a operand, which is also their destination.
 	switch s.step {
 	case stateStepFetch:
+		// Trigger at most one queued interrupt between instructions
+		if !s.queueing && len(s.queue) > 0 {
+			if err := s.triggerInterrupt(); err != nil {
+				s.lastError = err
+				return err
+			}
+		}
 		// Fetch the next opcode
+		s.pc = s.PC()
 		opcode := s.nextWord()
-		s.op, s.a, s.b = decodeOpcode(opcode)
-		if cost, err := cycleCost(s.op); err != nil {
+		var cost uint
+		var err error
+		if s.Spec == Spec17 {
+			s.op, s.a, s.b = decodeOpcode17(opcode)
+			cost, err = cycleCost17(s.op)
+		} else {
+			s.op, s.a, s.b = decodeOpcode(opcode)
+			cost, err = cycleCost(s.op)
+		}
+		s.startRecord(opcode)
+		if err != nil {
 			s.lastError = err
 			return err
-		} else {
-			s.cycleCost = cost
 		}
+		s.cycleCost = cost
 		s.address = Address{}
 		s.delayed = false
 		s.step = stateStepDecodeA
 		fallthrough
 	case stateStepDecodeA:
 		// decode operand A
-		val, loc, delay := s.fetchOperand(s.a, s.delayed)
+		val, loc, delay := s.decodeOperand(s.a, true, s.delayed)
 		s.delayed = delay
 		if delay {
 			break
 		}
+		s.record.A = Operand{Word(s.a), val, loc}
 		s.a = uint32(val)
-		s.address = loc
+		if s.Spec == Spec11 || s.op >= opcodeExtendedOffset {
+			s.address = loc
+		}
 		if s.op >= opcodeExtendedOffset {
 			s.step = stateStepExecute
 		} else {
@@ -85,11 +179,18 @@ step:
 		fallthrough
 	case stateStepDecodeB:
 		// decode operand B
-		val, _, delay := s.fetchOperand(s.b, s.delayed)
+		val, loc, delay := s.decodeOperand(s.b, false, s.delayed)
 		s.delayed = delay
 		if delay {
 			break
 		}
+		if s.op < opcodeExtendedOffset {
+			// special opcodes fall through here with a b of 0, ignore it
+			s.record.B = Operand{Word(s.b), val, loc}
+			if s.Spec == Spec17 {
+				s.address = loc
+			}
+		}
 		s.b = uint32(val)
 		s.step = stateStepExecute
 		fallthrough
@@ -101,95 +202,311 @@ step:
 		}
 		// we now have valid opcodes, and we've spun enough cycles for the instruction
 		var val Word
-		switch s.op {
-		case opcodeSET:
-			val = Word(s.b)
-		case opcodeADD:
-			result := s.a + s.b
-			val = Word(result)
-			s.SetO(Word(result >> 16))
-		case opcodeSUB:
-			result := s.a - s.b
-			val = Word(result)
-			s.SetO(Word(result >> 16))
-		case opcodeMUL:
-			result := s.a * s.b
-			val = Word(result)
-			s.SetO(Word(result >> 16))
-		case opcodeDIV:
-			if s.b == 0 {
-				val = 0
-				s.SetO(0)
-			} else {
-				result := s.a / s.b
-				val = Word(result)
-				// O is a bit weird here
-				s.SetO(Word((s.a << 16) / s.b))
-			}
-		case opcodeMOD:
-			if s.b == 0 {
-				val = 0
-			} else {
-				val = Word(s.a % s.b)
-			}
-		case opcodeSHL:
-			result := s.a << s.b
-			val = Word(result)
-			s.SetO(Word(result >> 16))
-		case opcodeSHR:
-			val = Word(s.a >> s.b)
-			s.SetO(Word((s.a << 16) >> s.b))
-		case opcodeAND:
-			val = Word(s.a & s.b)
-		case opcodeBOR:
-			val = Word(s.a | s.b)
-		case opcodeXOR:
-			val = Word(s.a ^ s.b)
-		case opcodeIFE:
-			if !(s.a == s.b) {
-				s.skipInstruction()
-				break step
-			}
-			s.address = Address{}
-		case opcodeIFN:
-			if !(s.a != s.b) {
-				s.skipInstruction()
-				break step
-			}
-			s.address = Address{}
-		case opcodeIFG:
-			if !(s.a > s.b) {
-				s.skipInstruction()
-				break step
-			}
-			s.address = Address{}
-		case opcodeIFB:
-			if !((s.a & s.b) != 0) {
-				s.skipInstruction()
-				break step
-			}
-			s.address = Address{}
-		case opcodeExtJSR:
-			val = s.PC()
-			s.DecrSP() // PUSH
-			s.address = Address{
-				addressType: addressTypeMemory,
-				index:       s.SP(),
-			}
-			s.SetPC(Word(s.a))
-		default:
-			// cycleCost should have already caught this
-			panic("Unexpected opcode")
+		var skip bool
+		var err error
+		if s.Spec == Spec17 {
+			val, skip, err = s.execute17()
+		} else {
+			val, skip = s.execute11()
+		}
+		if err != nil {
+			s.lastError = err
+			return err
+		}
+		if skip {
+			s.record.Skipped = true
+			s.skipInstruction()
+			break
 		}
 		if err := s.storeAddress(s.address, val); err != nil {
 			s.lastError = err
 			return err
 		}
+		if !s.record.Skipped && s.address.addressType != addressTypeNone {
+			// skipping and stalling reuse this step, but they aren't part
+			// of what the instruction itself stored
+			s.record.Stored, s.record.Dest, s.record.Value = true, s.address, val
+		}
+		if s.stall > 0 {
+			// the instruction isn't done until the extra cycles are spent
+			s.op, s.cycleCost, s.address = opcodeStall, s.stall, Address{}
+			s.stall = 0
+			break
+		}
+		s.halted = s.PC() == s.pc && s.IA() == 0
 		s.step = stateStepFetch
 	}
 	return nil
 }
 
+// AtInstructionBoundary returns true if the previous instruction has finished
+// and the next cycle will start a new one.
+func (s *State) AtInstructionBoundary() bool {
+	return s.step == stateStepFetch
+}
+
+// InstructionAddress returns the address of the instruction that is executing,
+// or that executed last if the machine is between instructions.
+func (s *State) InstructionAddress() Word {
+	return s.pc
+}
+
+// Halted returns true if the last instruction jumped to itself, such as
+// SUB PC, 1, while interrupts are disabled. Nothing but an external change
+// to the state can make a halted DCPU-16 do anything else.
+func (s *State) Halted() bool {
+	return s.halted
+}
+
+// execute11 executes the decoded 1.1 instruction. It returns the value to
+// store into s.address, or true for skip if the next instruction should be skipped.
+func (s *State) execute11() (val Word, skip bool) {
+	switch s.op {
+	case opcodeSET:
+		val = Word(s.b)
+	case opcodeADD:
+		result := s.a + s.b
+		val = Word(result)
+		s.SetO(Word(result >> 16))
+	case opcodeSUB:
+		result := s.a - s.b
+		val = Word(result)
+		s.SetO(Word(result >> 16))
+	case opcodeMUL:
+		result := s.a * s.b
+		val = Word(result)
+		s.SetO(Word(result >> 16))
+	case opcodeDIV:
+		if s.b == 0 {
+			val = 0
+			s.SetO(0)
+		} else {
+			result := s.a / s.b
+			val = Word(result)
+			// O is a bit weird here
+			s.SetO(Word((s.a << 16) / s.b))
+		}
+	case opcodeMOD:
+		if s.b == 0 {
+			val = 0
+		} else {
+			val = Word(s.a % s.b)
+		}
+	case opcodeSHL:
+		result := s.a << s.b
+		val = Word(result)
+		s.SetO(Word(result >> 16))
+	case opcodeSHR:
+		val = Word(s.a >> s.b)
+		s.SetO(Word((s.a << 16) >> s.b))
+	case opcodeAND:
+		val = Word(s.a & s.b)
+	case opcodeBOR:
+		val = Word(s.a | s.b)
+	case opcodeXOR:
+		val = Word(s.a ^ s.b)
+	case opcodeIFE:
+		skip = !(s.a == s.b)
+		s.address = Address{}
+	case opcodeIFN:
+		skip = !(s.a != s.b)
+		s.address = Address{}
+	case opcodeIFG:
+		skip = !(s.a > s.b)
+		s.address = Address{}
+	case opcodeIFB:
+		skip = !((s.a & s.b) != 0)
+		s.address = Address{}
+	case opcodeExtJSR:
+		val = s.PC()
+		s.DecrSP() // PUSH
+		s.address = Address{
+			addressType: addressTypeMemory,
+			index:       s.SP(),
+		}
+		s.SetPC(Word(s.a))
+	default:
+		// cycleCost should have already caught this
+		panic("Unexpected opcode")
+	}
+	return
+}
+
+// execute17 executes the decoded 1.7 instruction. It returns the value to
+// store into s.address, or true for skip if the next instruction should be skipped.
+// Note that in 1.7, b is the destination and a is the source.
+func (s *State) execute17() (val Word, skip bool, err error) {
+	// signed views of the operands
+	sa, sb := int32(int16(s.a)), int32(int16(s.b))
+	switch s.op {
+	case opcode17SET:
+		val = Word(s.a)
+	case opcode17ADD:
+		result := s.b + s.a
+		val = Word(result)
+		s.SetEX(Word(result >> 16))
+	case opcode17SUB:
+		result := s.b - s.a
+		val = Word(result)
+		s.SetEX(Word(result >> 16))
+	case opcode17MUL:
+		result := s.b * s.a
+		val = Word(result)
+		s.SetEX(Word(result >> 16))
+	case opcode17MLI:
+		result := sb * sa
+		val = Word(result)
+		s.SetEX(Word(result >> 16))
+	case opcode17DIV:
+		if s.a == 0 {
+			val = 0
+			s.SetEX(0)
+		} else {
+			val = Word(s.b / s.a)
+			s.SetEX(Word((s.b << 16) / s.a))
+		}
+	case opcode17DVI:
+		if sa == 0 {
+			val = 0
+			s.SetEX(0)
+		} else {
+			// Go division already rounds towards 0
+			val = Word(sb / sa)
+			s.SetEX(Word((sb << 16) / sa))
+		}
+	case opcode17MOD:
+		if s.a == 0 {
+			val = 0
+		} else {
+			val = Word(s.b % s.a)
+		}
+	case opcode17MDI:
+		if sa == 0 {
+			val = 0
+		} else {
+			// the sign of the result follows b, as the spec requires
+			val = Word(sb % sa)
+		}
+	case opcode17AND:
+		val = Word(s.b & s.a)
+	case opcode17BOR:
+		val = Word(s.b | s.a)
+	case opcode17XOR:
+		val = Word(s.b ^ s.a)
+	case opcode17SHR:
+		val = Word(s.b >> s.a)
+		s.SetEX(Word((s.b << 16) >> s.a))
+	case opcode17ASR:
+		val = Word(sb >> s.a)
+		s.SetEX(Word((s.b << 16) >> s.a))
+	case opcode17SHL:
+		result := s.b << s.a
+		val = Word(result)
+		s.SetEX(Word(result >> 16))
+	case opcode17IFB:
+		skip = !((s.b & s.a) != 0)
+		s.address = Address{}
+	case opcode17IFC:
+		skip = !((s.b & s.a) == 0)
+		s.address = Address{}
+	case opcode17IFE:
+		skip = !(s.b == s.a)
+		s.address = Address{}
+	case opcode17IFN:
+		skip = !(s.b != s.a)
+		s.address = Address{}
+	case opcode17IFG:
+		skip = !(s.b > s.a)
+		s.address = Address{}
+	case opcode17IFA:
+		skip = !(sb > sa)
+		s.address = Address{}
+	case opcode17IFL:
+		skip = !(s.b < s.a)
+		s.address = Address{}
+	case opcode17IFU:
+		skip = !(sb < sa)
+		s.address = Address{}
+	case opcode17ADX:
+		result := s.b + s.a + uint32(s.EX())
+		val = Word(result)
+		if result > 0xffff {
+			s.SetEX(0x0001)
+		} else {
+			s.SetEX(0)
+		}
+	case opcode17SBX:
+		result := int32(s.b) - int32(s.a) + int32(int16(s.EX()))
+		val = Word(result)
+		if result < 0 {
+			s.SetEX(0xffff)
+		} else if result > 0xffff {
+			s.SetEX(0x0001)
+		} else {
+			s.SetEX(0)
+		}
+	case opcode17STI:
+		val = Word(s.a)
+		s.SetI(s.I() + 1)
+		s.SetJ(s.J() + 1)
+	case opcode17STD:
+		val = Word(s.a)
+		s.SetI(s.I() - 1)
+		s.SetJ(s.J() - 1)
+	case opcode17ExtJSR:
+		val = s.PC()
+		s.DecrSP() // PUSH
+		s.address = Address{
+			addressType: addressTypeMemory,
+			index:       s.SP(),
+		}
+		s.SetPC(Word(s.a))
+	case opcode17ExtINT:
+		err = s.Interrupt(Word(s.a))
+		s.address = Address{}
+	case opcode17ExtIAG:
+		val = s.IA()
+	case opcode17ExtIAS:
+		s.SetIA(Word(s.a))
+		s.address = Address{}
+	case opcode17ExtRFI:
+		s.queueing = false
+		s.SetA(s.Ram.Load(s.SP()))
+		s.IncrSP()
+		s.SetPC(s.Ram.Load(s.SP()))
+		s.IncrSP()
+		s.address = Address{}
+	case opcode17ExtIAQ:
+		s.queueing = s.a != 0
+		s.address = Address{}
+	case opcode17ExtHWN:
+		val = Word(len(s.Devices))
+	case opcode17ExtHWQ:
+		var id, manufacturer uint32
+		var version Word
+		if dev := s.device(Word(s.a)); dev != nil {
+			id, version, manufacturer = dev.HardwareID(), dev.HardwareVersion(), dev.Manufacturer()
+		}
+		s.SetA(Word(id))
+		s.SetB(Word(id >> 16))
+		s.SetC(version)
+		s.SetX(Word(manufacturer))
+		s.SetY(Word(manufacturer >> 16))
+		s.address = Address{}
+	case opcode17ExtHWI:
+		if dev := s.device(Word(s.a)); dev != nil {
+			s.stall, err = dev.HandleInterrupt(s)
+		}
+		s.address = Address{}
+	case opcodeStall:
+		// nothing to do
+	default:
+		// cycleCost17 should have already caught this
+		panic("Unexpected opcode")
+	}
+	return
+}
+
 func decodeOpcode(value Word) (oooo, aaaaaa, bbbbbb uint32) {
 	oooo = uint32(value) & 0xF
 	aaaaaa = uint32(value>>4) & 0x3F
@@ -201,6 +518,17 @@ func decodeOpcode(value Word) (oooo, aaaaaa, bbbbbb uint32) {
 	return
 }
 
+func decodeOpcode17(value Word) (ooooo, aaaaaa, bbbbb uint32) {
+	ooooo = uint32(value) & 0x1F
+	bbbbb = uint32(value>>5) & 0x1F
+	aaaaaa = uint32(value>>10) & 0x3F
+	if ooooo == 0 {
+		// special opcode
+		ooooo, bbbbb = bbbbb+opcodeExtendedOffset, 0
+	}
+	return
+}
+
 // cycleCost also doubles as an opcode validity test
 func cycleCost(opcode uint32) (uint, error) {
 	switch opcode {
@@ -218,6 +546,92 @@ func cycleCost(opcode uint32) (uint, error) {
 	return 0, &OpcodeError{byte(opcode)}
 }
 
+// cycleCost17 is the 1.7 equivalent of cycleCost
+func cycleCost17(opcode uint32) (uint, error) {
+	switch opcode {
+	case opcode17SET, opcode17AND, opcode17BOR, opcode17XOR,
+		opcode17SHR, opcode17ASR, opcode17SHL:
+		return 1, nil
+	case opcode17ADD, opcode17SUB, opcode17MUL, opcode17MLI:
+		return 2, nil
+	case opcode17DIV, opcode17DVI, opcode17MOD, opcode17MDI:
+		return 3, nil
+	case opcode17IFB, opcode17IFC, opcode17IFE, opcode17IFN,
+		opcode17IFG, opcode17IFA, opcode17IFL, opcode17IFU:
+		return 2, nil
+	case opcode17ADX, opcode17SBX:
+		return 3, nil
+	case opcode17STI, opcode17STD:
+		return 2, nil
+	case opcode17ExtJSR:
+		return 3, nil
+	case opcode17ExtINT:
+		return 4, nil
+	case opcode17ExtIAG, opcode17ExtIAS:
+		return 1, nil
+	case opcode17ExtRFI:
+		return 3, nil
+	case opcode17ExtIAQ:
+		return 2, nil
+	case opcode17ExtHWN:
+		return 2, nil
+	case opcode17ExtHWQ, opcode17ExtHWI:
+		return 4, nil
+	}
+	return 0, &OpcodeError{byte(opcode)}
+}
+
+// Interrupt queues an interrupt with the given message. This is how hardware
+// devices signal the DCPU-16, and is also used by the INT instruction.
+// Queued interrupts are triggered one at a time between instructions, unless
+// interrupt queueing is enabled. If IA is 0, the interrupt is ignored.
+// If more than 256 interrupts are queued, the DCPU-16 catches fire and an
+// *OnFireError is returned, both here and from all future calls to StepCycle.
+func (s *State) Interrupt(message Word) error {
+	if s.lastError != nil {
+		return s.lastError
+	}
+	if s.IA() == 0 {
+		return nil
+	}
+	if len(s.queue) >= maxQueuedInterrupts {
+		s.lastError = &OnFireError{message}
+		return s.lastError
+	}
+	s.queue = append(s.queue, message)
+	return nil
+}
+
+// triggerInterrupt pops the first interrupt off the queue and jumps to IA.
+// Queueing is enabled until the handler executes RFI.
+func (s *State) triggerInterrupt() error {
+	message := s.queue[0]
+	s.queue = s.queue[1:]
+	if s.IA() == 0 {
+		// IA was cleared after the interrupt was queued
+		return nil
+	}
+	s.queueing = true
+	for _, val := range [2]Word{s.PC(), s.A()} {
+		s.DecrSP()
+		if err := s.Ram.Store(s.SP(), val); err != nil {
+			return err
+		}
+	}
+	s.SetPC(s.IA())
+	s.SetA(message)
+	return nil
+}
+
+// decodeOperand dispatches to the fetchOperand variant for the current spec.
+// isA indicates whether this is the a operand, which matters for 1.7.
+func (s *State) decodeOperand(operand uint32, isA, loadWord bool) (val Word, address Address, delay bool) {
+	if s.Spec == Spec17 {
+		return s.fetchOperand17(operand, isA, loadWord)
+	}
+	return s.fetchOperand(operand, loadWord)
+}
+
 // fetchOperand fetches the value indicated by the operand.
 // If the operand needs to fetch the next word and loadWord is false,
 // it returns true in delay. Otherwise, if loadWord is true, or if it
@@ -303,9 +717,105 @@ func (s *State) fetchOperand(operand uint32, loadWord bool) (val Word, address A
 	return
 }
 
+// fetchOperand17 is the 1.7 equivalent of fetchOperand.
+// isA indicates whether the operand is in the a position, which determines
+// whether 0x18 is POP or PUSH.
+func (s *State) fetchOperand17(operand uint32, isA, loadWord bool) (val Word, address Address, delay bool) {
+	switch operand {
+	case 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07:
+		// register (A, B, C, X, Y, Z, I or J, in that order)
+		address = Address{
+			addressType: addressTypeRegister,
+			index:       Word(operand),
+		}
+	case 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f:
+		// [register]
+		address = Address{
+			addressType: addressTypeMemory,
+			index:       s.Registers[operand-0x08],
+		}
+	case 0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17:
+		// [register + next word]
+		if loadWord {
+			address = Address{
+				addressType: addressTypeMemory,
+				index:       s.Registers[operand-0x10] + s.nextWord(),
+			}
+		} else {
+			delay = true
+		}
+	case 0x18:
+		if isA {
+			// POP / [SP++]
+			address = Address{
+				addressType: addressTypeMemory,
+				index:       s.SP(),
+			}
+			s.IncrSP()
+		} else {
+			// PUSH / [--SP]
+			s.DecrSP()
+			address = Address{
+				addressType: addressTypeMemory,
+				index:       s.SP(),
+			}
+		}
+	case 0x19:
+		// PEEK / [SP]
+		address = Address{
+			addressType: addressTypeMemory,
+			index:       s.SP(),
+		}
+	case 0x1a:
+		// PICK n / [SP + next word]
+		if loadWord {
+			address = Address{
+				addressType: addressTypeMemory,
+				index:       s.SP() + s.nextWord(),
+			}
+		} else {
+			delay = true
+		}
+	case 0x1b, 0x1c, 0x1d:
+		// SP / PC / EX
+		address = Address{
+			addressType: addressTypeRegister,
+			index:       Word(operand) - 0x1b + registerSP,
+		}
+	case 0x1e:
+		// [next word]
+		if loadWord {
+			address = Address{
+				addressType: addressTypeMemory,
+				index:       s.nextWord(),
+			}
+		} else {
+			delay = true
+		}
+	case 0x1f:
+		// next word (literal)
+		if loadWord {
+			val = s.nextWord()
+		} else {
+			delay = true
+		}
+	default:
+		if operand > 0x3f || !isA {
+			// this shouldn't be possible
+			panic(fmt.Sprintf("Unexpected operand %#02x", operand))
+		}
+		// literal value 0xffff-0x1e (-1..30)
+		val = Word(operand) - 0x21
+	}
+	if address.addressType != addressTypeNone {
+		val = s.loadAddress(address)
+	}
+	return
+}
+
 // nextWord returns [PC++]
 func (s *State) nextWord() Word {
-	val := s.Ram.Load(s.PC())
+	val := s.Ram.fetch(s.PC())
 	s.IncrPC()
 	return val
 }
@@ -335,17 +845,35 @@ func (s *State) storeAddress(address Address, value Word) error {
 }
 
 // skipInstruction sets up the state to execute SET PC, a
-// where a is the address of the following instruction
+// where a is the address of the following instruction.
+// In 1.7, conditional instructions are skipped in a chain,
+// at a cost of one cycle per skipped instruction.
 func (s *State) skipInstruction() {
-	opcode := s.Ram.Load(s.PC())
-	count := instructionLength(opcode)
-	s.op = opcodeSET
-	s.b = uint32(s.PC() + count)
+	var count Word
+	var cost uint
+	if s.Spec == Spec17 {
+		for {
+			opcode := s.Ram.load(s.PC() + count)
+			count += instructionLength17(opcode)
+			cost++
+			if op, _, _ := decodeOpcode17(opcode); op < opcode17IFB || op > opcode17IFU {
+				break
+			}
+		}
+		s.op = opcode17SET
+		s.a = uint32(s.PC() + count)
+	} else {
+		opcode := s.Ram.load(s.PC())
+		count = instructionLength(opcode)
+		cost = 1
+		s.op = opcodeSET
+		s.b = uint32(s.PC() + count)
+	}
 	s.address = Address{
 		addressType: addressTypeRegister,
 		index:       registerPC,
 	}
-	s.cycleCost = 1
+	s.cycleCost = cost
 }
 
 func instructionLength(opcode Word) Word {
@@ -364,6 +892,22 @@ func instructionLength(opcode Word) Word {
 	return Word(length)
 }
 
+func instructionLength17(opcode Word) Word {
+	op, a, b := decodeOpcode17(opcode)
+	length := 1
+	operandCount := func(operand uint32) int {
+		if (operand >= 0x10 && operand <= 0x17) || operand == 0x1a || operand == 0x1e || operand == 0x1f {
+			return 1
+		}
+		return 0
+	}
+	length += operandCount(a)
+	if op < opcodeExtendedOffset {
+		length += operandCount(b)
+	}
+	return Word(length)
+}
+
 // debugging aids
 //
 func (a Address) String() string {
@@ -371,8 +915,7 @@ func (a Address) String() string {
 	case addressTypeNone:
 		return "<None>"
 	case addressTypeRegister:
-		reg := []string{"A", "B", "C", "X", "Y", "Z", "I", "J", "PC", "SP", "O"}[a.index]
-		return fmt.Sprintf("<%s>", reg)
+		return fmt.Sprintf("<%s>", RegisterNames[a.index])
 	case addressTypeMemory:
 		return fmt.Sprintf("<[%#02x]>", a.index)
 	}
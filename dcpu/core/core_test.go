@@ -1,6 +1,7 @@
 package core
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -247,3 +248,389 @@ func TestMemoryMappedIO(t *testing.T) {
 		}
 	}
 }
+
+// encode17 assembles a 1.7 basic instruction. Special instructions can be
+// built with an op of 0 and the special opcode in b.
+func encode17(op, b, a Word) Word {
+	return op | b<<5 | a<<10
+}
+
+func TestSpec17Instructions(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []Word
+		setup   func(s *State)
+		cycles  int
+		check   func(s *State) error
+	}{
+		{"SET A, next word", []Word{encode17(0x01, 0x00, 0x1f), 0x1234}, nil, 2,
+			func(s *State) error { return expectWord("A", s.A(), 0x1234) }},
+		{"ADD overflow", []Word{encode17(0x02, 0x00, 0x01)}, func(s *State) { s.SetA(0xffff); s.SetB(2) }, 2,
+			func(s *State) error { return expectWords("A", s.A(), 1, "EX", s.EX(), 1) }},
+		{"SUB underflow", []Word{encode17(0x03, 0x00, 0x22)}, nil, 2,
+			func(s *State) error { return expectWords("A", s.A(), 0xffff, "EX", s.EX(), 0xffff) }},
+		{"MLI", []Word{encode17(0x05, 0x00, 0x01)}, func(s *State) { s.SetA(0xfffe); s.SetB(3) }, 2,
+			func(s *State) error { return expectWords("A", s.A(), 0xfffa, "EX", s.EX(), 0xffff) }},
+		{"DVI", []Word{encode17(0x07, 0x00, 0x01)}, func(s *State) { s.SetA(0xfff9); s.SetB(2) }, 3,
+			func(s *State) error { return expectWord("A", s.A(), 0xfffd) }},
+		{"MDI", []Word{encode17(0x09, 0x00, 0x01)}, func(s *State) { s.SetA(0xfff9); s.SetB(16) }, 3,
+			func(s *State) error { return expectWord("A", s.A(), 0xfff9) }},
+		{"ASR", []Word{encode17(0x0e, 0x00, 0x25)}, func(s *State) { s.SetA(0x8001) }, 1,
+			func(s *State) error { return expectWords("A", s.A(), 0xf800, "EX", s.EX(), 0x1000) }},
+		{"ADX", []Word{encode17(0x1a, 0x00, 0x01)}, func(s *State) { s.SetA(0xffff); s.SetEX(1) }, 3,
+			func(s *State) error { return expectWords("A", s.A(), 0, "EX", s.EX(), 1) }},
+		{"SBX", []Word{encode17(0x1b, 0x00, 0x01)}, func(s *State) { s.SetB(1) }, 3,
+			func(s *State) error { return expectWords("A", s.A(), 0xffff, "EX", s.EX(), 0xffff) }},
+		{"STI", []Word{encode17(0x1e, 0x00, 0x01)}, func(s *State) { s.SetB(7) }, 2,
+			func(s *State) error { return expectWords("A", s.A(), 7, "I", s.I(), 1, "J", s.J(), 1) }},
+		{"STD", []Word{encode17(0x1f, 0x00, 0x01)}, func(s *State) { s.SetB(7) }, 2,
+			func(s *State) error { return expectWords("A", s.A(), 7, "I", s.I(), 0xffff, "J", s.J(), 0xffff) }},
+		{"JSR", []Word{encode17(0x00, 0x01, 0x31)}, nil, 3,
+			func(s *State) error {
+				return expectWords("PC", s.PC(), 0x10, "SP", s.SP(), 0xffff, "[SP]", s.Ram.Load(0xffff), 1)
+			}},
+		{"PUSH/POP", []Word{encode17(0x01, 0x18, 0x26), encode17(0x01, 0x00, 0x18)}, nil, 2,
+			func(s *State) error { return expectWords("A", s.A(), 5, "SP", s.SP(), 0) }},
+		{"PICK", []Word{encode17(0x01, 0x00, 0x1a), 0x0001}, func(s *State) { s.SetSP(0xfffe); s.Ram.Store(0xffff, 9) }, 2,
+			func(s *State) error { return expectWord("A", s.A(), 9) }},
+		{"chained skip", []Word{
+			encode17(0x12, 0x00, 0x21), // IFE A, 0
+			encode17(0x13, 0x00, 0x22), // IFN A, 1
+			encode17(0x01, 0x01, 0x26), // SET B, 5
+			encode17(0x01, 0x02, 0x27), // SET C, 6
+		}, func(s *State) { s.SetA(1) }, 4,
+			func(s *State) error { return expectWords("PC", s.PC(), 3, "B", s.B(), 0) }},
+		{"passing IF", []Word{
+			encode17(0x16, 0x00, 0x22), // IFL A, 1
+			encode17(0x01, 0x01, 0x26), // SET B, 5
+		}, nil, 3,
+			func(s *State) error { return expectWords("PC", s.PC(), 2, "B", s.B(), 5) }},
+	}
+	for _, test := range tests {
+		state := &State{Spec: Spec17}
+		if err := state.LoadProgram(test.program, 0); err != nil {
+			t.Fatal(err)
+		}
+		if test.setup != nil {
+			test.setup(state)
+		}
+		for i := 0; i < test.cycles; i++ {
+			if err := state.StepCycle(); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		if state.step != stateStepFetch {
+			t.Errorf("%s: Unexpectedly stopped mid-instruction after %d cycles", test.name, test.cycles)
+		}
+		if err := test.check(state); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestSpec17InvalidOpcode(t *testing.T) {
+	state := &State{Spec: Spec17}
+	if err := state.LoadProgram([]Word{0x0018}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := state.StepCycle().(*OpcodeError); !ok {
+		t.Errorf("Expected an OpcodeError, found %v", err)
+	}
+}
+
+func expectWord(name string, found, expected Word) error {
+	if found != expected {
+		return fmt.Errorf("Unexpected value for %s; expected %#x, found %#x", name, expected, found)
+	}
+	return nil
+}
+
+// expectWords takes triples of name, found, expected
+func expectWords(args ...interface{}) error {
+	for i := 0; i+2 < len(args); i += 3 {
+		if err := expectWord(args[i].(string), args[i+1].(Word), Word(args[i+2].(int))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSpec17Interrupts(t *testing.T) {
+	state := &State{Spec: Spec17}
+	program := []Word{
+		encode17(0x00, 0x0a, 0x25), // IAS 4
+		encode17(0x00, 0x08, 0x26), // INT 5
+		encode17(0x01, 0x02, 0x22), // SET C, 1
+		encode17(0x03, 0x1c, 0x22), // SUB PC, 1
+		encode17(0x01, 0x01, 0x00), // SET B, A
+		encode17(0x00, 0x0b, 0x21), // RFI 0
+	}
+	if err := state.LoadProgram(program, 0); err != nil {
+		t.Fatal(err)
+	}
+	// IAS (1) + INT (4) + SET B, A (1) + RFI (3) + SET C, 1 (1)
+	for i := 0; i < 10; i++ {
+		if err := state.StepCycle(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := expectWords("A", state.A(), 0, "B", state.B(), 5, "C", state.C(), 1,
+		"PC", state.PC(), 3, "SP", state.SP(), 0, "IA", state.IA(), 4); err != nil {
+		t.Error(err)
+	}
+	if state.queueing {
+		t.Error("Interrupt queueing unexpectedly left enabled")
+	}
+}
+
+func TestSpec17InterruptQueueOverflow(t *testing.T) {
+	state := &State{Spec: Spec17}
+	state.SetIA(0x100)
+	state.queueing = true
+	for i := 0; i < maxQueuedInterrupts; i++ {
+		if err := state.Interrupt(Word(i)); err != nil {
+			t.Fatalf("Unexpected error queueing interrupt %d: %v", i, err)
+		}
+	}
+	if _, ok := state.Interrupt(0xbeef).(*OnFireError); !ok {
+		t.Fatal("Expected the DCPU-16 to catch fire")
+	}
+	if _, ok := state.StepCycle().(*OnFireError); !ok {
+		t.Error("Expected StepCycle to keep returning the OnFireError")
+	}
+}
+
+type testDevice struct {
+	interrupts int
+}
+
+func (d *testDevice) HardwareID() uint32    { return 0x12345678 }
+func (d *testDevice) HardwareVersion() Word { return 0x0042 }
+func (d *testDevice) Manufacturer() uint32  { return 0x9abcdef0 }
+
+func (d *testDevice) HandleInterrupt(s *State) (uint, error) {
+	d.interrupts++
+	s.SetZ(s.A() + 1)
+	return 2, nil
+}
+
+func TestSpec17Hardware(t *testing.T) {
+	dev := new(testDevice)
+	state := &State{Spec: Spec17, Devices: []Device{new(testDevice), dev}}
+	program := []Word{
+		encode17(0x00, 0x10, 0x06), // HWN I
+		encode17(0x00, 0x11, 0x22), // HWQ 1
+		encode17(0x00, 0x12, 0x22), // HWI 1
+		encode17(0x00, 0x12, 0x25), // HWI 4
+	}
+	if err := state.LoadProgram(program, 0); err != nil {
+		t.Fatal(err)
+	}
+	// HWN (2) + HWQ (4)
+	for i := 0; i < 6; i++ {
+		if err := state.StepCycle(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := expectWords("I", state.I(), 2, "A", state.A(), 0x5678, "B", state.B(), 0x1234,
+		"C", state.C(), 0x42, "X", state.X(), 0xdef0, "Y", state.Y(), 0x9abc); err != nil {
+		t.Error(err)
+	}
+	// HWI takes 4 cycles plus the 2 requested by the device
+	for i := 0; i < 6; i++ {
+		if err := state.StepCycle(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if state.step != stateStepFetch || state.PC() != 3 {
+		t.Errorf("Expected HWI to take 6 cycles; PC is %#x", state.PC())
+	}
+	if err := expectWord("Z", state.Z(), 0x5679); err != nil {
+		t.Error(err)
+	}
+	// HWI to a missing device is ignored
+	for i := 0; i < 4; i++ {
+		if err := state.StepCycle(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dev.interrupts != 1 {
+		t.Errorf("Expected 1 interrupt, found %d", dev.interrupts)
+	}
+}
+
+func TestStepInstruction(t *testing.T) {
+	state := &State{Spec: Spec17}
+	program := []Word{
+		encode17(0x01, 0x1e, 0x26), 0x1000, // SET [0x1000], 5
+		encode17(0x12, 0x00, 0x22),         // IFE A, 1
+		encode17(0x01, 0x01, 0x28),         // SET B, 7
+		encode17(0x00, 0x01, 0x1f), 0x0010, // JSR 0x10
+	}
+	if err := state.LoadProgram(program, 0); err != nil {
+		t.Fatal(err)
+	}
+	inst, err := state.StepInstruction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := inst.B.Address.Memory(); !ok || addr != 0x1000 || inst.A.Code != 0x26 || inst.A.Value != 5 || !inst.A.Address.IsEmpty() {
+		t.Errorf("Unexpected operands %+v, %+v", inst.A, inst.B)
+	}
+	if addr, _ := inst.Dest.Memory(); inst.Address != 0 || inst.Opcode != 0x01 || inst.Special || inst.Cycles != 2 || !inst.Stored || addr != 0x1000 || inst.Value != 5 {
+		t.Errorf("Unexpected record %+v", inst)
+	}
+	if !state.AtInstructionBoundary() {
+		t.Error("Expected to be at an instruction boundary")
+	}
+
+	inst, err = state.StepInstruction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg, ok := inst.B.Address.Register(); inst.Address != 2 || inst.Opcode != 0x12 || !inst.Skipped || inst.Stored || inst.Cycles != 3 || !ok || RegisterNames[reg] != "A" {
+		t.Errorf("Unexpected record %+v", inst)
+	}
+
+	inst, err = state.StepInstruction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, _ := inst.Dest.Memory(); inst.Address != 4 || inst.Opcode != 0x01 || !inst.Special || inst.A.Value != 0x10 || inst.Cycles != 4 || addr != 0xffff || inst.Value != 6 {
+		t.Errorf("Unexpected record %+v", inst)
+	}
+	if state.PC() != 0x10 {
+		t.Errorf("Expected PC to be 0x10, found %#x", state.PC())
+	}
+
+	// a failing instruction still has its address recorded
+	state.Ram.Store(0x10, 0x0018)
+	if inst, err = state.StepInstruction(); err == nil || inst.Address != 0x10 {
+		t.Errorf("Expected an error at 0x10, found %v at %#x", err, inst.Address)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	state := &State{Spec: Spec17}
+	program := []Word{
+		encode17(0x01, 0x06, 0x21),         // SET I, 0
+		encode17(0x01, 0x16, 0x06), 0x1000, // SET [0x1000+I], I
+		encode17(0x02, 0x06, 0x22), // ADD I, 1
+		encode17(0x01, 0x1c, 0x22), // SET PC, 1
+	}
+	if err := state.LoadProgram(program, 0); err != nil {
+		t.Fatal(err)
+	}
+	state.EnableHistory(20, 4)
+	// the registers and the written memory after each instruction
+	type snapshot struct {
+		registers Registers
+		memory    [16]Word
+	}
+	take := func() (snap snapshot) {
+		snap.registers = state.Registers
+		copy(snap.memory[:], state.Ram.GetSlice(0x1000, 0x1010))
+		return
+	}
+	var snaps []snapshot
+	for i := 0; i < 30; i++ {
+		if _, err := state.StepInstruction(); err != nil {
+			t.Fatal(err)
+		}
+		snaps = append(snaps, take())
+	}
+	expect := func(what string, instructions int) {
+		if snap := take(); snap != snaps[instructions-1] {
+			t.Errorf("%s: expected the state after %d instructions, found %+v", what, instructions, snap)
+		}
+	}
+	if n := state.HistoryLen(); n != 20 {
+		t.Errorf("Expected 20 instructions of history, found %d", n)
+	}
+	if cycles, err := state.StepBack(); err != nil || cycles != 2 {
+		t.Errorf("Expected to undo 2 cycles, found %d (%v)", cycles, err)
+	}
+	expect("StepBack", 29)
+	if _, err := state.Rewind(10); err != nil {
+		t.Fatal(err)
+	}
+	expect("Rewind", 19)
+
+	// I is 4 for the write at the 14th instruction
+	if steps, _, err := state.StepBackToWrite(0x1004); err != nil || steps != 6 {
+		t.Errorf("Expected to step back 6 instructions, found %d (%v)", steps, err)
+	}
+	expect("StepBackToWrite", 13)
+	if _, _, err := state.StepBackToWrite(0x1000); err != ErrNoHistory {
+		t.Errorf("Expected ErrNoHistory, found %v", err)
+	}
+	expect("StepBackToWrite outside the window", 13)
+
+	// part of an instruction is undone by itself
+	if err := state.StepCycle(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.StepBack(); err != nil {
+		t.Fatal(err)
+	}
+	expect("StepBack in the middle of an instruction", 13)
+
+	if steps, _, err := state.StepBackUntil(func() bool { return false }); err != ErrNoHistory || steps != 3 {
+		t.Errorf("Expected to run out of history after 3 steps, found %d (%v)", steps, err)
+	}
+	expect("StepBackUntil", 10)
+
+	// running forwards again repeats what happened
+	if _, err := state.StepInstruction(); err != nil {
+		t.Fatal(err)
+	}
+	expect("StepInstruction", 11)
+}
+
+func TestWatch(t *testing.T) {
+	state := &State{Spec: Spec17}
+	program := []Word{
+		encode17(0x01, 0x1e, 0x26), 0x1000, // SET [0x1000], 5
+		encode17(0x01, 0x00, 0x1e), 0x1000, // SET A, [0x1000]
+		encode17(0x01, 0x1c, 0x25), // SET PC, 4
+	}
+	if err := state.LoadProgram(program, 0); err != nil {
+		t.Fatal(err)
+	}
+	var accesses []MemoryAccess
+	record := func(access MemoryAccess) { accesses = append(accesses, access) }
+	data := state.Ram.Watch(Region{0x1000, 1}, AccessRead|AccessWrite, record)
+	state.Ram.Watch(Region{0x0002, 2}, AccessExecute, record)
+	// only the CPU's accesses are noticed
+	state.Ram.Store(0x1000, 3)
+	for i := 0; i < 3; i++ {
+		if _, err := state.StepInstruction(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []MemoryAccess{
+		{AccessRead, 0x1000, 3, 3, 0},
+		{AccessWrite, 0x1000, 5, 3, 0},
+		{AccessExecute, 0x0002, program[2], program[2], 2},
+		{AccessExecute, 0x0003, 0x1000, 0x1000, 2},
+		{AccessRead, 0x1000, 5, 5, 2},
+	}
+	if fmt.Sprint(accesses) != fmt.Sprint(expected) {
+		t.Errorf("Expected accesses %v, found %v", expected, accesses)
+	}
+
+	accesses = nil
+	state.Ram.Unwatch(data)
+	state.SetPC(0)
+	for i := 0; i < 2; i++ {
+		if _, err := state.StepInstruction(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(accesses) != 2 || accesses[0].Access != AccessExecute {
+		t.Errorf("Expected only the execute watch to be hit, found %v", accesses)
+	}
+	if state.A() != 5 {
+		t.Errorf("Expected A to be 5, found %#x", state.A())
+	}
+}
@@ -0,0 +1,25 @@
+package core
+
+// Device is a piece of hardware attached to the DCPU-16.
+// Devices are enumerated by the 1.7 HWN, HWQ and HWI instructions.
+type Device interface {
+	// HardwareID is the 32-bit id reported by HWQ in A and B
+	HardwareID() uint32
+	// HardwareVersion is the version reported by HWQ in C
+	HardwareVersion() Word
+	// Manufacturer is the 32-bit manufacturer id reported by HWQ in X and Y
+	Manufacturer() uint32
+	// HandleInterrupt is invoked by HWI. The device may inspect and modify
+	// the state, typically based on the registers. It returns the number of
+	// cycles the interrupt takes beyond the cost of HWI itself.
+	// If an error is returned, the machine is halted.
+	HandleInterrupt(s *State) (cycles uint, err error)
+}
+
+// device returns the device at the given index, or nil if there is none
+func (s *State) device(index Word) Device {
+	if int(index) < len(s.Devices) {
+		return s.Devices[index]
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package core
+
+import (
+	"errors"
+)
+
+// ErrNoHistory is returned when stepping back past the oldest
+// recorded instruction.
+var ErrNoHistory = errors.New("no more execution history")
+
+// history lets a State run backwards. Every instruction gets an undo entry
+// holding the registers and other state from before it started, and the old
+// value of every word of memory it wrote. Entries are kept in a ring that
+// holds the last window instructions. A full snapshot is also taken every so
+// often, which lets Rewind skip most of the undo entries when going back a
+// long way.
+type history struct {
+	entries     []undoEntry // ring of undo entries, indexed by instruction number
+	count       int         // number of instructions begun, including the current one
+	length      int         // number of entries in the ring
+	interval    int         // instructions between checkpoints, or 0 for none
+	checkpoints []checkpoint
+}
+
+type undoEntry struct {
+	registers Registers
+	pc        Word
+	halted    bool
+	queueing  bool
+	queue     []Word
+	writes    []undoWrite // old values, in the order they were overwritten
+	cycles    uint
+}
+
+type undoWrite struct {
+	address, value Word
+}
+
+// checkpoint is the state at the start of an instruction. Mapped memory
+// isn't in snapshots, so it's saved separately.
+type checkpoint struct {
+	index  int
+	snap   *Snapshot
+	mapped [][]Word
+}
+
+// EnableHistory starts recording enough history to step back up to window
+// instructions. A checkpoint is taken every interval instructions, if
+// interval isn't 0. Any history that was already recorded is forgotten.
+func (s *State) EnableHistory(window, interval int) {
+	if window <= 0 {
+		s.history = nil
+		return
+	}
+	s.history = &history{entries: make([]undoEntry, window), interval: interval}
+}
+
+// DisableHistory stops recording history and forgets what was recorded
+func (s *State) DisableHistory() {
+	s.history = nil
+}
+
+// HistoryLen returns the number of instructions that can be stepped back
+// over, including the current one if it's only partly executed.
+func (s *State) HistoryLen() int {
+	if s.history == nil {
+		return 0
+	}
+	return s.history.length
+}
+
+// StepBack undoes the last instruction, or returns to the start of the
+// current instruction if it's only partly executed. Changes made to devices
+// aren't undone, but writes they made to memory during HWI are. Returns the
+// number of cycles that were undone.
+func (s *State) StepBack() (cycles uint, err error) {
+	if s.history == nil || s.history.length == 0 {
+		return 0, ErrNoHistory
+	}
+	return s.history.undo(s), nil
+}
+
+// StepBackUntil steps back one instruction at a time until f returns true.
+// If the history runs out first, ErrNoHistory is returned and the State is
+// left at the oldest recorded instruction. Returns the number of instructions
+// and cycles that were undone.
+func (s *State) StepBackUntil(f func() bool) (steps int, cycles uint, err error) {
+	for {
+		n, err := s.StepBack()
+		if err != nil {
+			return steps, cycles, err
+		}
+		steps++
+		cycles += n
+		if f() {
+			return steps, cycles, nil
+		}
+	}
+}
+
+// StepBackToWrite goes back to just before the last instruction that wrote
+// to address, so that PC is at the instruction. If no recorded instruction
+// wrote to address, ErrNoHistory is returned and the State isn't changed.
+func (s *State) StepBackToWrite(address Word) (steps int, cycles uint, err error) {
+	h := s.history
+	if h == nil {
+		return 0, 0, ErrNoHistory
+	}
+	for i := h.count - 1; i >= h.count-h.length; i-- {
+		for _, write := range h.entry(i).writes {
+			if write.address == address {
+				steps = h.count - i
+				cycles, err = s.Rewind(steps)
+				return
+			}
+		}
+	}
+	return 0, 0, ErrNoHistory
+}
+
+// Rewind steps back n instructions, using a checkpoint to avoid undoing them
+// one at a time where possible. Returns the number of cycles undone.
+func (s *State) Rewind(n int) (cycles uint, err error) {
+	h := s.history
+	if h == nil || n > h.length {
+		return 0, ErrNoHistory
+	}
+	target := h.count - n
+	for i := target; i < h.count; i++ {
+		cycles += h.entry(i).cycles
+	}
+	// the earliest checkpoint at or after the target is the closest one
+	for _, cp := range h.checkpoints {
+		if cp.index >= target && cp.index < h.count {
+			h.restore(s, cp)
+			break
+		}
+	}
+	for h.count > target {
+		h.undo(s)
+	}
+	return cycles, nil
+}
+
+func (h *history) entry(index int) *undoEntry {
+	return &h.entries[index%len(h.entries)]
+}
+
+// begin starts the undo entry for the instruction that's about to start
+func (h *history) begin(s *State) {
+	if h.length == len(h.entries) {
+		h.length--
+	}
+	if h.interval > 0 && h.count%h.interval == 0 {
+		h.checkpoint(s)
+	}
+	e := h.entry(h.count)
+	e.registers, e.pc, e.halted, e.queueing = s.Registers, s.pc, s.halted, s.queueing
+	e.queue = append(e.queue[:0], s.queue...)
+	e.writes = e.writes[:0]
+	e.cycles = 0
+	h.count++
+	h.length++
+	// forget checkpoints that are older than any entry
+	oldest := h.count - h.length
+	for len(h.checkpoints) > 0 && h.checkpoints[0].index < oldest {
+		h.checkpoints = h.checkpoints[1:]
+	}
+}
+
+// write notes the old value of a word that's about to be written
+func (h *history) write(address, old Word) {
+	e := h.entry(h.count - 1)
+	e.writes = append(e.writes, undoWrite{address, old})
+}
+
+// undo reverts the most recent entry, returning the cycles it took
+func (h *history) undo(s *State) uint {
+	e := h.entry(h.count - 1)
+	for i := len(e.writes) - 1; i >= 0; i-- {
+		s.Ram.poke(e.writes[i].address, e.writes[i].value)
+	}
+	s.Registers, s.pc, s.halted, s.queueing = e.registers, e.pc, e.halted, e.queueing
+	s.queue = append([]Word(nil), e.queue...)
+	s.step = stateStepFetch
+	s.stall = 0
+	s.lastError = nil
+	s.record = Instruction{}
+	h.count--
+	h.length--
+	// checkpoints after the current instruction are in the undone future
+	for len(h.checkpoints) > 0 && h.checkpoints[len(h.checkpoints)-1].index > h.count {
+		h.checkpoints = h.checkpoints[:len(h.checkpoints)-1]
+	}
+	return e.cycles
+}
+
+func (h *history) checkpoint(s *State) {
+	cp := checkpoint{index: h.count, snap: s.Snapshot()}
+	for _, region := range s.Ram.mapped {
+		words := make([]Word, region.Length)
+		for i := range words {
+			words[i] = region.get(Word(i))
+		}
+		cp.mapped = append(cp.mapped, words)
+	}
+	h.checkpoints = append(h.checkpoints, cp)
+}
+
+// restore returns to a checkpoint, forgetting every entry after it
+func (h *history) restore(s *State, cp checkpoint) {
+	s.restore(cp.snap)
+	if len(cp.mapped) == len(s.Ram.mapped) {
+		for i, region := range s.Ram.mapped {
+			for j, val := range cp.mapped[i] {
+				region.set(Word(j), val)
+			}
+		}
+	}
+	h.length -= h.count - cp.index
+	h.count = cp.index
+	for len(h.checkpoints) > 0 && h.checkpoints[len(h.checkpoints)-1].index > h.count {
+		h.checkpoints = h.checkpoints[:len(h.checkpoints)-1]
+	}
+}
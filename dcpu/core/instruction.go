@@ -0,0 +1,73 @@
+package core
+
+// Instruction is a record of a single executed instruction, as returned by
+// StepInstruction.
+type Instruction struct {
+	Address Word    // the address of the first word of the instruction
+	Word    Word    // the first word of the instruction, which holds the opcode
+	Opcode  Word    // the opcode, as numbered by the spec being executed
+	Special bool    // whether Opcode is a special (1.1 non-basic) opcode
+	A, B    Operand // the operands, as named by the spec; special opcodes only have A
+	Cycles  uint    // the number of cycles the instruction took
+	Skipped bool    // whether this was a conditional instruction that failed
+	Stored  bool    // whether a value was written to Dest
+	Dest    Address // the location that was written
+	Value   Word    // the value that was written
+}
+
+// Operand is a decoded instruction operand
+type Operand struct {
+	Code    Word    // the operand as it was encoded in the instruction
+	Value   Word    // the value of the operand when it was decoded
+	Address Address // the effective address, which is empty for literals
+}
+
+// Register returns the index of the register that a refers to, as used by
+// RegisterNames, or false if a doesn't refer to a register.
+func (a Address) Register() (int, bool) {
+	return int(a.index), a.addressType == addressTypeRegister
+}
+
+// Memory returns the memory address that a refers to, or false if
+// it doesn't refer to memory.
+func (a Address) Memory() (Word, bool) {
+	return a.index, a.addressType == addressTypeMemory
+}
+
+// IsEmpty returns true if a doesn't refer to anything
+func (a Address) IsEmpty() bool {
+	return a.addressType == addressTypeNone
+}
+
+// StepInstruction steps until the next instruction boundary and returns a
+// record of the instruction that finished. If the State was in the middle of
+// an instruction, only the rest of it is run, but the record still describes
+// the whole thing except for Cycles. Errors are returned as by StepCycle, along
+// with what was recorded of the failing instruction.
+func (s *State) StepInstruction() (Instruction, error) {
+	for {
+		if err := s.StepCycle(); err != nil {
+			return s.record, err
+		}
+		if s.step == stateStepFetch {
+			return s.record, nil
+		}
+	}
+}
+
+// LastInstruction returns the record of the instruction that finished most
+// recently. In the middle of an instruction, or after an error, it describes
+// as much of the current instruction as has run.
+func (s *State) LastInstruction() Instruction {
+	return s.record
+}
+
+// startRecord begins the record of the instruction that was just fetched
+func (s *State) startRecord(word Word) {
+	s.record = Instruction{Address: s.pc, Word: word, Cycles: s.record.Cycles}
+	if s.op >= opcodeExtendedOffset {
+		s.record.Opcode, s.record.Special = Word(s.op-opcodeExtendedOffset), true
+	} else {
+		s.record.Opcode = Word(s.op)
+	}
+}
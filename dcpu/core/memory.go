@@ -21,9 +21,21 @@ type Memory struct {
 	ram       [0x10000]Word
 	protected []Region
 	mapped    []MMIORegion
+	journal   *history // records old values while an instruction executes
+	watches   []watch
+	nextWatch int
+	cpu       *Word // the address of the executing instruction, while the CPU is accessing memory
 }
 
 func (m *Memory) Load(offset Word) Word {
+	val := m.load(offset)
+	if m.cpu != nil && len(m.watches) > 0 {
+		m.notify(AccessRead, offset, val, val)
+	}
+	return val
+}
+
+func (m *Memory) load(offset Word) Word {
 	for _, region := range m.mapped {
 		if region.Contains(offset) {
 			return region.get(offset - region.Start)
@@ -32,7 +44,34 @@ func (m *Memory) Load(offset Word) Word {
 	return m.ram[offset]
 }
 
+// fetch loads a word of an instruction that's about to execute
+func (m *Memory) fetch(offset Word) Word {
+	val := m.load(offset)
+	if m.cpu != nil && len(m.watches) > 0 {
+		m.notify(AccessExecute, offset, val, val)
+	}
+	return val
+}
+
 func (m *Memory) Store(offset, value Word) error {
+	watched := m.cpu != nil && len(m.watches) > 0
+	var old Word
+	if m.journal != nil || watched {
+		old = m.load(offset)
+	}
+	if m.journal != nil {
+		m.journal.write(offset, old)
+	}
+	if err := m.store(offset, value); err != nil {
+		return err
+	}
+	if watched {
+		m.notify(AccessWrite, offset, value, old)
+	}
+	return nil
+}
+
+func (m *Memory) store(offset, value Word) error {
 	for _, region := range m.mapped {
 		if region.Contains(offset) {
 			return region.set(offset-region.Start, value)
@@ -49,6 +88,17 @@ func (m *Memory) Store(offset, value Word) error {
 	return nil
 }
 
+// poke stores a value without checking protection, for undoing writes
+func (m *Memory) poke(offset, value Word) {
+	for _, region := range m.mapped {
+		if region.Contains(offset) {
+			region.set(offset-region.Start, value)
+			return
+		}
+	}
+	m.ram[offset] = value
+}
+
 // GetSlice is intended for testing purposes
 func (m Memory) GetSlice(start, end Word) []Word {
 	return m.ram[start:end]
@@ -29,3 +29,51 @@ const (
 	opcodeExtJSR = 0x101
 )
 const opcodeExtendedOffset = 0x100
+
+// DCPU-16 1.7 basic opcodes
+const (
+	opcode17SET = 0x01
+	opcode17ADD = 0x02
+	opcode17SUB = 0x03
+	opcode17MUL = 0x04
+	opcode17MLI = 0x05
+	opcode17DIV = 0x06
+	opcode17DVI = 0x07
+	opcode17MOD = 0x08
+	opcode17MDI = 0x09
+	opcode17AND = 0x0a
+	opcode17BOR = 0x0b
+	opcode17XOR = 0x0c
+	opcode17SHR = 0x0d
+	opcode17ASR = 0x0e
+	opcode17SHL = 0x0f
+	opcode17IFB = 0x10
+	opcode17IFC = 0x11
+	opcode17IFE = 0x12
+	opcode17IFN = 0x13
+	opcode17IFG = 0x14
+	opcode17IFA = 0x15
+	opcode17IFL = 0x16
+	opcode17IFU = 0x17
+	opcode17ADX = 0x1a
+	opcode17SBX = 0x1b
+	opcode17STI = 0x1e
+	opcode17STD = 0x1f
+)
+
+// DCPU-16 1.7 special opcodes (internal representation)
+const (
+	opcode17ExtJSR = 0x101
+	opcode17ExtINT = 0x108
+	opcode17ExtIAG = 0x109
+	opcode17ExtIAS = 0x10a
+	opcode17ExtRFI = 0x10b
+	opcode17ExtIAQ = 0x10c
+	opcode17ExtHWN = 0x110
+	opcode17ExtHWQ = 0x111
+	opcode17ExtHWI = 0x112
+)
+
+// opcodeStall is an internal opcode that spends extra cycles at the end
+// of an instruction, such as when a device takes a while to handle HWI
+const opcodeStall = 0x200
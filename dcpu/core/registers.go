@@ -1,5 +1,7 @@
 package core
 
+import "strings"
+
 const (
 	registerA = iota
 	registerB
@@ -12,6 +14,7 @@ const (
 	registerSP
 	registerPC
 	registerO
+	registerIA
 	registerCount
 )
 
@@ -116,3 +119,39 @@ func (r *Registers) O() Word {
 func (r *Registers) SetO(value Word) {
 	r[registerO] = value
 }
+
+func (r *Registers) IA() Word {
+	return r[registerIA]
+}
+
+func (r *Registers) SetIA(value Word) {
+	r[registerIA] = value
+}
+
+// EX is the 1.7 name for the O register
+func (r *Registers) EX() Word {
+	return r[registerO]
+}
+
+func (r *Registers) SetEX(value Word) {
+	r[registerO] = value
+}
+
+// RegisterNames holds the name of every register, indexed the same way
+// as Registers. O is named EX in the 1.7 spec.
+var RegisterNames = [registerCount]string{"A", "B", "C", "X", "Y", "Z", "I", "J", "SP", "PC", "O", "IA"}
+
+// RegisterIndex returns the index into Registers of the named register.
+// Names are case-insensitive, and EX is accepted as an alias for O.
+func RegisterIndex(name string) (int, bool) {
+	name = strings.ToUpper(name)
+	if name == "EX" {
+		return registerO, true
+	}
+	for i, n := range RegisterNames {
+		if n == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,156 @@
+package core
+
+import "errors"
+
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// Snapshot holds everything needed to resume a State exactly where it left
+// off, even in the middle of an instruction. Attached devices and
+// memory-mapped regions aren't part of it, as they belong to whoever
+// attached them.
+type Snapshot struct {
+	Registers Registers
+	Ram       []Word   // all 0x10000 words of RAM, ignoring mapped regions
+	Protected []Region // protected regions, in ascending order
+	Spec      SpecVersion
+	Step      int
+	CycleCost uint
+	Op, A, B  uint32
+	Delayed   bool
+	Address   SnapshotAddress
+	Queue     []Word
+	Queueing  bool
+	Stall     uint
+	PC        Word
+	Halted    bool
+}
+
+// SnapshotAddress is an Address, with its fields exported so it
+// can be serialized.
+type SnapshotAddress struct {
+	Type  int
+	Index Word
+}
+
+// Snapshot returns a copy of the state. An error that stopped the state
+// isn't included, so the restored state will try to run again.
+func (s *State) Snapshot() *Snapshot {
+	snap := &Snapshot{
+		Registers: s.Registers,
+		Ram:       make([]Word, len(s.Ram.ram)),
+		Protected: append([]Region(nil), s.Ram.protected...),
+		Spec:      s.Spec,
+		Step:      s.step,
+		CycleCost: s.cycleCost,
+		Op:        s.op,
+		A:         s.a,
+		B:         s.b,
+		Delayed:   s.delayed,
+		Address:   SnapshotAddress{s.address.addressType, s.address.index},
+		Queue:     append([]Word(nil), s.queue...),
+		Queueing:  s.queueing,
+		Stall:     s.stall,
+		PC:        s.pc,
+		Halted:    s.halted,
+	}
+	copy(snap.Ram, s.Ram.ram[:])
+	return snap
+}
+
+// Restore replaces the state with the snapshot. Devices and memory-mapped
+// regions are left alone. The record of the last instruction isn't part of
+// the snapshot, so LastInstruction is empty until the next one finishes.
+// Any recorded history is forgotten.
+func (s *State) Restore(snap *Snapshot) error {
+	if err := snap.Validate(); err != nil {
+		return err
+	}
+	if h := s.history; h != nil {
+		s.EnableHistory(len(h.entries), h.interval)
+	}
+	s.restore(snap)
+	return nil
+}
+
+// Validate checks that the snapshot could have been taken from a State, so
+// that restoring it can't leave the State unable to run. It returns
+// ErrOutOfBounds if the RAM is the wrong size, and ErrInvalidSnapshot for
+// anything else.
+func (snap *Snapshot) Validate() error {
+	if len(snap.Ram) != len(Memory{}.ram) {
+		return ErrOutOfBounds
+	}
+	if snap.Spec != Spec11 && snap.Spec != Spec17 {
+		return ErrInvalidSnapshot
+	}
+	if snap.Step < stateStepFetch || snap.Step > stateStepExecute {
+		return ErrInvalidSnapshot
+	}
+	if !snap.validOperation() {
+		return ErrInvalidSnapshot
+	}
+	switch snap.Address.Type {
+	case addressTypeNone, addressTypeMemory:
+	case addressTypeRegister:
+		if snap.Address.Index >= registerCount {
+			return ErrInvalidSnapshot
+		}
+	default:
+		return ErrInvalidSnapshot
+	}
+	if len(snap.Queue) > maxQueuedInterrupts {
+		return ErrInvalidSnapshot
+	}
+	return nil
+}
+
+// validOperation returns whether the opcode and operands could have been
+// decoded by the snapshot's spec. Until they're decoded, A and B hold operand
+// codes, and afterwards they hold the operands' values.
+func (snap *Snapshot) validOperation() bool {
+	if snap.Step == stateStepFetch {
+		// fetching the next instruction replaces them
+		return true
+	}
+	var err error
+	maxA, maxB := uint32(0x3f), uint32(0x3f)
+	if snap.Spec == Spec17 {
+		_, err = cycleCost17(snap.Op)
+		if snap.Op == opcodeStall && snap.Step == stateStepExecute {
+			// an instruction spending the extra cycles a device asked for
+			err = nil
+		}
+		maxB = 0x1f
+	} else {
+		_, err = cycleCost(snap.Op)
+	}
+	if err != nil {
+		return false
+	}
+	switch snap.Step {
+	case stateStepDecodeA:
+		return snap.A <= maxA && snap.B <= maxB
+	case stateStepDecodeB:
+		return snap.A <= 0xffff && snap.B <= maxB
+	}
+	return snap.A <= 0xffff && snap.B <= 0xffff
+}
+
+func (s *State) restore(snap *Snapshot) {
+	s.Registers = snap.Registers
+	copy(s.Ram.ram[:], snap.Ram)
+	s.Ram.protected = append([]Region(nil), snap.Protected...)
+	s.Spec = snap.Spec
+	s.lastError = nil
+	s.step = snap.Step
+	s.cycleCost = snap.CycleCost
+	s.op, s.a, s.b = snap.Op, snap.A, snap.B
+	s.delayed = snap.Delayed
+	s.address = Address{snap.Address.Type, snap.Address.Index}
+	s.queue = append([]Word(nil), snap.Queue...)
+	s.queueing = snap.Queueing
+	s.stall = snap.Stall
+	s.pc = snap.PC
+	s.halted = snap.Halted
+	s.record = Instruction{}
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"strings"
+)
+
+// Access is a set of the kinds of memory access a watch observes
+type Access int
+
+const (
+	AccessRead    Access = 1 << iota // loading a value, which includes decoding an operand
+	AccessWrite                      // storing a value
+	AccessExecute                    // fetching a word of an instruction
+)
+
+func (a Access) String() string {
+	var kinds []string
+	for _, kind := range []struct {
+		access Access
+		name   string
+	}{{AccessRead, "read"}, {AccessWrite, "write"}, {AccessExecute, "execute"}} {
+		if a&kind.access != 0 {
+			kinds = append(kinds, kind.name)
+		}
+	}
+	if len(kinds) == 0 {
+		return "none"
+	}
+	return strings.Join(kinds, "/")
+}
+
+// MemoryAccess describes an access made to a watched region
+type MemoryAccess struct {
+	Access  Access // a single kind of access
+	Address Word
+	Value   Word // the value that was read, written or fetched
+	Old     Word // the value that was overwritten, for writes
+	PC      Word // the address of the instruction that made the access
+}
+
+type watch struct {
+	Region
+	id     int
+	access Access
+	f      func(MemoryAccess)
+}
+
+// Watch calls f whenever the CPU accesses a word of the region in one of the
+// given ways, after the access has happened. Only accesses made while the
+// State is stepping are observed, which includes those made by devices
+// handling HWI. Decoding an operand reads it, even if it's only the
+// destination of SET. Returns an id that can be passed to Unwatch.
+func (m *Memory) Watch(region Region, access Access, f func(MemoryAccess)) int {
+	m.nextWatch++
+	// copy the watches, so it's safe to add a watch from inside f
+	watches := make([]watch, len(m.watches), len(m.watches)+1)
+	copy(watches, m.watches)
+	m.watches = append(watches, watch{region, m.nextWatch, access, f})
+	return m.nextWatch
+}
+
+// Unwatch removes the watch with the given id, if there is one
+func (m *Memory) Unwatch(id int) {
+	var watches []watch
+	for _, w := range m.watches {
+		if w.id != id {
+			watches = append(watches, w)
+		}
+	}
+	m.watches = watches
+}
+
+func (m *Memory) notify(access Access, address, value, old Word) {
+	for _, w := range m.watches {
+		// the region may extend to the end of memory, so avoid End()
+		if w.access&access != 0 && address-w.Start < w.Length {
+			w.f(MemoryAccess{access, address, value, old, *m.cpu})
+		}
+	}
+}
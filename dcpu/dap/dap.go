@@ -0,0 +1,685 @@
+// Package dap implements the Debug Adapter Protocol, which lets editors
+// launch and debug DCPU-16 programs.
+//
+// Programs are run headless, so the adapter never touches the terminal and can
+// talk to the editor over stdin and stdout. Programs assembled from source can
+// be debugged by source line. The registers and the stack, read upwards from
+// SP, are shown as variables. Like the GDB stub, memory references are word
+// addresses, and memory is read and written as big-endian words.
+package dap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Server launches and debugs programs on behalf of a client
+type Server struct {
+	// Load reads the program named by the launch request. Programs that include
+	// line information can be debugged by source line.
+	Load func(path string, spec core.SpecVersion, littleEndian bool) (*asm.Program, error)
+	// Rate is the clock rate that programs run at, or DefaultClockRate if zero
+	Rate dcpu.ClockRate
+}
+
+const threadID = 1 // the DCPU-16 only has one thread
+
+// variable references
+const (
+	registersReference = 1
+	stackReference     = 2
+)
+
+// maxStackVariables limits how much of the stack is shown
+const maxStackVariables = 64
+
+var (
+	errNotLaunched = errors.New("no program has been launched")
+	errRunning     = errors.New("the program is running")
+)
+
+// session is the state of a single client
+type session struct {
+	*Server
+	w           *writer
+	lineBase    int // the number of the first line, as seen by the client
+	machine     *dcpu.Machine
+	prog        *asm.Program
+	source      string               // the absolute path of the source, if there is one
+	names       map[core.Word]string // labels by address
+	stopOnEntry bool
+	running     bool
+	stopErr     error       // the error that stopped the machine, once it has
+	shutDown    bool        // whether the machine has been stopped with Stop
+	breakpoints []core.Word // source breakpoints
+	pauseC      <-chan dcpu.PauseEvent
+	errorC      <-chan error
+	queued      []event // events to send after the current response
+}
+
+// Serve serves a single client until it disconnects. Any launched program is
+// stopped before Serve returns.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	sess := &session{Server: s, w: &writer{w: w}, lineBase: 1}
+	defer sess.stop()
+	requests := make(chan *request)
+	readErr := make(chan error, 1)
+	// the reader gives up on its last request once Serve returns
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		br := bufio.NewReader(r)
+		for {
+			req, err := readMessage(br)
+			if err != nil {
+				readErr <- err
+				close(requests)
+				return
+			}
+			select {
+			case requests <- req:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				if err := <-readErr; err != io.EOF {
+					return err
+				}
+				return nil
+			}
+			body, err := sess.handle(req)
+			if err == errDisconnect {
+				return sess.w.respond(req, nil)
+			} else if err != nil {
+				err = sess.w.fail(req, err)
+			} else {
+				err = sess.w.respond(req, body)
+			}
+			if err != nil {
+				return err
+			}
+		case evt := <-sess.pauseC:
+			if sess.running {
+				sess.running = false
+				sess.queue("stopped", stoppedBody(evt))
+			}
+		case err := <-sess.errorC:
+			// ErrorC is closed after the error is sent
+			sess.errorC = nil
+			sess.stopped(err)
+		}
+		if err := sess.flush(); err != nil {
+			return err
+		}
+	}
+}
+
+var errDisconnect = errors.New("disconnect")
+
+func (s *session) queue(name string, body interface{}) {
+	s.queued = append(s.queued, event{Type: "event", Event: name, Body: body})
+}
+
+// flush sends the queued events
+func (s *session) flush() error {
+	queued := s.queued
+	s.queued = nil
+	for i := range queued {
+		if err := s.w.write(&queued[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stop stops the machine, if it hasn't been already. The machine must be
+// stopped even if an error already ended the program, to shut it down.
+func (s *session) stop() {
+	if s.machine != nil && !s.shutDown {
+		s.machine.Stop()
+		s.shutDown = true
+		s.errorC, s.pauseC = nil, nil
+	}
+}
+
+// stopped reports the error that stopped the machine
+func (s *session) stopped(err error) {
+	s.running = false
+	s.stopErr = err
+	if err == dcpu.ErrHalted {
+		s.queue("exited", map[string]int{"exitCode": 0})
+		s.queue("terminated", nil)
+		return
+	}
+	s.queue("output", map[string]string{"category": "stderr", "output": err.Error() + "\n"})
+	s.queue("stopped", map[string]interface{}{
+		"reason":            "exception",
+		"description":       "Machine error",
+		"text":              err.Error(),
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	})
+}
+
+func stoppedBody(evt dcpu.PauseEvent) map[string]interface{} {
+	reason := "step"
+	switch evt.Reason {
+	case dcpu.PauseRequested:
+		reason = "pause"
+	case dcpu.PauseBreakpoint:
+		reason = "breakpoint"
+	case dcpu.PauseWatchpoint:
+		reason = "data breakpoint"
+	}
+	return map[string]interface{}{
+		"reason":            reason,
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	}
+}
+
+// handle handles a request, returning the body of the response
+func (s *session) handle(req *request) (interface{}, error) {
+	switch req.Command {
+	case "initialize":
+		return s.initialize(req.Arguments)
+	case "launch":
+		return s.launch(req.Arguments)
+	case "disconnect":
+		s.stop()
+		return nil, errDisconnect
+	case "terminate":
+		s.stop()
+		s.queue("terminated", nil)
+		return nil, nil
+	}
+	// everything else needs a program
+	if s.machine == nil {
+		return nil, errNotLaunched
+	}
+	switch req.Command {
+	case "setBreakpoints":
+		return s.setBreakpoints(req.Arguments)
+	case "configurationDone":
+		if s.stopOnEntry {
+			s.queue("stopped", map[string]interface{}{"reason": "entry", "threadId": threadID, "allThreadsStopped": true})
+			return nil, nil
+		}
+		return nil, s.resume(s.continueMachine)
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": threadID, "name": "DCPU-16"}},
+		}, nil
+	case "stackTrace":
+		return s.stackTrace()
+	case "scopes":
+		return map[string]interface{}{
+			"scopes": []map[string]interface{}{
+				{"name": "Registers", "variablesReference": registersReference, "expensive": false},
+				{"name": "Stack", "variablesReference": stackReference, "expensive": false},
+			},
+		}, nil
+	case "variables":
+		return s.variables(req.Arguments)
+	case "setVariable":
+		return s.setVariable(req.Arguments)
+	case "evaluate":
+		return s.evaluate(req.Arguments)
+	case "readMemory":
+		return s.readMemory(req.Arguments)
+	case "writeMemory":
+		return s.writeMemory(req.Arguments)
+	case "continue":
+		return map[string]bool{"allThreadsContinued": true}, s.resume(s.continueMachine)
+	case "next":
+		return nil, s.resume(s.machine.StepOver)
+	case "stepOut":
+		return nil, s.resume(s.machine.StepOut)
+	case "stepIn":
+		if err := s.checkStopped(); err != nil {
+			return nil, err
+		}
+		// errors arrive on ErrorC, and are reported from there
+		if err := s.machine.StepInstruction(); err == nil {
+			s.queue("stopped", map[string]interface{}{"reason": "step", "threadId": threadID, "allThreadsStopped": true})
+		}
+		return nil, nil
+	case "pause":
+		if s.running {
+			s.machine.Pause()
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request %s", req.Command)
+}
+
+// checkStopped returns an error unless the machine is paused
+func (s *session) checkStopped() error {
+	if s.stopErr != nil {
+		return s.stopErr
+	}
+	if s.running {
+		return errRunning
+	}
+	return nil
+}
+
+// resume resumes the machine by calling f, which is continue or a step
+// that pauses again by itself
+func (s *session) resume(f func() error) error {
+	if err := s.checkStopped(); err != nil {
+		return err
+	}
+	if err := f(); err != nil {
+		return err
+	}
+	s.running = true
+	return nil
+}
+
+func (s *session) continueMachine() error {
+	s.machine.Resume()
+	return nil
+}
+
+func (s *session) initialize(args json.RawMessage) (interface{}, error) {
+	var init struct {
+		LinesStartAt1 *bool `json:"linesStartAt1"`
+	}
+	if err := unmarshal(args, &init); err != nil {
+		return nil, err
+	}
+	if init.LinesStartAt1 != nil && !*init.LinesStartAt1 {
+		s.lineBase = 0
+	}
+	return map[string]bool{
+		"supportsConfigurationDoneRequest": true,
+		"supportsSetVariable":              true,
+		"supportsReadMemoryRequest":        true,
+		"supportsWriteMemoryRequest":       true,
+		"supportsTerminateRequest":         true,
+	}, nil
+}
+
+func (s *session) launch(args json.RawMessage) (interface{}, error) {
+	if s.machine != nil {
+		return nil, errors.New("a program has already been launched")
+	}
+	var launch struct {
+		Program      string `json:"program"`
+		Spec         string `json:"spec"`
+		LittleEndian bool   `json:"littleEndian"`
+		StopOnEntry  bool   `json:"stopOnEntry"`
+	}
+	if err := unmarshal(args, &launch); err != nil {
+		return nil, err
+	}
+	spec := core.Spec11
+	if launch.Spec != "" {
+		if err := spec.Set(launch.Spec); err != nil {
+			return nil, err
+		}
+	}
+	prog, err := s.Load(launch.Program, spec, launch.LittleEndian)
+	if err != nil {
+		return nil, err
+	}
+	machine := &dcpu.Machine{Headless: true, StopOnHalt: true, StartPaused: true}
+	machine.State.Spec = spec
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		return nil, err
+	}
+	rate := s.Rate
+	if rate == 0 {
+		rate = dcpu.DefaultClockRate
+	}
+	if err := machine.Start(rate); err != nil {
+		return nil, err
+	}
+	// the machine is paused before running anything, which configurationDone
+	// reports itself, so don't report it again once the program is running
+	<-machine.PauseC
+	s.machine, s.prog, s.shutDown = machine, prog, false
+	s.pauseC, s.errorC = machine.PauseC, machine.ErrorC
+	s.stopOnEntry = launch.StopOnEntry
+	if len(prog.Lines) > 0 {
+		s.source, _ = filepath.Abs(launch.Program)
+	}
+	s.names = make(map[core.Word]string)
+	for name, addr := range prog.Labels {
+		s.names[addr] = name
+	}
+	// now that there's a program, breakpoints can be set
+	s.queue("initialized", nil)
+	return nil, nil
+}
+
+type breakpoint struct {
+	Verified bool   `json:"verified"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+func (s *session) setBreakpoints(args json.RawMessage) (interface{}, error) {
+	var set struct {
+		Source struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := unmarshal(args, &set); err != nil {
+		return nil, err
+	}
+	for _, addr := range s.breakpoints {
+		s.machine.ClearBreakpoint(addr)
+	}
+	s.breakpoints = nil
+	path, _ := filepath.Abs(set.Source.Path)
+	results := make([]breakpoint, len(set.Breakpoints))
+	for i, bp := range set.Breakpoints {
+		if s.source == "" || path != s.source {
+			results[i].Message = "no line information for this source"
+			continue
+		}
+		addr, line, ok := s.prog.AddressForLine(bp.Line - s.lineBase + 1)
+		if !ok {
+			results[i].Message = "no code at or after this line"
+			continue
+		}
+		s.machine.SetBreakpoint(addr)
+		s.breakpoints = append(s.breakpoints, addr)
+		results[i] = breakpoint{Verified: true, Line: line + s.lineBase - 1}
+	}
+	return map[string]interface{}{"breakpoints": results}, nil
+}
+
+func (s *session) stackTrace() (interface{}, error) {
+	var pc core.Word
+	s.machine.Do(func() {
+		pc = s.machine.State.PC()
+		if !s.machine.State.AtInstructionBoundary() {
+			pc = s.machine.State.InstructionAddress()
+		}
+	})
+	frame := map[string]interface{}{
+		"id":                          0,
+		"name":                        s.describe(pc),
+		"line":                        0,
+		"column":                      0,
+		"instructionPointerReference": memoryReference(pc),
+	}
+	if line, ok := s.prog.LineForAddress(pc); ok && s.source != "" {
+		frame["line"] = line + s.lineBase - 1
+		frame["column"] = s.lineBase
+		frame["source"] = map[string]string{"name": filepath.Base(s.source), "path": s.source}
+	}
+	return map[string]interface{}{
+		"stackFrames": []interface{}{frame},
+		"totalFrames": 1,
+	}, nil
+}
+
+// describe names an address relative to the closest label before it
+func (s *session) describe(addr core.Word) string {
+	best, found := core.Word(0), false
+	for labelAddr := range s.names {
+		if labelAddr <= addr && (!found || labelAddr > best) {
+			best, found = labelAddr, true
+		}
+	}
+	if !found {
+		return formatWord(addr)
+	} else if best == addr {
+		return s.names[best]
+	}
+	return fmt.Sprintf("%s+%d", s.names[best], addr-best)
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+	MemoryReference    string `json:"memoryReference,omitempty"`
+}
+
+func (s *session) variables(args json.RawMessage) (interface{}, error) {
+	var vars struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := unmarshal(args, &vars); err != nil {
+		return nil, err
+	}
+	var result []variable
+	state := &s.machine.State
+	switch vars.VariablesReference {
+	case registersReference:
+		s.machine.Do(func() {
+			for i, val := range state.Registers {
+				result = append(result, variable{Name: s.registerName(i), Value: formatWord(val), MemoryReference: memoryReference(val)})
+			}
+		})
+	case stackReference:
+		s.machine.Do(func() {
+			// the stack is empty when SP is 0
+			for offset, addr := 0, int(state.SP()); addr != 0 && addr < 0x10000 && offset < maxStackVariables; offset, addr = offset+1, addr+1 {
+				val := state.Ram.Load(core.Word(addr))
+				name := fmt.Sprintf("[SP+%d] %s", offset, formatWord(core.Word(addr)))
+				result = append(result, variable{Name: name, Value: formatWord(val), MemoryReference: memoryReference(val)})
+			}
+		})
+	default:
+		return nil, errors.New("unknown variables reference")
+	}
+	return map[string]interface{}{"variables": result}, nil
+}
+
+// registerName names the register with the given index
+func (s *session) registerName(index int) string {
+	if name := core.RegisterNames[index]; name != "O" || s.machine.State.Spec != core.Spec17 {
+		return name
+	}
+	return "EX"
+}
+
+func (s *session) setVariable(args json.RawMessage) (interface{}, error) {
+	var set struct {
+		VariablesReference int    `json:"variablesReference"`
+		Name               string `json:"name"`
+		Value              string `json:"value"`
+	}
+	if err := unmarshal(args, &set); err != nil {
+		return nil, err
+	}
+	val, err := s.evaluateExpression(set.Value)
+	if err != nil {
+		return nil, err
+	}
+	switch set.VariablesReference {
+	case registersReference:
+		index, ok := core.RegisterIndex(set.Name)
+		if !ok {
+			return nil, fmt.Errorf("unknown register %s", set.Name)
+		}
+		s.machine.Do(func() { s.machine.State.Registers[index] = val })
+	case stackReference:
+		// the name ends with the address
+		fields := strings.Fields(set.Name)
+		if len(fields) == 0 {
+			return nil, errors.New("missing stack address")
+		}
+		addr, err := parseWord(fields[len(fields)-1])
+		if err != nil {
+			return nil, err
+		}
+		s.machine.Do(func() { err = s.machine.State.Ram.Store(addr, val) })
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unknown variables reference")
+	}
+	return map[string]string{"value": formatWord(val)}, nil
+}
+
+func (s *session) evaluate(args json.RawMessage) (interface{}, error) {
+	var eval struct {
+		Expression string `json:"expression"`
+	}
+	if err := unmarshal(args, &eval); err != nil {
+		return nil, err
+	}
+	val, err := s.evaluateExpression(eval.Expression)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"result":             formatWord(val),
+		"variablesReference": 0,
+		"memoryReference":    memoryReference(val),
+	}, nil
+}
+
+// evaluateExpression evaluates a number, label, register, or [expression]
+func (s *session) evaluateExpression(expr string) (core.Word, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "[") && strings.HasSuffix(expr, "]") {
+		addr, err := s.evaluateExpression(expr[1 : len(expr)-1])
+		if err != nil {
+			return 0, err
+		}
+		var val core.Word
+		s.machine.Do(func() { val = s.machine.State.Ram.Load(addr) })
+		return val, nil
+	}
+	if addr, ok := s.prog.Labels[expr]; ok {
+		return addr, nil
+	}
+	if index, ok := core.RegisterIndex(expr); ok {
+		var val core.Word
+		s.machine.Do(func() { val = s.machine.State.Registers[index] })
+		return val, nil
+	}
+	return parseWord(expr)
+}
+
+type memoryArguments struct {
+	MemoryReference string `json:"memoryReference"`
+	Offset          int    `json:"offset"`
+	Count           int    `json:"count"`
+	Data            string `json:"data"`
+}
+
+// memoryRange converts a reference and a byte offset into the word-addressed
+// memory into an absolute byte offset, and the number of bytes available
+func memoryRange(mem *memoryArguments) (start, available int, err error) {
+	ref, err := parseWord(mem.MemoryReference)
+	if err != nil {
+		return 0, 0, err
+	}
+	start = int(ref)*2 + mem.Offset
+	if start < 0 || start > 0x20000 {
+		return 0, 0, errors.New("address out of range")
+	}
+	return start, 0x20000 - start, nil
+}
+
+func (s *session) readMemory(args json.RawMessage) (interface{}, error) {
+	var mem memoryArguments
+	if err := unmarshal(args, &mem); err != nil {
+		return nil, err
+	}
+	start, available, err := memoryRange(&mem)
+	if err != nil {
+		return nil, err
+	}
+	count := mem.Count
+	if count < 0 {
+		return nil, errors.New("negative count")
+	}
+	if count > available {
+		count = available
+	}
+	data := make([]byte, count)
+	s.machine.Do(func() {
+		for i := range data {
+			w := s.machine.State.Ram.Load(core.Word((start + i) / 2))
+			if (start+i)%2 == 0 {
+				data[i] = byte(w >> 8)
+			} else {
+				data[i] = byte(w)
+			}
+		}
+	})
+	return map[string]interface{}{
+		"address": memoryReference(core.Word(start / 2)),
+		"data":    base64.StdEncoding.EncodeToString(data),
+	}, nil
+}
+
+func (s *session) writeMemory(args json.RawMessage) (interface{}, error) {
+	var mem memoryArguments
+	if err := unmarshal(args, &mem); err != nil {
+		return nil, err
+	}
+	start, available, err := memoryRange(&mem)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(mem.Data)
+	if err != nil {
+		return nil, err
+	}
+	if start%2 != 0 || len(data)%2 != 0 || len(data) > available {
+		return nil, errors.New("memory can only be written a whole word at a time")
+	}
+	s.machine.Do(func() {
+		for i := 0; i < len(data) && err == nil; i += 2 {
+			w := core.Word(data[i])<<8 | core.Word(data[i+1])
+			err = s.machine.State.Ram.Store(core.Word((start+i)/2), w)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"bytesWritten": len(data)}, nil
+}
+
+func unmarshal(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	return json.Unmarshal(args, v)
+}
+
+func formatWord(w core.Word) string {
+	return fmt.Sprintf("0x%04x", w)
+}
+
+func memoryReference(addr core.Word) string {
+	return fmt.Sprintf("0x%04x", addr)
+}
+
+func parseWord(str string) (core.Word, error) {
+	val, err := strconv.ParseUint(str, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %s", str)
+	}
+	return core.Word(val), nil
+}
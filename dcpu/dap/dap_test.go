@@ -0,0 +1,262 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// message is any message from the server
+type message struct {
+	Type       string          `json:"type"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Event      string          `json:"event"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// client is a minimal DAP client
+type client struct {
+	t        *testing.T
+	w        io.Writer
+	seq      int
+	messages chan *message
+	events   []*message // events received while waiting for a response
+}
+
+func newClient(t *testing.T, r io.Reader, w io.Writer) *client {
+	c := &client{t: t, w: w, messages: make(chan *message, 100)}
+	go func() {
+		br := bufio.NewReader(r)
+		for {
+			var length int
+			if _, err := fmt.Fscanf(br, "Content-Length: %d\r\n\r\n", &length); err != nil {
+				close(c.messages)
+				return
+			}
+			body := make([]byte, length)
+			if _, err := io.ReadFull(br, body); err != nil {
+				close(c.messages)
+				return
+			}
+			var msg message
+			if err := json.Unmarshal(body, &msg); err != nil {
+				t.Error(err)
+			}
+			c.messages <- &msg
+		}
+	}()
+	return c
+}
+
+func (c *client) next() *message {
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			c.t.Fatal("connection closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timed out waiting for a message")
+	}
+	return nil
+}
+
+// request sends a request and decodes the body of the response into result
+func (c *client) request(command string, args interface{}, result interface{}) {
+	c.seq++
+	data, err := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	for {
+		msg := c.next()
+		if msg.Type == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if msg.RequestSeq != c.seq {
+			c.t.Fatalf("%s: unexpected response to request %d", command, msg.RequestSeq)
+		}
+		if !msg.Success {
+			c.t.Fatalf("%s: %s", command, msg.Message)
+		}
+		if result != nil {
+			if err := json.Unmarshal(msg.Body, result); err != nil {
+				c.t.Fatalf("%s: %v", command, err)
+			}
+		}
+		return
+	}
+}
+
+// waitEvent waits for the named event, and decodes its body into result
+func (c *client) waitEvent(name string, result interface{}) {
+	for {
+		var msg *message
+		if len(c.events) > 0 {
+			msg, c.events = c.events[0], c.events[1:]
+		} else {
+			msg = c.next()
+		}
+		if msg.Type == "event" && msg.Event == name {
+			if result != nil {
+				if err := json.Unmarshal(msg.Body, result); err != nil {
+					c.t.Fatalf("%s: %v", name, err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// waitStopped waits for the stopped event and checks the reason and line
+func (c *client) waitStopped(reason string, line int) {
+	var stopped struct {
+		Reason string `json:"reason"`
+	}
+	c.waitEvent("stopped", &stopped)
+	if stopped.Reason != reason {
+		c.t.Fatalf("expected to stop for %s, found %s", reason, stopped.Reason)
+	}
+	var trace struct {
+		StackFrames []struct {
+			Line int `json:"line"`
+		} `json:"stackFrames"`
+	}
+	c.request("stackTrace", map[string]int{"threadId": 1}, &trace)
+	if len(trace.StackFrames) == 0 || trace.StackFrames[0].Line != line {
+		c.t.Fatalf("expected to stop at line %d, found %+v", line, trace.StackFrames)
+	}
+}
+
+// evaluate evaluates an expression and checks the result
+func (c *client) evaluate(expr, expected string) {
+	var result struct {
+		Result string `json:"result"`
+	}
+	c.request("evaluate", map[string]string{"expression": expr}, &result)
+	if result.Result != expected {
+		c.t.Errorf("expected %s to be %s, found %s", expr, expected, result.Result)
+	}
+}
+
+const testProgram = `; test program
+        SET A, 1
+        SET PUSH, 7
+        SET [0x1000], A
+        ADD A, 1
+        JSR sub
+:halt   SET PC, halt
+:sub    SET B, 3
+        SET PC, POP
+`
+
+func TestServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.asm")
+	if err := ioutil.WriteFile(path, []byte(testProgram), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Load: func(path string, spec core.SpecVersion, littleEndian bool) (*asm.Program, error) {
+			src, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			return asm.Assemble(src, spec)
+		},
+		Rate: 1e6,
+	}
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(serverR, serverW)
+		serverW.Close()
+	}()
+	c := newClient(t, clientR, clientW)
+
+	var caps map[string]bool
+	c.request("initialize", map[string]interface{}{"adapterID": "dcpu16"}, &caps)
+	if !caps["supportsReadMemoryRequest"] {
+		t.Errorf("unexpected capabilities %v", caps)
+	}
+	c.request("launch", map[string]interface{}{"program": path, "spec": "1.7", "stopOnEntry": true}, nil)
+	c.waitEvent("initialized", nil)
+
+	// there is no code at or after line 100
+	var bps struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": path},
+		"breakpoints": []map[string]int{{"line": 5}, {"line": 100}},
+	}, &bps)
+	if len(bps.Breakpoints) != 2 || !bps.Breakpoints[0].Verified || bps.Breakpoints[0].Line != 5 || bps.Breakpoints[1].Verified {
+		t.Fatalf("unexpected breakpoints %+v", bps.Breakpoints)
+	}
+	c.request("configurationDone", nil, nil)
+	c.waitStopped("entry", 2)
+
+	c.request("continue", map[string]int{"threadId": 1}, nil)
+	c.waitStopped("breakpoint", 5)
+
+	var vars struct {
+		Variables []variable `json:"variables"`
+	}
+	c.request("variables", map[string]int{"variablesReference": registersReference}, &vars)
+	if len(vars.Variables) != 12 || vars.Variables[0].Name != "A" || vars.Variables[0].Value != "0x0001" || vars.Variables[10].Name != "EX" {
+		t.Errorf("unexpected registers %+v", vars.Variables)
+	}
+	c.request("variables", map[string]int{"variablesReference": stackReference}, &vars)
+	if len(vars.Variables) != 1 || vars.Variables[0].Name != "[SP+0] 0xffff" || vars.Variables[0].Value != "0x0007" {
+		t.Errorf("unexpected stack %+v", vars.Variables)
+	}
+	var mem struct {
+		Data string `json:"data"`
+	}
+	c.request("readMemory", map[string]interface{}{"memoryReference": "0x1000", "count": 2}, &mem)
+	if mem.Data != "AAE=" {
+		t.Errorf("unexpected memory %q", mem.Data)
+	}
+	c.request("setVariable", map[string]interface{}{"variablesReference": registersReference, "name": "A", "value": "5"}, nil)
+	c.evaluate("A", "0x0005")
+	c.evaluate("[0x1000]", "0x0001")
+	c.evaluate("sub", "0x0009")
+
+	c.request("next", map[string]int{"threadId": 1}, nil)
+	c.waitStopped("step", 6)
+	c.evaluate("A", "0x0006")
+	c.request("next", map[string]int{"threadId": 1}, nil)
+	c.waitStopped("step", 7)
+	c.evaluate("B", "0x0003")
+
+	// the program halts, which ends it
+	c.request("continue", map[string]int{"threadId": 1}, nil)
+	c.waitEvent("exited", nil)
+	c.waitEvent("terminated", nil)
+	c.request("disconnect", nil, nil)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for the server to finish")
+	}
+}
@@ -0,0 +1,109 @@
+package dap
+
+// reading and writing protocol messages
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// request is a request from the client
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// readMessage reads a single message, which is made up of headers
+// followed by a JSON body
+func readMessage(r *bufio.Reader) (*request, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "Content-Length" {
+			if length, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+				return nil, fmt.Errorf("invalid Content-Length %q", parts[1])
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("missing Content-Length")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	var req request
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// writer numbers and writes messages
+type writer struct {
+	w   io.Writer
+	seq int
+}
+
+func (w *writer) respond(req *request, body interface{}) error {
+	return w.write(&response{Type: "response", RequestSeq: req.Seq, Success: true, Command: req.Command, Body: body})
+}
+
+func (w *writer) fail(req *request, err error) error {
+	return w.write(&response{Type: "response", RequestSeq: req.Seq, Command: req.Command, Message: err.Error()})
+}
+
+func (w *writer) event(name string, body interface{}) error {
+	return w.write(&event{Type: "event", Event: name, Body: body})
+}
+
+func (w *writer) write(msg interface{}) error {
+	w.seq++
+	switch msg := msg.(type) {
+	case *response:
+		msg.Seq = w.seq
+	case *event:
+		msg.Seq = w.seq
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w.w, "Content-Length: %d\r\n\r\n", len(data)); err != nil {
+		return err
+	}
+	_, err = w.w.Write(data)
+	return err
+}
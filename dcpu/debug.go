@@ -0,0 +1,385 @@
+package dcpu
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"github.com/kballard/dcpu16/dcpu/disasm"
+	"io"
+	"os"
+	"sort"
+)
+
+// PauseReason describes why the machine paused
+type PauseReason int
+
+const (
+	PauseRequested  PauseReason = iota // Pause was called, or the machine started paused
+	PauseBreakpoint                    // execution reached a breakpoint
+	PauseStep                          // a StepOver or StepOut finished
+	PauseWatchpoint                    // an instruction accessed a watched word
+)
+
+func (r PauseReason) String() string {
+	switch r {
+	case PauseRequested:
+		return "paused"
+	case PauseBreakpoint:
+		return "breakpoint"
+	case PauseStep:
+		return "step"
+	case PauseWatchpoint:
+		return "watchpoint"
+	}
+	return "unknown"
+}
+
+// PauseEvent is sent on Machine.PauseC whenever the machine pauses
+type PauseEvent struct {
+	Reason  PauseReason
+	PC      core.Word
+	Address core.Word   // the word that was accessed, for PauseWatchpoint
+	Access  core.Access // how it was accessed, for PauseWatchpoint
+}
+
+// WatchAction is what a watchpoint does when it's hit
+type WatchAction int
+
+const (
+	WatchPause WatchAction = iota // pause once the instruction finishes
+	WatchLog                      // write a line to Machine.WatchOutput
+)
+
+var (
+	ErrNotPaused  = errors.New("Machine is not paused")
+	ErrNotStarted = errors.New("Machine has not started")
+)
+
+// debugState is the part of the Machine that's used by the debugging API.
+// It's only touched from the machine's goroutine.
+type debugState struct {
+	active         bool // whether the machine's goroutine is running
+	paused         bool
+	pauseRequested bool // pause at the next instruction boundary
+	resumed        bool // no cycles have run since resuming
+	until          func() bool
+	breakpoints    map[core.Word]bool
+	watchHit       *core.MemoryAccess // the first access to a pausing watchpoint since the last pause
+}
+
+// Do calls f on the machine's goroutine between cycles, and waits for it to
+// return. This is the only safe way to inspect or modify the State of a running
+// machine. If the machine isn't running, f is called directly.
+func (m *Machine) Do(f func()) {
+	if m.control != nil {
+		reply := make(chan struct{})
+		select {
+		case m.control <- func() { f(); close(reply) }:
+			<-reply
+			return
+		case <-m.done:
+		}
+	}
+	f()
+}
+
+// Pause pauses the machine at the next instruction boundary. Once it's
+// paused, a PauseEvent is sent on PauseC.
+func (m *Machine) Pause() {
+	m.Do(func() {
+		if m.active && !m.paused {
+			m.pauseRequested = true
+		}
+	})
+}
+
+// Resume resumes a paused machine. If it's paused at a breakpoint,
+// the instruction at the breakpoint is executed.
+func (m *Machine) Resume() {
+	m.Do(func() {
+		if m.paused {
+			m.resume(nil)
+		}
+	})
+}
+
+// Paused returns true if the machine is paused
+func (m *Machine) Paused() (paused bool) {
+	m.Do(func() {
+		paused = m.paused
+	})
+	return
+}
+
+// StepCycle runs a single cycle of a paused machine. Breakpoints are ignored.
+func (m *Machine) StepCycle() (err error) {
+	m.Do(func() {
+		if err = m.checkStep(); err == nil {
+			err = m.cycle()
+		}
+	})
+	return
+}
+
+// StepInstruction runs a paused machine up to the next instruction boundary.
+// Breakpoints are ignored.
+func (m *Machine) StepInstruction() (err error) {
+	m.Do(func() {
+		if err = m.checkStep(); err != nil {
+			return
+		}
+		for {
+			if err = m.cycle(); err != nil || m.State.AtInstructionBoundary() {
+				return
+			}
+		}
+	})
+	return
+}
+
+// StepOver is like StepInstruction, except that subroutine calls made with JSR
+// are run until they return. The machine is resumed while this happens, so a
+// PauseEvent is sent on PauseC once it's done. If a breakpoint is reached first,
+// the machine pauses there instead.
+func (m *Machine) StepOver() (err error) {
+	m.Do(func() {
+		if err = m.checkStep(); err != nil {
+			return
+		}
+		if !m.active {
+			err = ErrNotStarted
+			return
+		}
+		until := func() bool { return true }
+		if m.State.AtInstructionBoundary() {
+			pc := m.State.PC()
+			if inst := disasm.Decode(&m.State.Ram, pc, m.State.Spec); inst.Mnemonic == "JSR" {
+				ret, sp := pc+core.Word(len(inst.Words)), m.State.SP()
+				until = func() bool {
+					return m.State.PC() == ret && m.State.SP() == sp
+				}
+			}
+		}
+		m.resume(until)
+	})
+	return
+}
+
+// StepOut runs a paused machine until the current subroutine returns, which
+// is detected by the stack becoming shallower than it is now. Like StepOver,
+// a PauseEvent is sent on PauseC once it's done.
+func (m *Machine) StepOut() (err error) {
+	m.Do(func() {
+		if err = m.checkStep(); err != nil {
+			return
+		}
+		if !m.active {
+			err = ErrNotStarted
+			return
+		}
+		// the stack grows down from 0, so its depth is the negated SP
+		depth := -m.State.SP()
+		m.resume(func() bool {
+			return -m.State.SP() < depth
+		})
+	})
+	return
+}
+
+// StepBack runs a paused machine backwards by one instruction. History must
+// have been enabled with State.EnableHistory. Devices aren't run backwards,
+// but the memory they wrote to during HWI is restored.
+func (m *Machine) StepBack() (err error) {
+	m.Do(func() {
+		if err = m.checkStep(); err != nil {
+			return
+		}
+		var cycles uint
+		cycles, err = m.State.StepBack()
+		m.rewound(cycles)
+	})
+	return
+}
+
+// ReverseContinue runs a paused machine backwards until it reaches a
+// breakpoint. If the history runs out first, core.ErrNoHistory is returned
+// and the machine is left at the oldest instruction it remembers.
+func (m *Machine) ReverseContinue() (err error) {
+	m.Do(func() {
+		if err = m.checkStep(); err != nil {
+			return
+		}
+		var cycles uint
+		_, cycles, err = m.State.StepBackUntil(func() bool {
+			return m.breakpoints[m.State.PC()]
+		})
+		m.rewound(cycles)
+	})
+	return
+}
+
+// StepBackToWrite runs a paused machine backwards to the last instruction that
+// wrote to address, stopping before it executes. If there isn't one in the
+// history, core.ErrNoHistory is returned and the machine doesn't move.
+func (m *Machine) StepBackToWrite(address core.Word) (err error) {
+	m.Do(func() {
+		if err = m.checkStep(); err != nil {
+			return
+		}
+		var cycles uint
+		_, cycles, err = m.State.StepBackToWrite(address)
+		m.rewound(cycles)
+	})
+	return
+}
+
+// rewound accounts for cycles that were undone
+func (m *Machine) rewound(cycles uint) {
+	if cycles > m.cycleCount {
+		cycles = m.cycleCount
+	}
+	m.cycleCount -= cycles
+	// any access that was noticed is in the undone future
+	m.watchHit = nil
+}
+
+// checkStep returns an error if the machine is running
+func (m *Machine) checkStep() error {
+	if m.active && !m.paused {
+		return ErrNotPaused
+	}
+	return nil
+}
+
+// SetBreakpoint pauses the machine whenever it's about to execute
+// the instruction at address
+func (m *Machine) SetBreakpoint(address core.Word) {
+	m.Do(func() {
+		if m.breakpoints == nil {
+			m.breakpoints = make(map[core.Word]bool)
+		}
+		m.breakpoints[address] = true
+	})
+}
+
+// ClearBreakpoint removes the breakpoint at address, if there is one
+func (m *Machine) ClearBreakpoint(address core.Word) {
+	m.Do(func() {
+		delete(m.breakpoints, address)
+	})
+}
+
+// Breakpoints returns the address of every breakpoint, in ascending order
+func (m *Machine) Breakpoints() []core.Word {
+	var addrs []int
+	m.Do(func() {
+		for addr := range m.breakpoints {
+			addrs = append(addrs, int(addr))
+		}
+	})
+	sort.Ints(addrs)
+	words := make([]core.Word, len(addrs))
+	for i, addr := range addrs {
+		words[i] = core.Word(addr)
+	}
+	return words
+}
+
+// AddWatchpoint watches for the given kinds of access to the words in region.
+// With WatchPause, the machine pauses once the instruction that made the access
+// finishes, even if it was only a read or the value didn't change. With
+// WatchLog, the access is written to WatchOutput and the machine carries on.
+// Returns an id for RemoveWatchpoint.
+func (m *Machine) AddWatchpoint(region core.Region, access core.Access, action WatchAction) int {
+	if action == WatchLog {
+		return m.AddWatchFunc(region, access, m.logAccess)
+	}
+	return m.AddWatchFunc(region, access, func(acc core.MemoryAccess) {
+		if m.watchHit == nil {
+			m.watchHit = &acc
+		}
+	})
+}
+
+// AddWatchFunc calls f on the machine's goroutine whenever an instruction
+// accesses one of the words in region in one of the given ways, right after
+// the access. The access always goes ahead, and f must not block. See
+// core.Memory.Watch for which accesses are noticed.
+func (m *Machine) AddWatchFunc(region core.Region, access core.Access, f func(core.MemoryAccess)) (id int) {
+	m.Do(func() {
+		id = m.State.Ram.Watch(region, access, f)
+	})
+	return
+}
+
+// RemoveWatchpoint removes a watchpoint added by AddWatchpoint or AddWatchFunc
+func (m *Machine) RemoveWatchpoint(id int) {
+	m.Do(func() {
+		m.State.Ram.Unwatch(id)
+	})
+}
+
+func (m *Machine) logAccess(acc core.MemoryAccess) {
+	w := m.WatchOutput
+	if w == nil {
+		w = io.Writer(os.Stderr)
+	}
+	line := fmt.Sprintf("watch: PC %04x %s [%04x] = %04x", acc.PC, acc.Access, acc.Address, acc.Value)
+	if acc.Access == core.AccessWrite {
+		line += fmt.Sprintf(" (was %04x)", acc.Old)
+	}
+	fmt.Fprintf(w, "%s, cycle %d\n", line, m.cycleCount)
+}
+
+// resume resumes the machine. If until isn't nil, the machine pauses again
+// at the first instruction boundary where it returns true.
+func (m *Machine) resume(until func() bool) {
+	m.paused = false
+	m.resumed = true
+	m.until = until
+}
+
+// checkPause pauses the machine if it should stop before the next cycle,
+// returning true if it did.
+func (m *Machine) checkPause() bool {
+	if !m.State.AtInstructionBoundary() {
+		return false
+	}
+	var reason PauseReason
+	switch {
+	case m.pauseRequested:
+		reason = PauseRequested
+	case m.resumed:
+		// don't stop before executing anything, but forget about
+		// any accesses made while single-stepping
+		m.watchHit = nil
+		return false
+	case m.watchHit != nil:
+		reason = PauseWatchpoint
+	case m.breakpoints[m.State.PC()]:
+		reason = PauseBreakpoint
+	case m.until != nil && m.until():
+		reason = PauseStep
+	default:
+		return false
+	}
+	m.pause(reason)
+	return true
+}
+
+func (m *Machine) pause(reason PauseReason) {
+	evt := PauseEvent{Reason: reason, PC: m.State.PC()}
+	if reason == PauseWatchpoint {
+		evt.Address, evt.Access = m.watchHit.Address, m.watchHit.Access
+	}
+	m.watchHit = nil
+	m.paused = true
+	m.pauseRequested = false
+	m.until = nil
+	// nobody may be listening, so replace any event that wasn't received
+	select {
+	case <-m.pauseC:
+	default:
+	}
+	m.pauseC <- evt
+}
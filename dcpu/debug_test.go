@@ -0,0 +1,206 @@
+package dcpu
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitPause(t *testing.T, m *Machine, reason PauseReason, pc core.Word) {
+	select {
+	case evt := <-m.PauseC:
+		if evt.Reason != reason || evt.PC != pc {
+			t.Fatalf("Expected pause (%v) at %#x, found pause (%v) at %#x", reason, pc, evt.Reason, evt.PC)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for pause (%v) at %#x", reason, pc)
+	}
+}
+
+func TestDebugging(t *testing.T) {
+	prog, err := asm.Assemble([]byte(`
+		      SET A, 1
+		      JSR sub
+		      SET B, 2
+		:loop SET PC, loop
+		:sub  ADD A, 1
+		      SET PC, POP`), core.Spec11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := &Machine{Headless: true, StartPaused: true}
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(10e6); err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Stop()
+	waitPause(t, machine, PauseRequested, 0)
+
+	if err := machine.StepCycle(); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.StepOver(); err != nil {
+		t.Fatal(err)
+	}
+	waitPause(t, machine, PauseStep, 3)
+	var a, b core.Word
+	machine.Do(func() { a, b = machine.State.A(), machine.State.B() })
+	if a != 2 || b != 0 {
+		t.Errorf("Expected A=2 B=0 after stepping over JSR, found A=%#x B=%#x", a, b)
+	}
+
+	// the loop reaches the breakpoint again on every iteration
+	machine.SetBreakpoint(prog.Labels["loop"])
+	machine.Resume()
+	waitPause(t, machine, PauseBreakpoint, 4)
+	machine.Resume()
+	waitPause(t, machine, PauseBreakpoint, 4)
+
+	machine.ClearBreakpoint(prog.Labels["loop"])
+	machine.Resume()
+	if err := machine.StepCycle(); err != ErrNotPaused {
+		t.Errorf("Expected ErrNotPaused while running, found %v", err)
+	}
+	machine.Pause()
+	waitPause(t, machine, PauseRequested, 4)
+	if !machine.Paused() {
+		t.Error("Expected the machine to be paused")
+	}
+	if err := machine.StepInstruction(); err != nil {
+		t.Fatal(err)
+	}
+	machine.Do(func() { b = machine.State.B() })
+	if b != 2 {
+		t.Errorf("Expected B=2, found %#x", b)
+	}
+}
+
+func TestStepOut(t *testing.T) {
+	prog, err := asm.Assemble([]byte(`
+		      JSR sub
+		:loop SET PC, loop
+		:sub  SET PUSH, 1
+		      SET A, POP
+		      SET PC, POP`), core.Spec11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := &Machine{Headless: true, StartPaused: true}
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(10e6); err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Stop()
+	waitPause(t, machine, PauseRequested, 0)
+	if err := machine.StepInstruction(); err != nil {
+		t.Fatal(err)
+	}
+	// pushing and popping inside the subroutine doesn't count as returning
+	if err := machine.StepOut(); err != nil {
+		t.Fatal(err)
+	}
+	waitPause(t, machine, PauseStep, prog.Labels["loop"])
+}
+
+func TestReverseExecution(t *testing.T) {
+	prog, err := asm.Assemble([]byte(`
+		      SET A, 1
+		:mark SET [0x1000], A
+		      ADD A, 1
+		      IFG 5, A
+		      SET PC, mark
+		:loop SET PC, loop`), core.Spec11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := &Machine{Headless: true, StartPaused: true}
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		t.Fatal(err)
+	}
+	machine.State.EnableHistory(1000, 100)
+	if err := machine.Start(10e6); err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Stop()
+	waitPause(t, machine, PauseRequested, 0)
+	machine.SetBreakpoint(prog.Labels["loop"])
+	machine.Resume()
+	waitPause(t, machine, PauseBreakpoint, prog.Labels["loop"])
+
+	expect := func(what string, pc, a, mem core.Word) {
+		var state [3]core.Word
+		machine.Do(func() {
+			state = [3]core.Word{machine.State.PC(), machine.State.A(), machine.State.Ram.Load(0x1000)}
+		})
+		if state != [3]core.Word{pc, a, mem} {
+			t.Errorf("%s: expected PC=%#x A=%#x [0x1000]=%#x, found %#x", what, pc, a, mem, state)
+		}
+	}
+	machine.SetBreakpoint(prog.Labels["mark"])
+	if err := machine.ReverseContinue(); err != nil {
+		t.Fatal(err)
+	}
+	expect("ReverseContinue", prog.Labels["mark"], 4, 3)
+	if err := machine.StepBackToWrite(0x1000); err != nil {
+		t.Fatal(err)
+	}
+	expect("StepBackToWrite", prog.Labels["mark"], 3, 2)
+	if err := machine.StepBack(); err != nil {
+		t.Fatal(err)
+	}
+	expect("StepBack", prog.Labels["loop"]-2, 3, 2)
+
+	machine.ClearBreakpoint(prog.Labels["mark"])
+	if err := machine.ReverseContinue(); err != core.ErrNoHistory {
+		t.Errorf("Expected ErrNoHistory, found %v", err)
+	}
+	expect("ReverseContinue to the start", 0, 0, 0)
+}
+
+func TestWatchpoints(t *testing.T) {
+	prog, err := asm.Assemble([]byte(`
+		      SET A, 1
+		:mark SET [0x1000], A
+		      SET B, [0x1001]
+		:loop SET PC, loop`), core.Spec11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	machine := &Machine{Headless: true, StartPaused: true, WatchOutput: &log}
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(10e6); err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Stop()
+	waitPause(t, machine, PauseRequested, 0)
+	machine.AddWatchpoint(core.Region{Start: 0x1000, Length: 1}, core.AccessWrite, WatchPause)
+	machine.AddWatchpoint(core.Region{Start: 0x1001, Length: 1}, core.AccessRead, WatchLog)
+	machine.Resume()
+	select {
+	case evt := <-machine.PauseC:
+		if evt.Reason != PauseWatchpoint || evt.PC != prog.Labels["mark"]+2 || evt.Address != 0x1000 || evt.Access != core.AccessWrite {
+			t.Fatalf("Expected a write to 0x1000, found %+v", evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the watchpoint")
+	}
+
+	machine.SetBreakpoint(prog.Labels["loop"])
+	machine.Resume()
+	waitPause(t, machine, PauseBreakpoint, prog.Labels["loop"])
+	expected := fmt.Sprintf("watch: PC %04x read [1001] = 0000", prog.Labels["mark"]+2)
+	if !strings.HasPrefix(log.String(), expected) {
+		t.Errorf("Expected the read to be logged as %q, found %q", expected, log.String())
+	}
+}
@@ -0,0 +1,364 @@
+// Package disasm turns DCPU-16 machine code back into assembly.
+//
+// The output uses the same syntax accepted by the asm package. Words that
+// don't decode to a valid instruction are emitted as DAT. Labels can be
+// synthesized for the targets of jumps (JSR, SET PC and IAS with a literal
+// value), which makes control flow a lot easier to follow.
+package disasm
+
+import (
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io"
+	"strings"
+)
+
+// Instruction is a single decoded instruction
+type Instruction struct {
+	Address  core.Word   // the address of the first word
+	Words    []core.Word // every word of the instruction, including next words
+	Mnemonic string      // "DAT" if the words aren't a valid instruction
+	Operands []Operand   // in source order
+}
+
+// Operand is a single decoded operand
+type Operand struct {
+	Code    core.Word // the 6-bit operand code
+	Next    core.Word // the value of the next word, if the operand uses one
+	spec    core.SpecVersion
+	isA     bool
+	literal bool // whether this is the operand of a DAT
+}
+
+// Reader is anything that words can be loaded from, such as core.Memory
+type Reader interface {
+	Load(address core.Word) core.Word
+}
+
+// words adapts a slice to the Reader interface. Addresses past the end
+// of the slice read as zero.
+type words struct {
+	origin core.Word
+	words  []core.Word
+}
+
+func (w words) Load(address core.Word) core.Word {
+	i := int(address - w.origin)
+	if i < len(w.words) {
+		return w.words[i]
+	}
+	return 0
+}
+
+// Decode decodes the instruction at the given address
+func Decode(r Reader, address core.Word, spec core.SpecVersion) Instruction {
+	word := r.Load(address)
+	inst := Instruction{Address: address, Words: []core.Word{word}}
+	var codes []core.Word // operand codes, in source order
+	var isA []bool
+	if spec == core.Spec17 {
+		op, b, a := word&0x1f, (word>>5)&0x1f, word>>10
+		if op == 0 {
+			inst.Mnemonic = specialOpcodes17[b]
+			codes, isA = []core.Word{a}, []bool{true}
+		} else {
+			inst.Mnemonic = basicOpcodes17[op]
+			codes, isA = []core.Word{b, a}, []bool{false, true}
+		}
+	} else {
+		op, a, b := word&0xf, (word>>4)&0x3f, word>>10
+		if op == 0 {
+			inst.Mnemonic = specialOpcodes11[a]
+			codes, isA = []core.Word{b}, []bool{true}
+		} else {
+			inst.Mnemonic = basicOpcodes11[op]
+			codes, isA = []core.Word{a, b}, []bool{false, true}
+		}
+	}
+	if inst.Mnemonic == "" {
+		return dat(address, word)
+	}
+	inst.Operands = make([]Operand, len(codes))
+	for i, code := range codes {
+		inst.Operands[i] = Operand{Code: code, spec: spec, isA: isA[i]}
+	}
+	// next words are read in the order the operands are decoded,
+	// which in 1.7 is a before b
+	order := []int{0, 1}
+	if spec == core.Spec17 {
+		order = []int{1, 0}
+	}
+	next := address + 1
+	for _, i := range order {
+		if i >= len(inst.Operands) {
+			continue
+		}
+		if operand := &inst.Operands[i]; operand.HasNextWord() {
+			operand.Next = r.Load(next)
+			inst.Words = append(inst.Words, operand.Next)
+			next++
+		}
+	}
+	return inst
+}
+
+// dat returns a DAT pseudo-instruction for a single word
+func dat(address, word core.Word) Instruction {
+	return Instruction{
+		Address:  address,
+		Words:    []core.Word{word},
+		Mnemonic: "DAT",
+		Operands: []Operand{{Next: word, literal: true}},
+	}
+}
+
+// Disassemble decodes the words, which are loaded at origin, into a list of
+// instructions. An instruction that would run past the end of the words is
+// emitted as DAT instead.
+func Disassemble(input []core.Word, origin core.Word, spec core.SpecVersion) []Instruction {
+	r := words{origin, input}
+	var insts []Instruction
+	for i := 0; i < len(input); {
+		inst := Decode(r, origin+core.Word(i), spec)
+		if i+len(inst.Words) > len(input) {
+			inst = dat(inst.Address, input[i])
+		}
+		insts = append(insts, inst)
+		i += len(inst.Words)
+	}
+	return insts
+}
+
+// DisassembleMemory decodes the instructions in memory from start up to,
+// but not including, end.
+func DisassembleMemory(r Reader, start, end core.Word, spec core.SpecVersion) []Instruction {
+	input := make([]core.Word, int(end-start))
+	for i := range input {
+		input[i] = r.Load(start + core.Word(i))
+	}
+	return Disassemble(input, start, spec)
+}
+
+// maxInstructionLength is the number of words in the longest instruction
+const maxInstructionLength = 3
+
+// Around decodes the instructions surrounding the one at pc, returning up to
+// before instructions preceding it and after instructions following it.
+// Instructions are variable length, so the preceding ones are found by picking
+// the earliest starting point that decodes cleanly up to pc.
+func Around(r Reader, pc core.Word, before, after int, spec core.SpecVersion) []Instruction {
+	var prefix []Instruction
+	for back := before * maxInstructionLength; back > 0 && prefix == nil; back-- {
+		if int(pc) < back {
+			continue
+		}
+		addr := pc - core.Word(back)
+		var insts []Instruction
+		for addr < pc {
+			inst := Decode(r, addr, spec)
+			insts = append(insts, inst)
+			addr += core.Word(len(inst.Words))
+		}
+		if addr == pc {
+			prefix = insts
+		}
+	}
+	if len(prefix) > before {
+		prefix = prefix[len(prefix)-before:]
+	}
+	insts := prefix
+	addr := pc
+	for i := 0; i <= after; i++ {
+		inst := Decode(r, addr, spec)
+		insts = append(insts, inst)
+		addr += core.Word(len(inst.Words))
+		if addr < inst.Address {
+			// wrapped around the end of memory
+			break
+		}
+	}
+	return insts
+}
+
+// HasNextWord returns true if the operand reads the next word
+func (o Operand) HasNextWord() bool {
+	if o.literal {
+		return false
+	}
+	switch {
+	case o.Code >= 0x10 && o.Code <= 0x17, o.Code == 0x1e, o.Code == 0x1f:
+		return true
+	case o.Code == 0x1a:
+		// PICK n
+		return o.spec == core.Spec17
+	}
+	return false
+}
+
+// Literal returns the value of a literal operand, or false if the
+// operand isn't a literal
+func (o Operand) Literal() (core.Word, bool) {
+	switch {
+	case o.literal, o.Code == 0x1f:
+		return o.Next, true
+	case o.Code >= 0x20 && o.spec == core.Spec17:
+		return o.Code - 0x21, true
+	case o.Code >= 0x20:
+		return o.Code - 0x20, true
+	}
+	return 0, false
+}
+
+var registerNames = [...]string{"A", "B", "C", "X", "Y", "Z", "I", "J"}
+
+// String formats the operand as assembly
+func (o Operand) String() string {
+	return o.format(nil)
+}
+
+// format formats the operand, using a label in place of a literal
+// next word if one exists
+func (o Operand) format(labels map[core.Word]string) string {
+	if o.literal {
+		return fmt.Sprintf("0x%04x", o.Next)
+	}
+	switch code := o.Code; {
+	case code <= 0x07:
+		return registerNames[code]
+	case code <= 0x0f:
+		return "[" + registerNames[code-0x08] + "]"
+	case code <= 0x17:
+		return fmt.Sprintf("[0x%04x+%s]", o.Next, registerNames[code-0x10])
+	case code == 0x18:
+		if o.spec == core.Spec17 && !o.isA {
+			return "PUSH"
+		}
+		return "POP"
+	case code == 0x19:
+		return "PEEK"
+	case code == 0x1a:
+		if o.spec == core.Spec17 {
+			return fmt.Sprintf("PICK 0x%04x", o.Next)
+		}
+		return "PUSH"
+	case code == 0x1b:
+		return "SP"
+	case code == 0x1c:
+		return "PC"
+	case code == 0x1d:
+		if o.spec == core.Spec17 {
+			return "EX"
+		}
+		return "O"
+	case code == 0x1e:
+		return fmt.Sprintf("[0x%04x]", o.Next)
+	case code == 0x1f:
+		if label, ok := labels[o.Next]; ok {
+			return label
+		}
+		return fmt.Sprintf("0x%04x", o.Next)
+	}
+	val, _ := o.Literal()
+	if val == 0xffff {
+		return "-1"
+	}
+	return fmt.Sprint(val)
+}
+
+// Target returns the address that the instruction jumps to, if it's a jump
+// to a literal address. Interrupt handlers set with IAS count as jumps.
+func (inst Instruction) Target() (core.Word, bool) {
+	var src Operand
+	switch {
+	case inst.Mnemonic == "JSR" || inst.Mnemonic == "IAS":
+		src = inst.Operands[0]
+	case inst.Mnemonic == "SET" && inst.Operands[0].Code == 0x1c:
+		src = inst.Operands[1]
+	default:
+		return 0, false
+	}
+	return src.Literal()
+}
+
+// String formats the instruction as assembly, without its address
+func (inst Instruction) String() string {
+	return inst.Format(nil)
+}
+
+// Format is like String, except that literal values in the next word are
+// replaced with the label at that address, if there is one.
+func (inst Instruction) Format(labels map[core.Word]string) string {
+	operands := make([]string, len(inst.Operands))
+	for i, o := range inst.Operands {
+		operands[i] = o.format(labels)
+	}
+	return inst.Mnemonic + " " + strings.Join(operands, ", ")
+}
+
+// Labels synthesizes a label for the target of every jump. Labels are only
+// created for targets that are the start of one of the instructions.
+func Labels(insts []Instruction) map[core.Word]string {
+	starts := make(map[core.Word]bool, len(insts))
+	for _, inst := range insts {
+		starts[inst.Address] = true
+	}
+	labels := make(map[core.Word]string)
+	for _, inst := range insts {
+		if target, ok := inst.Target(); ok && starts[target] {
+			labels[target] = fmt.Sprintf("label%04x", target)
+		}
+	}
+	return labels
+}
+
+// Write writes the instructions to w, one per line, prefixed with the address
+// and the raw words. Labels may be nil. If highlight is the address of one of
+// the instructions, that line is marked with an arrow.
+func Write(w io.Writer, insts []Instruction, labels map[core.Word]string, highlight int) error {
+	for _, inst := range insts {
+		if label, ok := labels[inst.Address]; ok {
+			if _, err := fmt.Fprintf(w, ":%s\n", label); err != nil {
+				return err
+			}
+		}
+		marker := "  "
+		if int(inst.Address) == highlight {
+			marker = "=>"
+		}
+		raw := make([]string, maxInstructionLength)
+		for i := range raw {
+			if i < len(inst.Words) {
+				raw[i] = fmt.Sprintf("%04x", inst.Words[i])
+			} else {
+				raw[i] = "    "
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s %04x: %s  %s\n", marker, inst.Address, strings.Join(raw, " "), inst.Format(labels)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var basicOpcodes11 = [16]string{
+	"", "SET", "ADD", "SUB", "MUL", "DIV", "MOD", "SHL",
+	"SHR", "AND", "BOR", "XOR", "IFE", "IFN", "IFG", "IFB",
+}
+
+var specialOpcodes11 = [64]string{
+	0x01: "JSR",
+}
+
+var basicOpcodes17 = [32]string{
+	0x01: "SET", 0x02: "ADD", 0x03: "SUB", 0x04: "MUL", 0x05: "MLI",
+	0x06: "DIV", 0x07: "DVI", 0x08: "MOD", 0x09: "MDI", 0x0a: "AND",
+	0x0b: "BOR", 0x0c: "XOR", 0x0d: "SHR", 0x0e: "ASR", 0x0f: "SHL",
+	0x10: "IFB", 0x11: "IFC", 0x12: "IFE", 0x13: "IFN", 0x14: "IFG",
+	0x15: "IFA", 0x16: "IFL", 0x17: "IFU", 0x1a: "ADX", 0x1b: "SBX",
+	0x1e: "STI", 0x1f: "STD",
+}
+
+var specialOpcodes17 = [32]string{
+	0x01: "JSR", 0x08: "INT", 0x09: "IAG", 0x0a: "IAS", 0x0b: "RFI",
+	0x0c: "IAQ", 0x10: "HWN", 0x11: "HWQ", 0x12: "HWI",
+}
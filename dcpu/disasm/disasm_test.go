@@ -0,0 +1,135 @@
+package disasm
+
+import (
+	"bytes"
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"strings"
+	"testing"
+)
+
+func disassembleSource(t *testing.T, src string, spec core.SpecVersion) []Instruction {
+	prog, err := asm.Assemble([]byte(src), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Disassemble(prog.Words, 0, spec)
+}
+
+func expectText(t *testing.T, insts []Instruction, expected []string) {
+	if len(insts) != len(expected) {
+		t.Fatalf("expected %d instructions, found %d", len(expected), len(insts))
+	}
+	for i, inst := range insts {
+		if inst.String() != expected[i] {
+			t.Errorf("instruction %d: expected %q, found %q", i, expected[i], inst.String())
+		}
+	}
+}
+
+func TestDisassemble11(t *testing.T) {
+	insts := disassembleSource(t, `
+		SET A, 0x30
+		SET [0x1000+I], 31
+		ADD PUSH, POP
+		SUB PEEK, [J]
+		IFB O, SP
+		JSR 0x1234
+		DAT 0x0000`, core.Spec11)
+	expectText(t, insts, []string{
+		"SET A, 0x0030",
+		"SET [0x1000+I], 31",
+		"ADD PUSH, POP",
+		"SUB PEEK, [J]",
+		"IFB O, SP",
+		"JSR 0x1234",
+		"DAT 0x0000",
+	})
+}
+
+func TestDisassemble17(t *testing.T) {
+	insts := disassembleSource(t, `
+		SET A, -1
+		SET [0x1000+B], 30
+		ADD PUSH, POP
+		SET B, PICK 2
+		STD [Z], EX
+		IFU A, [0x0002]
+		HWI 0
+		RFI 0
+		DAT 0x0018, 0x0000`, core.Spec17)
+	expectText(t, insts, []string{
+		"SET A, -1",
+		"SET [0x1000+B], 30",
+		"ADD PUSH, POP",
+		"SET B, PICK 0x0002",
+		"STD [Z], EX",
+		"IFU A, [0x0002]",
+		"HWI 0",
+		"RFI 0",
+		"DAT 0x0018",
+		"DAT 0x0000",
+	})
+}
+
+func TestTruncated(t *testing.T) {
+	// SET A, next word without the next word
+	insts := Disassemble([]core.Word{0x8401, 0x7c01}, 0, core.Spec11)
+	expectText(t, insts, []string{"SET A, 1", "DAT 0x7c01"})
+}
+
+func TestLabels(t *testing.T) {
+	insts := disassembleSource(t, `
+		:start SET A, 0x30
+		:loop  SUB A, 1
+		       IFN A, 0
+		       SET PC, loop
+		       JSR start
+		       SET PC, 0x1000`, core.Spec11)
+	labels := Labels(insts)
+	if len(labels) != 2 || labels[0] != "label0000" || labels[2] != "label0002" {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, insts, labels, 4); err != nil {
+		t.Fatal(err)
+	}
+	expected := `:label0000
+   0000: 7c01 0030       SET A, 0x0030
+:label0002
+   0002: 8403            SUB A, 1
+   0003: 800d            IFN A, 0
+=> 0004: 7dc1 0002       SET PC, label0002
+   0006: 7c10 0000       JSR label0000
+   0008: 7dc1 1000       SET PC, 0x1000
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestAround(t *testing.T) {
+	var mem core.Memory
+	prog, err := asm.Assemble([]byte(`
+		SET A, 0x30
+		SET B, 1
+		SET [0x1000+A], 0x1234
+		ADD A, B
+		SET PC, 0`), core.Spec17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range prog.Words {
+		mem.Store(core.Word(i), w)
+	}
+	insts := Around(&mem, 6, 2, 1, core.Spec17)
+	var addrs []string
+	for _, inst := range insts {
+		addrs = append(addrs, inst.String())
+	}
+	found := strings.Join(addrs, "; ")
+	expected := "SET B, 1; SET [0x1000+A], 0x1234; ADD A, B; SET PC, 0"
+	if found != expected {
+		t.Errorf("expected %q, found %q", expected, found)
+	}
+}
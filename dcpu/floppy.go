@@ -0,0 +1,269 @@
+// Mackapar 3.5" Floppy Drive (M35FD) implementation
+// Disks hold 1440 sectors of 512 words, in 80 tracks of 18 sectors. Reads and
+// writes happen asynchronously: the drive is busy while it seeks to the track
+// and transfers the sector, and the data is copied to or from RAM once the
+// transfer finishes. The drive raises an interrupt whenever its state or
+// error changes, if interrupts are enabled.
+//
+// Disk images are files on the host, holding the sectors in order as
+// big-endian words, the same as compiled programs. Writes are kept in memory
+// until the disk is ejected or the machine stops.
+
+package dcpu
+
+import (
+	"errors"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	floppyHardwareID      = 0x4fd524c5
+	floppyHardwareVersion = 0x000b
+	floppyManufacturer    = 0x1eb37e91 // MACKAPAR
+)
+
+const (
+	FloppySectorWords     = 512
+	FloppySectors         = 1440
+	floppySectorsPerTrack = 18
+	floppyWordsPerSecond  = 30700
+	floppySeekMicros      = 2400 // time to move between adjacent tracks
+)
+
+// HWI messages understood by the drive, passed in register A
+const (
+	floppyPoll         = 0
+	floppySetInterrupt = 1
+	floppyReadSector   = 2
+	floppyWriteSector  = 3
+)
+
+// FloppyState is the state of the drive, as reported to the program
+type FloppyState core.Word
+
+const (
+	FloppyNoMedia FloppyState = 0 // there's no disk in the drive
+	FloppyReady   FloppyState = 1 // the drive is ready to read or write
+	FloppyReadyWP FloppyState = 2 // the drive is ready to read, but the disk is write-protected
+	FloppyBusy    FloppyState = 3 // the drive is reading or writing
+)
+
+// FloppyError is the last error reported by the drive
+type FloppyError core.Word
+
+const (
+	FloppyErrorNone      FloppyError = 0
+	FloppyErrorBusy      FloppyError = 1      // the drive was busy
+	FloppyErrorNoMedia   FloppyError = 2      // there was no disk
+	FloppyErrorProtected FloppyError = 3      // the disk is write-protected
+	FloppyErrorEject     FloppyError = 4      // the disk was ejected while busy
+	FloppyErrorBadSector FloppyError = 5      // the sector doesn't exist
+	FloppyErrorBroken    FloppyError = 0xffff // something went wrong with the drive
+)
+
+var ErrNotDiskImage = errors.New("file is too large to be a disk image")
+
+// Floppy is an M35FD drive. Attach it to a Machine running the 1.7 spec with
+// AttachDevice. While the machine is running, Insert and Eject must be called
+// through Machine.Do.
+type Floppy struct {
+	disk      []core.Word // the disk's contents, or nil if there's no disk
+	path      string      // the disk image
+	protected bool
+	dirty     bool // whether the disk has been written since it was saved
+	err       FloppyError
+	message   core.Word // interrupt message, or 0 if interrupts are off
+	changed   bool      // whether the state or error changed since the last Tick
+	track     uint      // the track the head is over
+	// the operation in progress, if busy
+	busy    bool
+	writing bool
+	sector  core.Word
+	address core.Word
+	done    uint      // the cycle the operation finishes at
+	cycle   uint      // the current cycle, as of the last Tick
+	rate    ClockRate // the clock rate of the machine
+}
+
+// Insert inserts the disk image at path, ejecting any disk that's already in
+// the drive. If the file doesn't exist and the disk isn't write-protected,
+// the disk starts out blank, and the file is created when it's saved.
+func (f *Floppy) Insert(path string, protected bool) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !protected {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) > FloppySectors*FloppySectorWords*2 {
+		return ErrNotDiskImage
+	}
+	if err := f.Eject(); err != nil {
+		return err
+	}
+	disk := make([]core.Word, FloppySectors*FloppySectorWords)
+	for i := 0; i+1 < len(data); i += 2 {
+		disk[i/2] = core.Word(data[i])<<8 | core.Word(data[i+1])
+	}
+	f.disk, f.path, f.protected, f.dirty = disk, path, protected, false
+	f.changed = true
+	return nil
+}
+
+// Eject saves the disk, if it was written, and removes it from the drive.
+// Ejecting a disk while the drive is busy cancels the operation.
+func (f *Floppy) Eject() error {
+	if f.disk == nil {
+		return nil
+	}
+	err := f.Flush()
+	if f.busy {
+		f.busy = false
+		f.err = FloppyErrorEject
+	}
+	f.disk, f.path = nil, ""
+	f.changed = true
+	return err
+}
+
+// Inserted returns the path of the disk image in the drive, if there is one
+func (f *Floppy) Inserted() (path string, ok bool) {
+	return f.path, f.disk != nil
+}
+
+// Flush saves the disk to its image, if it has been written
+func (f *Floppy) Flush() error {
+	if !f.dirty {
+		return nil
+	}
+	data := make([]byte, len(f.disk)*2)
+	for i, w := range f.disk {
+		data[i*2], data[i*2+1] = byte(w>>8), byte(w)
+	}
+	if err := ioutil.WriteFile(f.path, data, 0666); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+func (f *Floppy) State() FloppyState {
+	switch {
+	case f.disk == nil:
+		return FloppyNoMedia
+	case f.busy:
+		return FloppyBusy
+	case f.protected:
+		return FloppyReadyWP
+	}
+	return FloppyReady
+}
+
+func (f *Floppy) HardwareID() uint32 {
+	return floppyHardwareID
+}
+
+func (f *Floppy) HardwareVersion() core.Word {
+	return floppyHardwareVersion
+}
+
+func (f *Floppy) Manufacturer() uint32 {
+	return floppyManufacturer
+}
+
+func (f *Floppy) HandleInterrupt(s *core.State) (uint, error) {
+	switch s.A() {
+	case floppyPoll:
+		s.SetB(core.Word(f.State()))
+		s.SetC(core.Word(f.err))
+		f.err = FloppyErrorNone
+	case floppySetInterrupt:
+		f.message = s.X()
+	case floppyReadSector, floppyWriteSector:
+		writing := s.A() == floppyWriteSector
+		if err := f.start(writing, s.X(), s.Y()); err != FloppyErrorNone {
+			f.setError(err)
+			s.SetB(0)
+		} else {
+			s.SetB(1)
+		}
+	}
+	return 0, nil
+}
+
+// start starts reading or writing a sector, if that's possible
+func (f *Floppy) start(writing bool, sector, address core.Word) FloppyError {
+	switch {
+	case f.disk == nil:
+		return FloppyErrorNoMedia
+	case f.busy:
+		return FloppyErrorBusy
+	case writing && f.protected:
+		return FloppyErrorProtected
+	case sector >= FloppySectors:
+		return FloppyErrorBadSector
+	}
+	f.busy, f.writing, f.sector, f.address = true, writing, sector, address
+	f.done = f.cycle + f.duration()
+	f.changed = true
+	return FloppyErrorNone
+}
+
+func (f *Floppy) setError(err FloppyError) {
+	if f.err != err {
+		f.err = err
+		f.changed = true
+	}
+}
+
+// duration returns the number of cycles it takes to seek to the track and
+// transfer the sector, at the machine's clock rate
+func (f *Floppy) duration() uint {
+	track := uint(f.sector) / floppySectorsPerTrack
+	tracks := track - f.track
+	if track < f.track {
+		tracks = f.track - track
+	}
+	f.track = track
+	micros := uint64(tracks)*floppySeekMicros + FloppySectorWords*1000000/floppyWordsPerSecond
+	return uint(micros * uint64(f.rate) / 1e6)
+}
+
+// Tick finishes the operation in progress once enough time has passed, and
+// raises an interrupt if the state or error changed.
+func (f *Floppy) Tick(m *Machine) error {
+	f.cycle, f.rate = m.cycleCount, m.rate
+	if f.busy && f.cycle >= f.done {
+		f.finish(&m.State)
+	}
+	if !f.changed {
+		return nil
+	}
+	f.changed = false
+	if f.message != 0 {
+		return m.State.Interrupt(f.message)
+	}
+	return nil
+}
+
+// finish copies the sector to or from RAM
+func (f *Floppy) finish(s *core.State) {
+	sector := f.disk[int(f.sector)*FloppySectorWords:][:FloppySectorWords]
+	for i := range sector {
+		address := f.address + core.Word(i)
+		if f.writing {
+			sector[i] = s.Ram.Load(address)
+		} else if err := s.Ram.Store(address, sector[i]); err != nil {
+			// the words that could be stored are left in place
+			f.setError(FloppyErrorBroken)
+		}
+	}
+	if f.writing {
+		f.dirty = true
+	}
+	f.busy = false
+	f.changed = true
+}
@@ -0,0 +1,134 @@
+package dcpu
+
+import (
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFloppy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "floppy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a short image, with a marker at the start of sector 1
+	path := filepath.Join(dir, "disk.img")
+	image := make([]byte, 2*FloppySectorWords+4)
+	image[2*FloppySectorWords], image[2*FloppySectorWords+1] = 0x12, 0x34
+	image[2*FloppySectorWords+3] = 0x56
+	if err := ioutil.WriteFile(path, image, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// copy sector 1 to sector 5, counting interrupts, then try a bad sector
+	prog, err := asm.Assemble([]byte(`
+		      IAS handler
+		      SET A, 1
+		      SET X, 0x99
+		      HWI 3
+		      SET A, 2
+		      SET X, 1
+		      SET Y, 0x2000
+		      HWI 3
+		      SET [0x1000], B
+		      JSR wait
+		      SET A, 3
+		      SET X, 5
+		      HWI 3
+		      SET [0x1001], B
+		      JSR wait
+		      SET A, 3
+		      SET X, 1440
+		      HWI 3
+		      SET [0x1002], B
+		      SET A, 0
+		      HWI 3
+		      SET [0x1004], C
+		:loop SET PC, loop
+		:wait SET A, 0
+		      HWI 3
+		      IFE B, 3
+		      SET PC, wait
+		      SET PC, POP
+		:handler
+		      ADD [0x1003], 1
+		      RFI 0`), core.Spec17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	floppy := new(Floppy)
+	if err := floppy.Insert(path, false); err != nil {
+		t.Fatal(err)
+	}
+	machine := &Machine{Headless: true, VirtualTime: true, CycleLimit: 10000}
+	machine.State.Spec = core.Spec17
+	if err := machine.AttachDevice(floppy); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(DefaultClockRate); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-machine.ErrorC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the cycle limit")
+	}
+	if err := machine.Stop(); err != ErrCycleLimit {
+		t.Errorf("Expected ErrCycleLimit, found %v", err)
+	}
+
+	// started, started, failed, the interrupts and the error
+	if results := machine.State.Ram.GetSlice(0x1000, 0x1005); !wordsEqual(results, []core.Word{1, 1, 0, 5, core.Word(FloppyErrorBadSector)}) {
+		t.Errorf("Unexpected results %v", results)
+	}
+	if sector := machine.State.Ram.GetSlice(0x2000, 0x2002); !wordsEqual(sector, []core.Word{0x1234, 0x0056}) {
+		t.Errorf("Expected sector 1 to be read, found %v", sector)
+	}
+	// stopping the machine saved the disk
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != FloppySectors*FloppySectorWords*2 {
+		t.Fatalf("Expected a full disk image, found %d bytes", len(data))
+	}
+	if sector := data[5*2*FloppySectorWords:]; sector[0] != 0x12 || sector[1] != 0x34 || sector[3] != 0x56 {
+		t.Errorf("Expected sector 5 to be copied from sector 1, found % x", sector[:4])
+	}
+}
+
+func TestFloppyProtected(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "missing-floppy.img")
+	floppy := new(Floppy)
+	if err := floppy.Insert(path, true); !os.IsNotExist(err) {
+		t.Errorf("Expected a protected disk to need an image, found %v", err)
+	}
+	if err := floppy.Insert(path, false); err != nil {
+		t.Fatal(err)
+	}
+	floppy.protected = true
+	state := new(core.State)
+	state.SetA(floppyWriteSector)
+	floppy.HandleInterrupt(state)
+	if state.B() != 0 {
+		t.Error("Expected writing a protected disk to fail")
+	}
+	state.SetA(floppyPoll)
+	floppy.HandleInterrupt(state)
+	if FloppyState(state.B()) != FloppyReadyWP || FloppyError(state.C()) != FloppyErrorProtected {
+		t.Errorf("Unexpected state %d and error %d", state.B(), state.C())
+	}
+	floppy.Eject()
+	floppy.HandleInterrupt(state)
+	if FloppyState(state.B()) != FloppyNoMedia {
+		t.Errorf("Expected no media, found %d", state.B())
+	}
+}
@@ -0,0 +1,90 @@
+package dcpu
+
+import (
+	"github.com/kballard/dcpu16/dcpu/core"
+	"image"
+	"image/color"
+)
+
+// The framebuffer renders the display pixel by pixel, independent of the
+// terminal. Each cell is a 4x8 glyph, which gives 128x96 pixels of display
+// surrounded by the border.
+const (
+	FrameBorder = 16 // width of the border on each side, in pixels
+	FrameWidth  = windowWidth*glyphWidth + 2*FrameBorder
+	FrameHeight = windowHeight*glyphHeight + 2*FrameBorder
+	glyphWidth  = 4
+	glyphHeight = 8
+)
+
+// Frame renders the current contents of the display, including the border,
+// into a new FrameWidth x FrameHeight image. If blinkHidden is true, blinking
+// characters are drawn in the hidden half of their cycle.
+// Frame reads video memory, so it must not race with a running machine.
+func (v *Video) Frame(blinkHidden bool) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, FrameWidth, FrameHeight))
+	v.RenderFrame(img, blinkHidden)
+	return img
+}
+
+// RenderFrame is like Frame but renders into an existing image,
+// which must be at least FrameWidth x FrameHeight.
+func (v *Video) RenderFrame(img *image.RGBA, blinkHidden bool) {
+	// the border is the background of the whole frame
+	border := rgbToColor(v.paletteColor(v.borderColor()))
+	for y := 0; y < FrameHeight; y++ {
+		for x := 0; x < FrameWidth; x++ {
+			img.SetRGBA(x, y, border)
+		}
+	}
+	if v.ram != nil && v.screen == 0 {
+		// the LEM1802 is disconnected, draw it black
+		black := color.RGBA{0, 0, 0, 0xff}
+		for y := FrameBorder; y < FrameHeight-FrameBorder; y++ {
+			for x := FrameBorder; x < FrameWidth-FrameBorder; x++ {
+				img.SetRGBA(x, y, black)
+			}
+		}
+		return
+	}
+	for i := 0; i < windowWidth*windowHeight; i++ {
+		word := v.cell(i)
+		// same layout as updateCell; fg, bg, blink, character
+		fg := rgbToColor(v.paletteColor(byte(word >> 12)))
+		bg := rgbToColor(v.paletteColor(byte(word >> 8)))
+		hidden := blinkHidden && word&0x80 != 0
+		glyph := v.glyph(byte(word))
+		x0 := FrameBorder + (i%windowWidth)*glyphWidth
+		y0 := FrameBorder + (i/windowWidth)*glyphHeight
+		for col := 0; col < glyphWidth; col++ {
+			bits := glyphColumn(glyph, col)
+			for row := 0; row < glyphHeight; row++ {
+				c := bg
+				if !hidden && bits&(1<<uint(row)) != 0 {
+					c = fg
+				}
+				img.SetRGBA(x0+col, y0+row, c)
+			}
+		}
+	}
+}
+
+// glyphColumn returns the bits of one column of a glyph,
+// with the least significant bit at the top
+func glyphColumn(glyph [2]core.Word, col int) byte {
+	word := glyph[col/2]
+	if col%2 == 0 {
+		return byte(word >> 8)
+	}
+	return byte(word)
+}
+
+// rgbToColor converts a 0x0rgb palette entry to a color
+func rgbToColor(rgb core.Word) color.RGBA {
+	return color.RGBA{
+		R: byte(rgb>>8&0xf) * 0x11,
+		G: byte(rgb>>4&0xf) * 0x11,
+		B: byte(rgb&0xf) * 0x11,
+		A: 0xff,
+	}
+}
@@ -0,0 +1,49 @@
+package dcpu
+
+import (
+	"github.com/kballard/dcpu16/dcpu/core"
+	"image/color"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	state := new(core.State)
+	video := Video{ram: &state.Ram, screen: 0x8000, border: 4}
+	// white 'A' on blue, then a blinking white 'A' on blue
+	state.Ram.Store(0x8000, 0xf141)
+	state.Ram.Store(0x8001, 0xf1c1)
+
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	blue := color.RGBA{0, 0, 0xaa, 0xff}
+	red := color.RGBA{0xaa, 0, 0, 0xff}
+	img := video.Frame(false)
+	if b := img.Bounds(); b.Dx() != FrameWidth || b.Dy() != FrameHeight {
+		t.Fatalf("Unexpected frame size %v", b)
+	}
+	// the first column of 'A' is 0x7e
+	expected := []color.RGBA{blue, white, white, white, white, white, white, blue}
+	for row, c := range expected {
+		if found := img.RGBAAt(FrameBorder, FrameBorder+row); found != c {
+			t.Errorf("Unexpected pixel in row %d; expected %v, found %v", row, c, found)
+		}
+	}
+	if found := img.RGBAAt(0, 0); found != red {
+		t.Errorf("Unexpected border color; expected %v, found %v", red, found)
+	}
+	// the blinking character is only visible half the time
+	if found := img.RGBAAt(FrameBorder+glyphWidth, FrameBorder+1); found != white {
+		t.Errorf("Unexpected blink pixel; expected %v, found %v", white, found)
+	}
+	img = video.Frame(true)
+	if found := img.RGBAAt(FrameBorder+glyphWidth, FrameBorder+1); found != blue {
+		t.Errorf("Unexpected blink pixel; expected %v, found %v", blue, found)
+	}
+
+	// custom palettes are read out of RAM
+	state.Ram.Store(0x9000+1, 0x0123)
+	video.palette = 0x9000
+	img = video.Frame(false)
+	if found, c := img.RGBAAt(FrameBorder, FrameBorder), (color.RGBA{0x11, 0x22, 0x33, 0xff}); found != c {
+		t.Errorf("Unexpected palette color; expected %v, found %v", c, found)
+	}
+}
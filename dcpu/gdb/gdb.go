@@ -0,0 +1,658 @@
+// Package gdb implements a stub for the GDB remote serial protocol, which
+// lets GDB and compatible front-ends debug a running dcpu.Machine.
+//
+// The DCPU-16 is word-addressed, so memory addresses in the protocol are word
+// addresses, and every word is transferred as two bytes in big-endian order,
+// the same as compiled programs. Lengths are still given in bytes. The
+// registers are A, B, C, X, Y, Z, I, J, SP, PC, EX and IA, in that order, each
+// transferred as a big-endian word. A target description is provided, so GDB
+// knows about them without any extra configuration.
+//
+// Software and hardware breakpoints are supported, as are write, read and
+// access watchpoints. Decoding an operand counts as reading it, so an access
+// watchpoint on the destination of a SET is hit by the read as well as the
+// write.
+// When the machine stops because of an error, the error is reported as a
+// signal: SIGSEGV for protection violations, SIGILL for invalid opcodes,
+// SIGABRT when the DCPU-16 catches fire and SIGXCPU when the cycle limit is
+// reached. A halted program is reported as having exited.
+package gdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrKilled is returned by Serve when the client kills the program
+var ErrKilled = errors.New("killed by the debugger")
+
+// Listen listens on the given address. Addresses of the form unix:path listen
+// on a Unix socket, anything else is treated as a TCP address. A TCP address
+// without a host only listens on the loopback interface.
+func Listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return net.Listen("unix", addr[len("unix:"):])
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	return net.Listen("tcp", addr)
+}
+
+// packetSize is the largest packet the client may send, and that we send,
+// not counting the framing. It's advertised by qSupported.
+const packetSize = 0x4000
+
+// signals reported in stop replies
+const (
+	sigINT  = 2
+	sigILL  = 4
+	sigTRAP = 5
+	sigABRT = 6
+	sigSEGV = 11
+	sigXCPU = 24
+)
+
+// server is the state of a single debugging session
+type server struct {
+	machine *dcpu.Machine
+	w       *bufio.Writer
+	noAck   bool
+	running bool
+	// the error that stopped the machine, once it has
+	stopErr error
+	// the last packet sent, in case it needs to be resent
+	last []byte
+	// the ids of the machine watchpoints set by each Z packet
+	watches map[watchpoint][]int
+}
+
+// watchpoint identifies a watchpoint by the Z packet that set it
+type watchpoint struct {
+	kind   string
+	region core.Region
+}
+
+// watchAccess maps the kinds of watchpoint in Z packets to the accesses
+// they watch for
+var watchAccess = map[string]core.Access{
+	"2": core.AccessWrite,
+	"3": core.AccessRead,
+	"4": core.AccessRead | core.AccessWrite,
+}
+
+// received is a packet, or an interrupt, read from the client
+type received struct {
+	packet    string
+	interrupt bool
+	nak       bool // the client wants our last packet again
+	corrupt   bool // the packet's checksum was wrong
+}
+
+// Serve serves a single client, which debugs the machine. The machine should
+// have been started paused. Serve returns nil when the client detaches, which
+// leaves the machine running, or ErrKilled when the client kills the program.
+// Either way, the machine's PauseC and ErrorC channels must not be read from
+// while Serve is running.
+func Serve(conn io.ReadWriter, m *dcpu.Machine) error {
+	s := &server{
+		machine: m,
+		w:       bufio.NewWriter(conn),
+		watches: make(map[watchpoint][]int),
+	}
+	input := make(chan received)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- readPackets(bufio.NewReader(conn), input)
+		close(input)
+	}()
+	pauseC, errorC := m.PauseC, m.ErrorC
+	// the client already knows the machine starts paused, so that pause
+	// mustn't be reported once it's running
+	select {
+	case <-pauseC:
+	default:
+	}
+	for {
+		select {
+		case r, ok := <-input:
+			if !ok {
+				return <-readErr
+			}
+			switch {
+			case r.interrupt:
+				if s.running {
+					m.Pause()
+				}
+			case r.nak:
+				if err := s.resend(); err != nil {
+					return err
+				}
+			case r.corrupt:
+				// ask the client to send it again
+				if !s.noAck {
+					if err := s.write([]byte{'-'}); err != nil {
+						return err
+					}
+				}
+			default:
+				if !s.noAck {
+					if err := s.write([]byte{'+'}); err != nil {
+						return err
+					}
+				}
+				reply, err := s.handle(r.packet)
+				if reply != nil {
+					if err := s.send(*reply); err != nil {
+						return err
+					}
+				}
+				if err == errDetached {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		case evt := <-pauseC:
+			if s.running {
+				s.running = false
+				if err := s.send(s.pauseReply(evt)); err != nil {
+					return err
+				}
+			}
+		case err := <-errorC:
+			// ErrorC is closed after the error is sent
+			errorC = nil
+			s.stopErr = err
+			if s.running {
+				s.running = false
+				if err := s.send(s.errorReply(err)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+var errDetached = errors.New("detached")
+
+// readPackets reads from the client until an error occurs
+func readPackets(r *bufio.Reader, input chan<- received) error {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case 0x03:
+			input <- received{interrupt: true}
+		case '-':
+			input <- received{nak: true}
+		case '$':
+			data, err := r.ReadBytes('#')
+			if err != nil {
+				return err
+			}
+			var sum [2]byte
+			if _, err := io.ReadFull(r, sum[:]); err != nil {
+				return err
+			}
+			data = data[:len(data)-1]
+			if expected, err := strconv.ParseUint(string(sum[:]), 16, 8); err != nil || byte(expected) != checksum(data) {
+				input <- received{corrupt: true}
+				continue
+			}
+			input <- received{packet: string(unescape(data))}
+		}
+		// anything else, such as acks, is ignored
+	}
+}
+
+func checksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return sum
+}
+
+// unescape removes the escaping used by binary data
+func unescape(data []byte) []byte {
+	if bytes.IndexByte(data, '}') < 0 {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			i++
+			out = append(out, data[i]^0x20)
+		} else {
+			out = append(out, data[i])
+		}
+	}
+	return out
+}
+
+func (s *server) write(data []byte) error {
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// send sends a packet to the client
+func (s *server) send(payload string) error {
+	var buf bytes.Buffer
+	buf.WriteByte('$')
+	for i := 0; i < len(payload); i++ {
+		switch c := payload[i]; c {
+		case '$', '#', '}', '*':
+			buf.WriteByte('}')
+			buf.WriteByte(c ^ 0x20)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	fmt.Fprintf(&buf, "#%02x", checksum(buf.Bytes()[1:]))
+	s.last = buf.Bytes()
+	return s.write(s.last)
+}
+
+func (s *server) resend() error {
+	if s.last == nil {
+		return nil
+	}
+	return s.write(s.last)
+}
+
+// reply wraps a packet payload
+func reply(payload string) *string {
+	return &payload
+}
+
+// replyError is an error response to a packet
+var replyError = reply("E01")
+
+var replyOK = reply("OK")
+
+// handle handles a packet. A nil reply means nothing should be sent yet,
+// because the machine is running. An error ends the session.
+func (s *server) handle(packet string) (*string, error) {
+	if packet == "" {
+		return reply(""), nil
+	}
+	m := s.machine
+	cmd, args := packet[0], packet[1:]
+	switch cmd {
+	case '?':
+		return reply(s.stopReply()), nil
+	case 'g':
+		var buf bytes.Buffer
+		m.Do(func() {
+			for _, val := range m.State.Registers {
+				writeWord(&buf, val)
+			}
+		})
+		return reply(buf.String()), nil
+	case 'G':
+		words, ok := parseWords(args)
+		if !ok || len(words) != len(m.State.Registers) {
+			return replyError, nil
+		}
+		m.Do(func() {
+			copy(m.State.Registers[:], words)
+		})
+		return replyOK, nil
+	case 'p':
+		index, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || int(index) >= len(m.State.Registers) {
+			return replyError, nil
+		}
+		var buf bytes.Buffer
+		m.Do(func() {
+			writeWord(&buf, m.State.Registers[index])
+		})
+		return reply(buf.String()), nil
+	case 'P':
+		parts := strings.SplitN(args, "=", 2)
+		if len(parts) != 2 {
+			return replyError, nil
+		}
+		index, err := strconv.ParseUint(parts[0], 16, 8)
+		words, ok := parseWords(parts[1])
+		if err != nil || !ok || len(words) != 1 || int(index) >= len(m.State.Registers) {
+			return replyError, nil
+		}
+		m.Do(func() {
+			m.State.Registers[index] = words[0]
+		})
+		return replyOK, nil
+	case 'm':
+		addr, length, ok := parseRange(args)
+		if !ok {
+			return replyError, nil
+		}
+		if length > packetSize/2 {
+			// each byte takes two hex digits. A short reply is allowed, and
+			// the client asks for the rest separately.
+			length = packetSize / 2
+		}
+		var buf bytes.Buffer
+		m.Do(func() {
+			for i := 0; i < (length+1)/2; i++ {
+				writeWord(&buf, m.State.Ram.Load(addr+core.Word(i)))
+			}
+		})
+		// an odd length only wants the high byte of the last word
+		return reply(buf.String()[:length*2]), nil
+	case 'M':
+		parts := strings.SplitN(args, ":", 2)
+		if len(parts) != 2 {
+			return replyError, nil
+		}
+		addr, length, ok := parseRange(parts[0])
+		words, ok2 := parseWords(parts[1])
+		if !ok || !ok2 || length != len(words)*2 {
+			return replyError, nil
+		}
+		var err error
+		m.Do(func() {
+			for i, w := range words {
+				if err = m.State.Ram.Store(addr+core.Word(i), w); err != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			return replyError, nil
+		}
+		return replyOK, nil
+	case 'c', 's':
+		if args != "" {
+			addr, err := strconv.ParseUint(args, 16, 16)
+			if err != nil {
+				return replyError, nil
+			}
+			m.Do(func() {
+				m.State.SetPC(core.Word(addr))
+			})
+		}
+		return s.resume(cmd == 's')
+	case 'v':
+		return s.handleV(args)
+	case 'Z', 'z':
+		return s.handleBreakpoint(cmd == 'Z', args), nil
+	case 'q', 'Q':
+		return s.handleQuery(packet), nil
+	case 'H', 'T':
+		// there's only one thread
+		return replyOK, nil
+	case 'k':
+		return nil, ErrKilled
+	case 'D':
+		s.clearDebugging()
+		if s.stopErr == nil {
+			m.Resume()
+		}
+		return replyOK, errDetached
+	}
+	// unsupported
+	return reply(""), nil
+}
+
+// resume resumes the machine, or steps a single instruction
+func (s *server) resume(step bool) (*string, error) {
+	if s.stopErr != nil {
+		return reply(s.errorReply(s.stopErr)), nil
+	}
+	if step {
+		if err := s.machine.StepInstruction(); err != nil {
+			s.stopErr = err
+			return reply(s.errorReply(err)), nil
+		}
+		return reply(fmt.Sprintf("S%02x", sigTRAP)), nil
+	}
+	s.running = true
+	s.machine.Resume()
+	return nil, nil
+}
+
+func (s *server) handleV(args string) (*string, error) {
+	switch {
+	case args == "Cont?":
+		return reply("vCont;c;C;s;S"), nil
+	case strings.HasPrefix(args, "Cont;"):
+		// there's only one thread, so only the first action matters
+		action := strings.SplitN(args[len("Cont;"):], ";", 2)[0]
+		action = strings.SplitN(action, ":", 2)[0]
+		if len(action) == 0 {
+			return replyError, nil
+		}
+		switch action[0] {
+		case 'c', 'C':
+			return s.resume(false)
+		case 's', 'S':
+			return s.resume(true)
+		}
+		return replyError, nil
+	case strings.HasPrefix(args, "Kill"):
+		return replyOK, ErrKilled
+	}
+	return reply(""), nil
+}
+
+// handleBreakpoint handles the Z and z packets
+func (s *server) handleBreakpoint(insert bool, args string) *string {
+	parts := strings.Split(args, ",")
+	if len(parts) < 3 {
+		return replyError
+	}
+	addr, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return replyError
+	}
+	m := s.machine
+	switch parts[0] {
+	case "0", "1":
+		// software and hardware breakpoints are the same thing
+		if insert {
+			m.SetBreakpoint(core.Word(addr))
+		} else {
+			m.ClearBreakpoint(core.Word(addr))
+		}
+	case "2", "3", "4":
+		// write, read and access watchpoints, the length is in bytes
+		length, err := strconv.ParseUint(parts[2], 16, 16)
+		if err != nil || length == 0 {
+			return replyError
+		}
+		key := watchpoint{parts[0], core.Region{Start: core.Word(addr), Length: core.Word((length + 1) / 2)}}
+		ids := s.watches[key]
+		if insert {
+			id := m.AddWatchpoint(key.region, watchAccess[parts[0]], dcpu.WatchPause)
+			s.watches[key] = append(ids, id)
+		} else if len(ids) > 0 {
+			m.RemoveWatchpoint(ids[len(ids)-1])
+			if len(ids) == 1 {
+				delete(s.watches, key)
+			} else {
+				s.watches[key] = ids[:len(ids)-1]
+			}
+		}
+	default:
+		return reply("")
+	}
+	return replyOK
+}
+
+// clearDebugging removes every breakpoint and watchpoint
+func (s *server) clearDebugging() {
+	for _, addr := range s.machine.Breakpoints() {
+		s.machine.ClearBreakpoint(addr)
+	}
+	for _, ids := range s.watches {
+		for _, id := range ids {
+			s.machine.RemoveWatchpoint(id)
+		}
+	}
+	s.watches = make(map[watchpoint][]int)
+}
+
+const targetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.dcpu16.core">
+    <reg name="a" bitsize="16" type="uint16" regnum="0"/>
+    <reg name="b" bitsize="16" type="uint16"/>
+    <reg name="c" bitsize="16" type="uint16"/>
+    <reg name="x" bitsize="16" type="uint16"/>
+    <reg name="y" bitsize="16" type="uint16"/>
+    <reg name="z" bitsize="16" type="uint16"/>
+    <reg name="i" bitsize="16" type="uint16"/>
+    <reg name="j" bitsize="16" type="uint16"/>
+    <reg name="sp" bitsize="16" type="data_ptr"/>
+    <reg name="pc" bitsize="16" type="code_ptr"/>
+    <reg name="ex" bitsize="16" type="uint16"/>
+    <reg name="ia" bitsize="16" type="code_ptr"/>
+  </feature>
+</target>
+`
+
+func (s *server) handleQuery(packet string) *string {
+	switch {
+	case strings.HasPrefix(packet, "qSupported"):
+		return reply(fmt.Sprintf("PacketSize=%x;QStartNoAckMode+;qXfer:features:read+;swbreak+;hwbreak+", packetSize))
+	case packet == "QStartNoAckMode":
+		s.noAck = true
+		return replyOK
+	case packet == "qAttached":
+		return reply("1")
+	case packet == "qC":
+		return reply("QC1")
+	case packet == "qfThreadInfo":
+		return reply("m1")
+	case packet == "qsThreadInfo":
+		return reply("l")
+	case strings.HasPrefix(packet, "qXfer:features:read:target.xml:"):
+		// the annex is followed by offset,length
+		offset, length, ok := parseXferRange(packet[len("qXfer:features:read:target.xml:"):])
+		if !ok {
+			return replyError
+		}
+		if offset >= len(targetXML) {
+			return reply("l")
+		}
+		end := offset + length
+		if end >= len(targetXML) {
+			return reply("l" + targetXML[offset:])
+		}
+		return reply("m" + targetXML[offset:end])
+	}
+	return reply("")
+}
+
+// stopReply describes why the machine is stopped, for the ? packet
+func (s *server) stopReply() string {
+	if s.stopErr != nil {
+		return s.errorReply(s.stopErr)
+	}
+	return fmt.Sprintf("S%02x", sigTRAP)
+}
+
+func (s *server) pauseReply(evt dcpu.PauseEvent) string {
+	switch evt.Reason {
+	case dcpu.PauseRequested:
+		return fmt.Sprintf("S%02x", sigINT)
+	case dcpu.PauseBreakpoint:
+		return fmt.Sprintf("T%02xswbreak:;", sigTRAP)
+	case dcpu.PauseWatchpoint:
+		kind := "watch"
+		if evt.Access == core.AccessRead {
+			kind = "rwatch"
+		}
+		return fmt.Sprintf("T%02x%s:%x;", sigTRAP, kind, evt.Address)
+	}
+	return fmt.Sprintf("S%02x", sigTRAP)
+}
+
+// errorReply maps the error that stopped the machine to a signal
+func (s *server) errorReply(err error) string {
+	sig := sigABRT
+	switch err {
+	case dcpu.ErrHalted:
+		return "W00"
+	case dcpu.ErrCycleLimit:
+		sig = sigXCPU
+	}
+	if merr, ok := err.(*dcpu.MachineError); ok {
+		switch merr.UnderlyingError.(type) {
+		case *core.ProtectionError:
+			sig = sigSEGV
+		case *core.OpcodeError:
+			sig = sigILL
+		case *core.OnFireError:
+			sig = sigABRT
+		}
+	}
+	return fmt.Sprintf("S%02x", sig)
+}
+
+func writeWord(buf *bytes.Buffer, w core.Word) {
+	fmt.Fprintf(buf, "%04x", w)
+}
+
+// parseWords parses hex-encoded big-endian words
+func parseWords(str string) ([]core.Word, bool) {
+	data, err := hex.DecodeString(str)
+	if err != nil || len(data)%2 != 0 {
+		return nil, false
+	}
+	words := make([]core.Word, len(data)/2)
+	for i := range words {
+		words[i] = core.Word(data[i*2])<<8 | core.Word(data[i*2+1])
+	}
+	return words, true
+}
+
+// parseRange parses addr,length
+func parseRange(str string) (addr core.Word, length int, ok bool) {
+	parts := strings.Split(str, ",")
+	if len(parts) != 2 {
+		return
+	}
+	a, err := strconv.ParseUint(parts[0], 16, 16)
+	if err != nil {
+		return
+	}
+	l, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil || l > 0x20000 {
+		return
+	}
+	return core.Word(a), int(l), true
+}
+
+// parseXferRange parses the offset,length of a qXfer packet
+func parseXferRange(str string) (offset, length int, ok bool) {
+	parts := strings.Split(str, ",")
+	if len(parts) != 2 {
+		return
+	}
+	o, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return
+	}
+	l, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return
+	}
+	return int(o), int(l), true
+}
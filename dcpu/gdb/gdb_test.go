@@ -0,0 +1,167 @@
+package gdb
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client is a minimal GDB client
+type client struct {
+	t     *testing.T
+	conn  net.Conn
+	r     *bufio.Reader
+	noAck bool
+}
+
+func (c *client) send(packet string) {
+	fmt.Fprintf(c.conn, "$%s#%02x", packet, checksum([]byte(packet)))
+	if !c.noAck {
+		if b, err := c.r.ReadByte(); err != nil || b != '+' {
+			c.t.Fatalf("%s: expected ack, found %q (%v)", packet, b, err)
+		}
+	}
+}
+
+func (c *client) receive() string {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatal(err)
+	}
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	sum := make([]byte, 2)
+	if _, err := c.r.Read(sum); err != nil {
+		c.t.Fatal(err)
+	}
+	if !c.noAck {
+		c.conn.Write([]byte{'+'})
+	}
+	return data[:len(data)-1]
+}
+
+// exchange sends a packet and checks the reply
+func (c *client) exchange(packet, expected string) {
+	c.send(packet)
+	if found := c.receive(); found != expected {
+		c.t.Fatalf("%s: expected %q, found %q", packet, expected, found)
+	}
+}
+
+func TestServe(t *testing.T) {
+	prog, err := asm.Assemble([]byte(`
+		      SET A, 1
+		:bp   SET [0x1000], A
+		      ADD A, 1
+		:loop SET PC, loop`), core.Spec17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := &dcpu.Machine{Headless: true, StartPaused: true}
+	machine.State.Spec = core.Spec17
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(1e6); err != nil {
+		t.Fatal(err)
+	}
+	defer machine.Stop()
+
+	l, err := Listen("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	served := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		defer conn.Close()
+		served <- Serve(conn, machine)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	c.send("qSupported:swbreak+")
+	if reply := c.receive(); !strings.Contains(reply, "QStartNoAckMode+") {
+		t.Errorf("unexpected qSupported reply %q", reply)
+	}
+	// a corrupted packet is dropped, and the client is asked to resend it
+	fmt.Fprintf(conn, "$?#%02x", checksum([]byte("?"))+1)
+	if b, err := c.r.ReadByte(); err != nil || b != '-' {
+		t.Fatalf("expected nak, found %q (%v)", b, err)
+	}
+	c.exchange("?", "S05")
+	c.exchange("QStartNoAckMode", "OK")
+	c.noAck = true
+	c.exchange("?", "S05")
+
+	// registers
+	c.exchange("P0=1234", "OK")
+	c.exchange("p0", "1234")
+	c.exchange("g", "123400000000000000000000000000000000000000000000")
+
+	// malformed packets
+	c.exchange("vCont;", "E01")
+	c.exchange("vCont;:1", "E01")
+
+	// breakpoints and watchpoints
+	c.exchange(fmt.Sprintf("Z0,%x,1", prog.Labels["bp"]), "OK")
+	c.send("c")
+	if reply := c.receive(); reply != "T05swbreak:;" {
+		t.Fatalf("expected a breakpoint, found %q", reply)
+	}
+	c.exchange("p9", "0001")
+	c.exchange("Z2,1000,2", "OK")
+	c.exchange("c", "T05watch:1000;")
+	c.exchange("p9", "0003")
+	c.exchange("m1000,2", "0001")
+	c.exchange("z2,1000,2", "OK")
+	c.exchange(fmt.Sprintf("z0,%x,1", prog.Labels["bp"]), "OK")
+	c.exchange("s", "S05")
+	c.exchange("p0", "0002")
+
+	// interrupting a running program
+	c.send("c")
+	time.Sleep(10 * time.Millisecond)
+	conn.Write([]byte{0x03})
+	if reply := c.receive(); reply != "S02" {
+		t.Fatalf("expected SIGINT, found %q", reply)
+	}
+	c.exchange("p9", "0004")
+
+	// errors are reported as signals
+	c.exchange("M10,2:0018", "OK")
+	c.exchange("m10,4", "00180000")
+	c.send("m0,8000")
+	if reply := c.receive(); len(reply) != packetSize {
+		t.Errorf("expected a reply of %d digits, found %d", packetSize, len(reply))
+	}
+	c.exchange("c10", "S04")
+	c.exchange("?", "S04")
+
+	c.send("k")
+	select {
+	case err := <-served:
+		if err != ErrKilled {
+			t.Errorf("expected ErrKilled, found %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for the server to finish")
+	}
+}
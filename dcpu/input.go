@@ -0,0 +1,83 @@
+package dcpu
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io"
+)
+
+// InputEvent is something that happened to a key that the program could
+// see, and the cycle it happened at
+type InputEvent struct {
+	Cycle  uint      `json:"cycle"`            // the machine's cycle count when the program saw the event
+	Key    core.Word `json:"key"`              // the key, or for the 1.1 keyboard, the word put in the buffer
+	Action KeyAction `json:"action,omitempty"` // always KeyTyped for the 1.1 keyboard
+}
+
+// InputRecorder writes every key the program receives to a file as JSON, one
+// InputEvent per line. Keys are recorded when the program can first see them,
+// rather than when they're typed, so a recording can be replayed exactly with
+// Keyboard.Replay. Set Machine.InputRecorder before starting the machine to
+// use it.
+type InputRecorder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+	err error // the first error writing the recording
+}
+
+// NewInputRecorder returns an InputRecorder that writes to w
+func NewInputRecorder(w io.Writer) *InputRecorder {
+	bw := bufio.NewWriter(w)
+	return &InputRecorder{w: bw, enc: json.NewEncoder(bw)}
+}
+
+// Err returns the first error that occurred writing the recording
+func (r *InputRecorder) Err() error {
+	return r.err
+}
+
+func (r *InputRecorder) record(event InputEvent) {
+	if r.err == nil {
+		r.err = r.enc.Encode(event)
+	}
+}
+
+// stop flushes the recording
+func (r *InputRecorder) stop() {
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+}
+
+// ReadInputEvents reads the events written by an InputRecorder
+func ReadInputEvents(r io.Reader) ([]InputEvent, error) {
+	var events []InputEvent
+	dec := json.NewDecoder(r)
+	for {
+		var event InputEvent
+		if err := dec.Decode(&event); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+}
+
+// pollKeys delivers the next key event the program should see to the
+// keyboard and records it, raising an interrupt if the Generic Keyboard
+// wants one
+func (m *Machine) pollKeys(typed bool) error {
+	event, ok := m.Keyboard.poll(m.cycleCount, typed)
+	if !ok {
+		return nil
+	}
+	if m.InputRecorder != nil {
+		m.InputRecorder.record(event)
+	}
+	if m.Keyboard.generic && m.Keyboard.message != 0 {
+		return m.State.Interrupt(m.Keyboard.message)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package dcpu
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"testing"
+	"time"
+)
+
+func TestInputReplay(t *testing.T) {
+	prog, err := asm.Assemble([]byte(`
+		      SET I, 0
+		:loop IFE [0x9000+I], 0
+		      SET PC, loop
+		      SET [0x1000+I], [0x9000+I]
+		      SET [0x9000+I], 0
+		      ADD I, 1
+		      AND I, 0xf
+		      SET PC, loop`), core.Spec11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// run records the input of a run and returns the keys the program read
+	run := func(queued string, replay []InputEvent) (*bytes.Buffer, []core.Word) {
+		var recording bytes.Buffer
+		machine := &Machine{Headless: true, VirtualTime: true, CycleLimit: 500}
+		machine.InputRecorder = NewInputRecorder(&recording)
+		machine.Keyboard.QueueKeys([]rune(queued))
+		if replay != nil {
+			machine.Keyboard.Replay(replay)
+		}
+		if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := machine.Start(10e6); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-machine.ErrorC:
+			if err != ErrCycleLimit {
+				t.Errorf("Expected ErrCycleLimit, found %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the cycle limit")
+		}
+		machine.Stop()
+		if err := machine.InputRecorder.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return &recording, machine.State.Ram.GetSlice(0x1000, 0x1004)
+	}
+
+	recording, keys := run("abc", nil)
+	if fmt.Sprint(keys) != fmt.Sprint([]core.Word{'a', 'b', 'c', 0}) {
+		t.Errorf("Expected the program to read abc, found %v", keys)
+	}
+	events, err := ReadInputEvents(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].Key != 'a' || events[2].Key != 'c' || events[1].Cycle <= events[0].Cycle {
+		t.Fatalf("Unexpected events %v", events)
+	}
+
+	// replaying ignores the queued keys, and delivers the same keys at
+	// the same cycles
+	replayed, keys := run("xyz", events)
+	if fmt.Sprint(keys) != fmt.Sprint([]core.Word{'a', 'b', 'c', 0}) {
+		t.Errorf("Expected the replay to read abc, found %v", keys)
+	}
+	if replayed.String() != recording.String() {
+		t.Errorf("Expected the replay to be recorded as %q, found %q", recording, replayed)
+	}
+}
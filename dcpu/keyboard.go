@@ -3,48 +3,246 @@
 // After a key is read, the program needs to stuff 0 back into the spot.
 // It's not fully-documented, but my assumption is if the circular buffer
 // runs out of space, subsequent keys are dropped.
+//
+// The 1.7 spec replaced the circular buffer with the Generic Keyboard, which
+// sits on the hardware bus. Programs pop typed keys off its buffer with HWI,
+// can ask whether a key is being held, and can be interrupted whenever a key
+// is typed, pressed or released. The same limit of 16 typed keys applies.
 
 package dcpu
 
 import (
 	"errors"
 	"github.com/kballard/dcpu16/dcpu/core"
+	"sync"
 )
 
+const (
+	keyboardHardwareID      = 0x30cf7406
+	keyboardHardwareVersion = 1
+)
+
+// HWI messages understood by the Generic Keyboard, passed in register A
+const (
+	keyboardClearBuffer  = 0
+	keyboardGetKey       = 1
+	keyboardIsPressed    = 2
+	keyboardSetInterrupt = 3
+)
+
+// keyboardInputSize is the number of key events that can wait for the
+// machine to take them. A modifier and the key it modifies are pressed
+// together, so there must be room for at least two.
+const keyboardInputSize = 16
+
 type Keyboard struct {
 	words    [0x10]core.Word
-	input    chan rune
+	input    chan InputEvent
 	offset   int
+	mu       sync.Mutex    // guards input, detached and keysDown, which are used by whoever registers keys
+	detached chan struct{} // closed once the machine stops reading input
 	keysDown map[Key]bool
+	queued   []rune
+	replay   []InputEvent // keys still to be replayed, if replaying
+	// the Generic Keyboard, when running the 1.7 spec
+	generic bool
+	buffer  []core.Word        // typed keys, oldest first
+	held    map[core.Word]bool // keys that are pressed
+	message core.Word          // interrupt message, or 0 if interrupts are off
 }
 
+// Key is a key as numbered by the Generic Keyboard. Keys 0x20-0x7f are the
+// ASCII characters they type.
 type Key uint16
 
 const (
+	KeyBackspace  Key = 0x10
+	KeyReturn     Key = 0x11
+	KeyInsert     Key = 0x12
+	KeyDelete     Key = 0x13
 	KeyArrowLeft  Key = 130
 	KeyArrowRight     = 131
 	KeyArrowUp        = 128
 	KeyArrowDown      = 129
+	KeyShift      Key = 0x90
+	KeyControl    Key = 0x91
+)
+
+// legacyKeys maps keys to what the 1.1 keyboard puts in its buffer for them,
+// if that isn't the key itself
+var legacyKeys = map[Key]core.Word{
+	KeyBackspace: 0x08,
+	KeyReturn:    0x0a,
+	KeyDelete:    0x7f,
+}
+
+// typedKeys maps characters typed by QueueKeys and RegisterKeyTyped to the
+// Generic Keyboard's keys
+var typedKeys = map[rune]Key{
+	'\b':   KeyBackspace,
+	'\n':   KeyReturn,
+	'\r':   KeyReturn,
+	'\x7f': KeyDelete,
+}
+
+// KeyAction says what happened to a key
+type KeyAction int
+
+const (
+	KeyTyped    KeyAction = iota // a character was typed, with no press or release
+	KeyPressed                   // a key was pressed, which also types it
+	KeyReleased                  // a key was released
 )
 
 // PollKeys checks for any pending keys and stuffs them into the buffer
 func (k *Keyboard) PollKeys() {
-	if k.words[k.offset] == 0 {
-		// we have an open spot; check for a key
+	k.poll(0, true)
+}
+
+// poll delivers the next key event, if there's room for it, and returns it.
+// Keys typed at the terminal are only taken if typed is true, but queued keys
+// always are. While replaying, only replayed events are taken, once the cycle
+// they were recorded at is reached. The 1.1 keyboard only sees the words put
+// in its buffer, so those are returned as KeyTyped events.
+func (k *Keyboard) poll(cycle uint, typed bool) (event InputEvent, ok bool) {
+	if !k.generic && k.words[k.offset] != 0 {
+		return event, false
+	}
+	// we have an open spot; check for a key
+	if event, ok = k.next(cycle, typed); !ok {
+		return
+	}
+	event.Cycle = cycle
+	if k.generic {
+		k.apply(event)
+		return event, true
+	}
+	if event.Action != KeyTyped {
+		word, ok := legacyWord(event)
+		if !ok {
+			return event, false
+		}
+		event = InputEvent{Cycle: cycle, Key: word}
+	}
+	k.words[k.offset] = event.Key
+	k.offset = (k.offset + 1) % len(k.words)
+	return event, true
+}
+
+// next returns the next key event
+func (k *Keyboard) next(cycle uint, typed bool) (InputEvent, bool) {
+	if k.replay != nil {
+		if len(k.replay) == 0 || k.replay[0].Cycle > cycle {
+			return InputEvent{}, false
+		}
+		event := k.replay[0]
+		k.replay = k.replay[1:]
+		return event, true
+	}
+	if typed {
+		k.mu.Lock()
+		input := k.input
+		k.mu.Unlock()
 		select {
-		case key := <-k.input:
-			k.words[k.offset] = core.Word(key)
-			k.offset = (k.offset + 1) % len(k.words)
+		case event := <-input:
+			return event, true
 		default:
 		}
 	}
+	if len(k.queued) > 0 {
+		event := InputEvent{Key: core.Word(k.queued[0])}
+		k.queued = k.queued[1:]
+		return event, true
+	}
+	return InputEvent{}, false
+}
+
+// legacyWord returns the word the 1.1 keyboard puts in its buffer for a press
+// or release. Keys that type characters only appear when they're pressed, and
+// the modifiers and Insert don't appear at all.
+func legacyWord(event InputEvent) (core.Word, bool) {
+	key := Key(event.Key)
+	if key >= KeyArrowUp && key <= KeyArrowRight {
+		if event.Action == KeyReleased {
+			return event.Key | 0x100, true
+		}
+		return event.Key, true
+	}
+	if event.Action == KeyReleased || key == KeyInsert || key == KeyShift || key == KeyControl {
+		return 0, false
+	}
+	if word, ok := legacyKeys[key]; ok {
+		return word, true
+	}
+	return event.Key, true
+}
+
+// apply updates the Generic Keyboard with an event
+func (k *Keyboard) apply(event InputEvent) {
+	key := event.Key
+	switch event.Action {
+	case KeyTyped:
+		if typed, ok := typedKeys[rune(key)]; ok {
+			key = core.Word(typed)
+		}
+	case KeyPressed:
+		if k.held == nil {
+			k.held = make(map[core.Word]bool)
+		}
+		k.held[key] = true
+		if Key(key) == KeyShift || Key(key) == KeyControl {
+			// modifiers don't type anything
+			return
+		}
+	case KeyReleased:
+		delete(k.held, key)
+		return
+	}
+	if len(k.buffer) < len(k.words) {
+		k.buffer = append(k.buffer, key)
+	}
+}
+
+func (k *Keyboard) HardwareID() uint32 {
+	return keyboardHardwareID
+}
+
+func (k *Keyboard) HardwareVersion() core.Word {
+	return keyboardHardwareVersion
+}
+
+func (k *Keyboard) Manufacturer() uint32 {
+	return 0
+}
+
+func (k *Keyboard) HandleInterrupt(s *core.State) (uint, error) {
+	switch s.A() {
+	case keyboardClearBuffer:
+		k.buffer = nil
+	case keyboardGetKey:
+		if len(k.buffer) == 0 {
+			s.SetC(0)
+		} else {
+			s.SetC(k.buffer[0])
+			k.buffer = k.buffer[1:]
+		}
+	case keyboardIsPressed:
+		if k.held[s.B()] {
+			s.SetC(1)
+		} else {
+			s.SetC(0)
+		}
+	case keyboardSetInterrupt:
+		k.message = s.B()
+	}
+	return 0, nil
 }
 
 func (k *Keyboard) MapToMachine(offset core.Word, m *Machine) error {
-	if k.input != nil {
+	if !k.openInput() {
 		return errors.New("Keyboard is already mapped to a machine")
 	}
-	k.input = make(chan rune, 1)
+	k.generic = false
 	k.offset = 0
 	for i := 0; i < 10; i++ {
 		// zero out the words
@@ -61,42 +259,121 @@ func (k *Keyboard) MapToMachine(offset core.Word, m *Machine) error {
 }
 
 func (k *Keyboard) UnmapFromMachine(offset core.Word, m *Machine) error {
-	if k.input == nil {
-		return errors.New("Keyboard is not mapped to a machine")
-	}
 	if err := m.State.Ram.UnmapRegion(offset, core.Word(len(k.words))); err != nil {
 		return err
 	}
-	close(k.input)
-	k.input = nil
+	if !k.closeInput() {
+		return errors.New("Keyboard is not mapped to a machine")
+	}
 	return nil
 }
 
+// attach makes the keyboard the Generic Keyboard of a machine, which is
+// attached to the hardware bus instead of being mapped into memory
+func (k *Keyboard) attach() error {
+	if !k.openInput() {
+		return errors.New("Keyboard is already attached to a machine")
+	}
+	k.generic = true
+	k.buffer, k.held, k.message = nil, nil, 0
+	return nil
+}
+
+// detach undoes attach
+func (k *Keyboard) detach() {
+	k.closeInput()
+}
+
+// openInput starts taking registered keys, unless it already has. This is
+// done before the machine starts.
+func (k *Keyboard) openInput() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.input != nil {
+		return false
+	}
+	k.input = make(chan InputEvent, keyboardInputSize)
+	k.detached = make(chan struct{})
+	return true
+}
+
+// closeInput stops taking registered keys, unless it already has. Keys that
+// are still pressed are forgotten, so releasing them does nothing. This is
+// done once the machine has stopped.
+func (k *Keyboard) closeInput() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.input == nil {
+		return false
+	}
+	// wake any release waiting for the machine
+	close(k.detached)
+	k.input, k.detached, k.keysDown = nil, nil, nil
+	return true
+}
+
+// QueueKeys queues up keys to be typed, in order, as the program makes room
+// for them. Unlike RegisterKeyTyped, queued keys are never dropped.
+// This is intended for scripting input, and must not be called while
+// the machine is running.
+func (k *Keyboard) QueueKeys(keys []rune) {
+	k.queued = append(k.queued, keys...)
+}
+
+// Replay replaces all other input with the events, which were recorded by an
+// InputRecorder. Each event happens at the cycle it was recorded at, or, for
+// the 1.1 keyboard, as soon as there's room after that. Keys typed at the
+// terminal, and queued keys, are ignored while replaying, even after the last
+// event. This must not be called while the machine is running.
+func (k *Keyboard) Replay(events []InputEvent) {
+	k.replay = append([]InputEvent{}, events...)
+}
+
+// RegisterKeyTyped types a character, without pressing or releasing
+// any key. If the keyboard is busy, the character is dropped.
 func (k *Keyboard) RegisterKeyTyped(key rune) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 	select {
-	case k.input <- key:
+	case k.input <- InputEvent{Key: core.Word(key)}:
 	default:
 	}
 }
 
+// RegisterKeyPressed presses a key, which types it if it isn't a modifier.
+// Pressing a key that's already pressed types it again. If too many keys are
+// waiting for the machine, the press is dropped.
 func (k *Keyboard) RegisterKeyPressed(key Key) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 	if k.keysDown == nil {
 		k.keysDown = make(map[Key]bool)
 	}
 	select {
-	case k.input <- rune(key):
+	case k.input <- InputEvent{Key: core.Word(key), Action: KeyPressed}:
 		k.keysDown[key] = true
 	default:
-		k.keysDown[key] = false
 	}
 }
 
+// RegisterKeyReleased releases a key that was pressed. This waits for the
+// keyboard to take the release, so a key is never left pressed, unless the
+// machine stops first. Once it has stopped, this does nothing.
 func (k *Keyboard) RegisterKeyReleased(key Key) {
-	if !k.keysDown[key] {
+	k.mu.Lock()
+	down := k.keysDown[key]
+	if down {
+		k.keysDown[key] = false
+	}
+	input, detached := k.input, k.detached
+	k.mu.Unlock()
+	if !down {
 		// we didn't successfully send the key down, so skip the key up
 		return
 	}
 	// block on this one; we don't want to ever send key down and not key up
-	k.input <- rune(key) | 0x100
-	k.keysDown[key] = false
+	select {
+	case input <- InputEvent{Key: core.Word(key), Action: KeyReleased}:
+	case <-detached:
+	}
 }
@@ -0,0 +1,120 @@
+package dcpu
+
+import (
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"testing"
+	"time"
+)
+
+// runKeyboard runs a program until the cycle limit, with the events replayed
+func runKeyboard(t *testing.T, src string, spec core.SpecVersion, events []InputEvent) *Machine {
+	prog, err := asm.Assemble([]byte(src), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := &Machine{Headless: true, VirtualTime: true, CycleLimit: 400}
+	machine.State.Spec = spec
+	machine.Keyboard.Replay(events)
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(10e6); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-machine.ErrorC:
+		if err != ErrCycleLimit {
+			t.Errorf("Expected ErrCycleLimit, found %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the cycle limit")
+	}
+	machine.Stop()
+	return machine
+}
+
+func TestGenericKeyboard(t *testing.T) {
+	// each interrupt records the next typed key, and whether A is held
+	machine := runKeyboard(t, `
+		      IAS handler
+		      SET A, 3
+		      SET B, 1
+		      HWI 2
+		:loop SET PC, loop
+		:handler
+		      SET A, 1
+		      HWI 2
+		      SET [0x1000+I], C
+		      SET A, 2
+		      SET B, 0x61
+		      HWI 2
+		      SET [0x1010+I], C
+		      ADD I, 1
+		      RFI 0`, core.Spec17, []InputEvent{
+		{50, 'a', KeyPressed},
+		{100, core.Word(KeyShift), KeyPressed},
+		{150, 'a', KeyReleased},
+		{200, '\n', KeyTyped},
+	})
+	typed := machine.State.Ram.GetSlice(0x1000, 0x1004)
+	held := machine.State.Ram.GetSlice(0x1010, 0x1014)
+	if fmt.Sprint(typed) != fmt.Sprint([]core.Word{'a', 0, 0, core.Word(KeyReturn)}) {
+		t.Errorf("Unexpected typed keys %v", typed)
+	}
+	if fmt.Sprint(held) != fmt.Sprint([]core.Word{1, 1, 0, 0}) {
+		t.Errorf("Unexpected held states %v", held)
+	}
+	if !machine.Keyboard.held[core.Word(KeyShift)] {
+		t.Error("Expected shift to be held")
+	}
+}
+
+func TestLegacyKeyboard(t *testing.T) {
+	// presses and releases are translated into the 1.1 keyboard's words
+	machine := runKeyboard(t, `
+		:loop IFE [0x9000+I], 0
+		      SET PC, loop
+		      SET [0x1000+I], [0x9000+I]
+		      SET [0x9000+I], 0
+		      ADD I, 1
+		      AND I, 0xf
+		      SET PC, loop`, core.Spec11, []InputEvent{
+		{50, core.Word(KeyArrowUp), KeyPressed},
+		{60, core.Word(KeyArrowUp), KeyReleased},
+		{70, core.Word(KeyShift), KeyPressed},
+		{80, 'x', KeyPressed},
+		{90, 'x', KeyReleased},
+		{100, core.Word(KeyReturn), KeyPressed},
+	})
+	words := machine.State.Ram.GetSlice(0x1000, 0x1005)
+	if fmt.Sprint(words) != fmt.Sprint([]core.Word{0x80, 0x180, 'x', 0x0a, 0}) {
+		t.Errorf("Unexpected keys %v", words)
+	}
+}
+
+func TestKeyReleasedAfterStop(t *testing.T) {
+	machine := &Machine{Headless: true, StartPaused: true}
+	machine.State.Spec = core.Spec17
+	if err := machine.Start(DefaultClockRate); err != nil {
+		t.Fatal(err)
+	}
+	// the paused machine takes none of these, so the release has to wait
+	for i := 0; i < keyboardInputSize; i++ {
+		machine.Keyboard.RegisterKeyPressed(Key('a' + i))
+	}
+	released := make(chan struct{})
+	go func() {
+		machine.Keyboard.RegisterKeyReleased('a')
+		close(released)
+	}()
+	machine.Stop()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the release to give up")
+	}
+	// once the machine has stopped, releasing a key does nothing
+	machine.Keyboard.RegisterKeyReleased('b')
+}
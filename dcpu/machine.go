@@ -12,16 +12,58 @@ import (
 )
 
 type Machine struct {
-	State      core.State
-	Video      Video
-	Keyboard   Keyboard
-	ErrorC     <-chan error // indicates when an error occurs
+	Headless    bool // don't use the terminal; the display is only rendered to a framebuffer
+	StopOnHalt  bool // stop with ErrHalted once the program halts (see core.State.Halted)
+	CycleLimit  uint // stop with ErrCycleLimit after this many cycles, if non-zero
+	StartPaused bool // start the machine paused, as if Pause was called
+	VirtualTime bool // time everything by the cycle count, see Start
+	State       core.State
+	Video       Video
+	Keyboard    Keyboard          // the Generic Keyboard when running the 1.7 spec
+	Clock       Clock             // only attached when running the 1.7 spec
+	SPED3       *SPED3            // attached after the keyboard, if set, when running the 1.7 spec
+	ErrorC      <-chan error      // indicates when an error occurs
+	PauseC      <-chan PauseEvent // indicates when the machine pauses
+	Tracer      *Tracer           // records every executed instruction, if set
+	WatchOutput io.Writer         // where WatchLog watchpoints write, or os.Stderr if nil
+	// InputRecorder records every key the program receives, if set
+	InputRecorder *InputRecorder
+	// OnRefresh is called on the machine's goroutine after each screen
+	// refresh, before the terminal is flushed. It must not call Do.
+	OnRefresh  func()
 	stopper    chan<- struct{}
 	stopped    <-chan error
+	control    chan func()     // functions to run between cycles, see Do
+	done       chan struct{}   // closed when the machine's goroutine exits
+	pauseC     chan PauseEvent // the sending side of PauseC
+	stoperr    error           // the error that stopped the machine
+	flushErr   error           // the first error flushing a device, see FlushErr
 	cycleCount uint
 	startTime  time.Time
+	rate       ClockRate
+	devices    []core.Device // devices attached with AttachDevice
+	tickers    []Ticker
+	debugState
 }
 
+// Ticker is implemented by devices that need to do work every cycle,
+// such as raising interrupts on a schedule.
+type Ticker interface {
+	Tick(m *Machine) error
+}
+
+// Flusher is implemented by devices that keep writes in memory, such as disk
+// drives. Flush is called on every attached device once the machine stops,
+// whether by Stop or HasError.
+type Flusher interface {
+	Flush() error
+}
+
+var (
+	ErrHalted     = errors.New("program halted")
+	ErrCycleLimit = errors.New("cycle limit reached")
+)
+
 type MachineError struct {
 	UnderlyingError error
 	PC              core.Word
@@ -31,14 +73,54 @@ func (err *MachineError) Error() string {
 	return fmt.Sprintf("machine error occurred; PC: %#x (%v)", err.PC, err.UnderlyingError)
 }
 
+// AttachDevice connects a device to the machine's hardware bus.
+// Devices are numbered in the order they're attached, after the machine's
+// built-in hardware, which is the order the HWN, HWQ and HWI instructions
+// see them in. If the device implements Ticker, it's ticked once per cycle
+// while the machine runs.
+func (m *Machine) AttachDevice(dev core.Device) error {
+	if m.stopped != nil {
+		return errors.New("Devices cannot be attached to a running machine")
+	}
+	m.devices = append(m.devices, dev)
+	return nil
+}
+
+// attachDevices populates the hardware bus of the State with the
+// built-in hardware followed by any attached devices.
+func (m *Machine) attachDevices() {
+	m.State.Devices = nil
+	if m.State.Spec == core.Spec17 {
+		m.State.Devices = append(m.State.Devices, &m.Video, &m.Clock, &m.Keyboard)
+		if m.SPED3 != nil {
+			m.State.Devices = append(m.State.Devices, m.SPED3)
+		}
+	}
+	m.State.Devices = append(m.State.Devices, m.devices...)
+	m.tickers = nil
+	for _, dev := range m.State.Devices {
+		if ticker, ok := dev.(Ticker); ok {
+			m.tickers = append(m.tickers, ticker)
+		}
+	}
+}
+
 const DefaultClockRate ClockRate = 100000 // 100KHz
 
 // Start boots up the machine, with a clock rate of 1 / period
 // 10MHz would be expressed as (Microsecond / 10)
+//
+// Normally the screen is refreshed, and keys typed at the terminal are
+// delivered, whenever the host gets around to it. With VirtualTime, the screen
+// is refreshed every rate/refresh rate cycles, and typed keys are only
+// delivered at refreshes, so a run with the same scripted input does exactly
+// the same thing at the same cycles every time. A headless machine with
+// VirtualTime runs as fast as it can, rather than at the clock rate.
 func (m *Machine) Start(rate ClockRate) (err error) {
 	if m.stopped != nil {
 		return errors.New("Machine has already started")
 	}
+	m.Video.headless = m.Headless
 	if err = m.Video.Init(); err != nil {
 		return
 	}
@@ -47,10 +129,24 @@ func (m *Machine) Start(rate ClockRate) (err error) {
 			m.Video.Close()
 		}
 	}()
-	if err = m.Video.MapToMachine(0x8000, m); err != nil {
-		return
+	if m.State.Spec == core.Spec17 {
+		// the LEM1802 reads the screen out of main RAM
+		m.Video.ram = &m.State.Ram
+	} else {
+		m.Video.ram = nil
+		if err = m.Video.MapToMachine(0x8000, m); err != nil {
+			return
+		}
+	}
+	if m.SPED3 != nil {
+		m.SPED3.ram = &m.State.Ram
 	}
-	if err = m.Keyboard.MapToMachine(0x9000, m); err != nil {
+	if m.State.Spec == core.Spec17 {
+		// the Generic Keyboard is on the hardware bus instead
+		if err = m.Keyboard.attach(); err != nil {
+			return
+		}
+	} else if err = m.Keyboard.MapToMachine(0x9000, m); err != nil {
 		return
 	}
 	stopper := make(chan struct{}, 1)
@@ -61,6 +157,21 @@ func (m *Machine) Start(rate ClockRate) (err error) {
 	m.ErrorC = errchan
 	m.cycleCount = 0
 	m.startTime = time.Now()
+	m.rate = rate
+	m.attachDevices()
+	if m.Tracer != nil {
+		m.Tracer.watch(&m.State.Ram)
+	}
+	m.control = make(chan func())
+	m.done = make(chan struct{})
+	m.pauseC = make(chan PauseEvent, 1)
+	m.PauseC = m.pauseC
+	m.stoperr = nil
+	m.active = true
+	m.paused = false
+	if m.StartPaused {
+		m.pause(PauseRequested)
+	}
 	go func() {
 		// we want an acurate cycle counter
 		// Unfortunately, time.NewTicker drops cycles on the floor if it can't keep up
@@ -72,23 +183,51 @@ func (m *Machine) Start(rate ClockRate) (err error) {
 			refreshRate = DefaultScreenRefreshRate
 		}
 		scanrate := time.NewTicker(refreshRate.ToDuration())
-		var stoperr error
+		// cycles between refreshes, with VirtualTime
+		refreshCycles := uint(1)
+		if refreshRate < rate {
+			refreshCycles = uint(rate / refreshRate)
+		}
+		refresh := func() {
+			m.Video.Draw()
+			m.drawSPED3()
+			m.Video.UpdateStats(&m.State, m.cycleCount)
+			if m.OnRefresh != nil {
+				m.OnRefresh()
+			}
+			m.Video.Flush()
+		}
 		nextTime := time.Now()
 		period := rate.ToDuration()
-		cycleChan <- nextTime
+		if !m.paused {
+			cycleChan <- nextTime
+		}
 		var timerChan <-chan time.Time
 		// runCycle needs to be split into a function, because we want to call it if
 		// any of two channels has a value
 		runCycle := func() bool {
-			if err := m.State.StepCycle(); err != nil {
-				stoperr = &MachineError{err, m.State.PC()}
+			if m.checkPause() {
+				// no more cycles are scheduled until the machine resumes
+				timerChan = nil
+				return true
+			}
+			if m.cycle() != nil {
 				return false
 			}
-			m.cycleCount++
-			m.Keyboard.PollKeys()
+			if m.VirtualTime && m.cycleCount%refreshCycles == 0 {
+				refresh()
+				if err := m.pollKeys(true); err != nil {
+					m.stoperr = &MachineError{err, m.State.PC()}
+					return false
+				}
+			}
 			nextTime = nextTime.Add(period)
 			now := time.Now()
-			if now.Before(nextTime) {
+			if m.VirtualTime && m.Headless {
+				// nobody's watching, so don't wait
+				cycleChan <- now
+				runtime.Gosched()
+			} else if now.Before(nextTime) {
 				// delay the cycle
 				timerChan = time.After(nextTime.Sub(now))
 			} else {
@@ -104,8 +243,11 @@ func (m *Machine) Start(rate ClockRate) (err error) {
 		for {
 			select {
 			case <-scanrate.C:
-				m.Video.UpdateStats(&m.State, m.cycleCount)
-				m.Video.Flush()
+				// with VirtualTime, the running program refreshes the screen
+				// itself, but the debugger still needs drawing while paused
+				if !m.VirtualTime || m.paused {
+					refresh()
+				}
 			case <-timerChan:
 				if !runCycle() {
 					break loop
@@ -114,35 +256,154 @@ func (m *Machine) Start(rate ClockRate) (err error) {
 				if !runCycle() {
 					break loop
 				}
+			case f := <-m.control:
+				wasPaused := m.paused
+				f()
+				if m.stoperr != nil {
+					break loop
+				}
+				if wasPaused && !m.paused {
+					// pick the cycle timing back up from now
+					nextTime = time.Now()
+					cycleChan <- nextTime
+				}
 			case _ = <-stopper:
 				break loop
 			}
 		}
 		scanrate.Stop()
-		stopped <- stoperr
-		errchan <- stoperr
+		if m.Headless {
+			// make sure the framebuffer reflects the final state
+			m.Video.Draw()
+		}
+		if m.Tracer != nil {
+			m.Tracer.unwatch(&m.State.Ram)
+			m.Tracer.stop(m.stoperr)
+		}
+		if m.InputRecorder != nil {
+			m.InputRecorder.stop()
+		}
+		m.active = false
+		close(m.done)
+		stopped <- m.stoperr
+		errchan <- m.stoperr
 		close(stopped)
 		close(errchan)
 	}()
 	return nil
 }
 
+// cycle runs a single cycle of the machine, including its devices.
+// Any error is recorded as the reason the machine stopped.
+func (m *Machine) cycle() error {
+	m.resumed = false
+	if m.Tracer != nil && m.State.AtInstructionBoundary() {
+		m.Tracer.start(&m.State)
+	}
+	if err := m.State.StepCycle(); err != nil {
+		if m.Tracer != nil {
+			m.Tracer.finish(m, err)
+		}
+		m.stoperr = &MachineError{err, m.State.PC()}
+		return m.stoperr
+	}
+	m.cycleCount++
+	if m.Tracer != nil && m.State.AtInstructionBoundary() {
+		m.Tracer.finish(m, nil)
+	}
+	if err := m.pollKeys(!m.VirtualTime); err != nil {
+		m.stoperr = &MachineError{err, m.State.PC()}
+		return m.stoperr
+	}
+	for _, ticker := range m.tickers {
+		if err := ticker.Tick(m); err != nil {
+			m.stoperr = &MachineError{err, m.State.PC()}
+			return m.stoperr
+		}
+	}
+	if m.StopOnHalt && m.State.Halted() {
+		m.stoperr = ErrHalted
+		return m.stoperr
+	}
+	if m.CycleLimit != 0 && m.cycleCount >= m.CycleLimit {
+		m.stoperr = ErrCycleLimit
+		return m.stoperr
+	}
+	return nil
+}
+
+// drawSPED3 draws the SPED-3, if there is one, in a square pane to the
+// right of the display
+func (m *Machine) drawSPED3() {
+	if m.Headless || m.SPED3 == nil || m.State.Spec != core.Spec17 {
+		return
+	}
+	width, height := m.Video.displaySize()
+	m.SPED3.drawPane(width+1, 0, height*2, height)
+}
+
+// TerminalSize returns the number of terminal columns and rows used by the
+// displays, including the SPED-3 if there is one, and the stats drawn below
+// them. Anything else drawn in the terminal should go outside of them.
+func (m *Machine) TerminalSize() (width, height int) {
+	width, height = m.Video.TerminalSize()
+	if m.SPED3 != nil && m.State.Spec == core.Spec17 {
+		_, paneHeight := m.Video.displaySize()
+		width += 1 + paneHeight*2
+	}
+	return
+}
+
 // Stop stops the machine. Returns an error if it's already stopped.
 // If the machine has halted due to an error, that error is returned.
+// This includes ErrHalted and ErrCycleLimit. Errors flushing the attached
+// devices are reported by FlushErr instead.
 func (m *Machine) Stop() error {
 	if m.stopped == nil {
 		return errors.New("Machine has not started")
 	}
-	m.Video.UnmapFromMachine(0x8000, m)
-	m.Keyboard.UnmapFromMachine(0x9000, m)
 	m.stopper <- struct{}{}
 	m.Video.Close()
 	err := <-m.stopped
+	m.shutDown()
+	return err
+}
+
+// shutDown disconnects the hardware from the machine and flushes the
+// attached devices, once the machine's goroutine has stopped
+func (m *Machine) shutDown() {
+	if m.State.Spec != core.Spec17 {
+		m.Video.UnmapFromMachine(0x8000, m)
+	}
+	if m.State.Spec == core.Spec17 {
+		m.Keyboard.detach()
+	} else {
+		m.Keyboard.UnmapFromMachine(0x9000, m)
+	}
+	m.flushDevices()
 	close(m.stopper)
 	m.stopper = nil
 	m.stopped = nil
 	m.ErrorC = nil
-	return err
+	m.PauseC = nil
+}
+
+// flushDevices flushes every attached device, once the machine has stopped
+func (m *Machine) flushDevices() {
+	m.flushErr = nil
+	for _, dev := range m.devices {
+		if dev, ok := dev.(Flusher); ok {
+			if err := dev.Flush(); err != nil && m.flushErr == nil {
+				m.flushErr = err
+			}
+		}
+	}
+}
+
+// FlushErr returns the first error flushing a device when the machine last
+// stopped, or nil if there wasn't one
+func (m *Machine) FlushErr() error {
+	return m.flushErr
 }
 
 // ClockRate represents the clock rate of the machine
@@ -214,10 +475,7 @@ func (m *Machine) HasError() error {
 	select {
 	case err := <-m.stopped:
 		m.Video.Close()
-		close(m.stopper)
-		m.stopper = nil
-		m.stopped = nil
-		m.ErrorC = nil
+		m.shutDown()
 		return err
 	default:
 	}
@@ -0,0 +1,152 @@
+package dcpu
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadSample reads a big-endian program from _samples
+func loadSample(t *testing.T, name string) []core.Word {
+	data, err := ioutil.ReadFile("../_samples/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	words := make([]core.Word, len(data)/2)
+	for i := range words {
+		words[i] = core.Word(data[i*2])<<8 | core.Word(data[i*2+1])
+	}
+	return words
+}
+
+func TestHeadlessMachine(t *testing.T) {
+	machine := &Machine{Headless: true, StopOnHalt: true}
+	if err := machine.State.LoadProgram(loadSample(t, "hello.obj"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(10e6); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-machine.ErrorC:
+		if err != ErrHalted {
+			t.Errorf("Expected ErrHalted, found %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the program to halt")
+	}
+	machine.Stop()
+	if text := machine.Video.Text(); !strings.HasPrefix(text, "Hello world!\n") {
+		t.Errorf("Unexpected display contents %q", text)
+	}
+	if machine.Video.Framebuffer() == nil {
+		t.Error("Expected a framebuffer")
+	}
+}
+
+func TestCycleLimit(t *testing.T) {
+	machine := &Machine{Headless: true, CycleLimit: 100}
+	if err := machine.State.LoadProgram(loadSample(t, "hello.obj"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(10e6); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-machine.ErrorC:
+		if err != ErrCycleLimit {
+			t.Errorf("Expected ErrCycleLimit, found %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the cycle limit")
+	}
+	machine.Stop()
+	if machine.cycleCount != 100 {
+		t.Errorf("Expected 100 cycles, found %d", machine.cycleCount)
+	}
+}
+
+// failingFlusher is a device that can't flush
+type failingFlusher struct {
+	flushed int
+}
+
+var errFlush = errors.New("flush failed")
+
+func (d *failingFlusher) HardwareID() uint32                              { return 0 }
+func (d *failingFlusher) HardwareVersion() core.Word                      { return 0 }
+func (d *failingFlusher) Manufacturer() uint32                            { return 0 }
+func (d *failingFlusher) HandleInterrupt(state *core.State) (uint, error) { return 0, nil }
+
+func (d *failingFlusher) Flush() error {
+	d.flushed++
+	return errFlush
+}
+
+func TestFlushErr(t *testing.T) {
+	dev := new(failingFlusher)
+	machine := &Machine{Headless: true, StopOnHalt: true}
+	machine.State.Spec = core.Spec17
+	machine.AttachDevice(dev)
+	machine.State.LoadProgram([]core.Word{0x7f81, 0}, 0) // SET PC, 0
+	for _, stop := range []func() error{machine.Stop, machine.HasError} {
+		if err := machine.Start(10e6); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-machine.ErrorC:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the program to halt")
+		}
+		// the flush error doesn't replace the reason the machine stopped
+		if err := stop(); err != ErrHalted {
+			t.Errorf("Expected ErrHalted, found %v", err)
+		}
+		if err := machine.FlushErr(); err != errFlush {
+			t.Errorf("Expected the flush error, found %v", err)
+		}
+	}
+	if dev.flushed != 2 {
+		t.Errorf("Expected 2 flushes, found %d", dev.flushed)
+	}
+}
+
+func TestVirtualTime(t *testing.T) {
+	// refreshes only depend on the cycle count, so two runs see exactly
+	// the same thing
+	run := func() []uint {
+		machine := &Machine{Headless: true, VirtualTime: true, CycleLimit: 5000}
+		var refreshes []uint
+		machine.OnRefresh = func() {
+			refreshes = append(refreshes, machine.cycleCount)
+		}
+		if err := machine.State.LoadProgram(loadSample(t, "hello.obj"), 0); err != nil {
+			t.Fatal(err)
+		}
+		// 1000Hz would take 5 seconds in real time
+		if err := machine.Start(1000); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-machine.ErrorC:
+			if err != ErrCycleLimit {
+				t.Errorf("Expected ErrCycleLimit, found %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for the cycle limit")
+		}
+		machine.Stop()
+		return refreshes
+	}
+	first, second := run(), run()
+	if len(first) != 312 || first[0] != 16 || first[311] != 4992 {
+		t.Errorf("Expected a refresh every 16 cycles, found %v", first)
+	}
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Errorf("Expected the same refreshes in both runs, found %v and %v", first, second)
+	}
+}
@@ -0,0 +1,174 @@
+// Serial port implementation
+// The serial port moves bytes between the program and the host, one at a
+// time. Bytes the host sends are kept in a small buffer until the program
+// reads them, and the program can be interrupted as each one arrives. Bytes
+// the program writes are passed on to the host as soon as it writes a
+// newline, or reads or polls for input, so prompts show up before the program
+// waits for an answer.
+
+package dcpu
+
+import (
+	"bufio"
+	"errors"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io"
+)
+
+const (
+	serialHardwareID      = 0x5e71a1c0
+	serialHardwareVersion = 1
+)
+
+// HWI messages understood by the serial port, passed in register A
+const (
+	serialPoll         = 0 // B = bytes waiting, C = 1 if the input ended and they've all been read
+	serialRead         = 1 // C = the next byte and B = 1, or B = C = 0 if none is waiting
+	serialWrite        = 2 // sends the low byte of B
+	serialSetInterrupt = 3 // interrupt with message B for each byte received, or never if 0
+)
+
+// SerialBufferSize is the number of received bytes the serial port holds
+// before it stops taking more from the host
+const SerialBufferSize = 64
+
+// Serial is a serial port connected to a reader and writer on the host, such
+// as stdin and stdout, a named pipe or a PTY. Attach it to a Machine running
+// the 1.7 spec with AttachDevice.
+type Serial struct {
+	input   chan byte // bytes from the host, or nil once it stops sending
+	w       *bufio.Writer
+	err     error       // the first error writing to the host
+	buffer  []core.Word // received bytes, oldest first
+	message core.Word   // interrupt message, or 0 if interrupts are off
+}
+
+// NewSerial returns a serial port that receives bytes read from r, and sends
+// bytes to w. Either may be nil. Reading from r starts right away, and
+// continues until it returns an error, such as io.EOF.
+func NewSerial(r io.Reader, w io.Writer) *Serial {
+	s := new(Serial)
+	if r != nil {
+		s.input = make(chan byte, SerialBufferSize)
+		go s.receive(r)
+	}
+	if w != nil {
+		s.w = bufio.NewWriter(w)
+	}
+	return s
+}
+
+// receive passes the bytes read from r to the machine, then closes the input
+func (s *Serial) receive(r io.Reader) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			close(s.input)
+			return
+		}
+		s.input <- b
+	}
+}
+
+// Err returns the first error that occurred sending bytes to the host
+func (s *Serial) Err() error {
+	return s.err
+}
+
+// Flush passes any bytes the program wrote on to the host
+func (s *Serial) Flush() error {
+	if s.w != nil && s.err == nil {
+		s.err = s.w.Flush()
+	}
+	return s.err
+}
+
+func (s *Serial) HardwareID() uint32 {
+	return serialHardwareID
+}
+
+func (s *Serial) HardwareVersion() core.Word {
+	return serialHardwareVersion
+}
+
+func (s *Serial) Manufacturer() uint32 {
+	return 0
+}
+
+func (s *Serial) HandleInterrupt(state *core.State) (uint, error) {
+	switch state.A() {
+	case serialPoll:
+		s.Flush()
+		state.SetB(core.Word(len(s.buffer)))
+		if s.input == nil && len(s.buffer) == 0 {
+			state.SetC(1)
+		} else {
+			state.SetC(0)
+		}
+	case serialRead:
+		s.Flush()
+		if len(s.buffer) == 0 {
+			state.SetB(0)
+			state.SetC(0)
+		} else {
+			state.SetB(1)
+			state.SetC(s.buffer[0])
+			s.buffer = s.buffer[1:]
+		}
+	case serialWrite:
+		if s.w != nil && s.err == nil {
+			b := byte(state.B())
+			s.err = s.w.WriteByte(b)
+			if b == '\n' {
+				s.Flush()
+			}
+		}
+	case serialSetInterrupt:
+		s.message = state.B()
+	}
+	return 0, nil
+}
+
+// Tick takes the next byte from the host, if there's room for it, raising an
+// interrupt if interrupts are enabled
+func (s *Serial) Tick(m *Machine) error {
+	if s.input == nil || len(s.buffer) >= SerialBufferSize {
+		return nil
+	}
+	select {
+	case b, ok := <-s.input:
+		if !ok {
+			s.input = nil
+			return nil
+		}
+		s.buffer = append(s.buffer, core.Word(b))
+		if s.message != 0 {
+			return m.State.Interrupt(s.message)
+		}
+	default:
+	}
+	return nil
+}
+
+// SaveState returns the interrupt message and the received bytes. Bytes that
+// were written but not yet sent aren't part of it, and will still be sent.
+func (s *Serial) SaveState() ([]byte, error) {
+	data := []byte{byte(s.message >> 8), byte(s.message)}
+	for _, b := range s.buffer {
+		data = append(data, byte(b))
+	}
+	return data, nil
+}
+
+func (s *Serial) RestoreState(data []byte) error {
+	if len(data) < 2 || len(data) > 2+SerialBufferSize {
+		return errors.New("invalid serial port state")
+	}
+	s.message = core.Word(data[0])<<8 | core.Word(data[1])
+	s.buffer = nil
+	for _, b := range data[2:] {
+		s.buffer = append(s.buffer, core.Word(b))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package dcpu
+
+import (
+	"bytes"
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSerial(t *testing.T) {
+	// echo the input in upper case until it ends, then say goodbye and halt
+	prog, err := asm.Assemble([]byte(`
+		:next SET A, 1
+		      HWI 3
+		      IFE B, 0
+		      SET PC, empty
+		      IFG C, 0x60
+		      IFL C, 0x7b
+		      SUB C, 0x20
+		      SET A, 2
+		      SET B, C
+		      HWI 3
+		      SET PC, next
+		:empty
+		      SET A, 0
+		      HWI 3
+		      IFE C, 0
+		      SET PC, next
+		      SET I, bye
+		:print
+		      IFE [I], 0
+		      SET PC, halt
+		      SET A, 2
+		      SET B, [I]
+		      HWI 3
+		      ADD I, 1
+		      SET PC, print
+		:halt SET PC, halt
+		:bye  DAT "bye", 0`), core.Spec17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	serial := NewSerial(strings.NewReader("hi there\n"), &output)
+	machine := &Machine{Headless: true, StopOnHalt: true}
+	machine.State.Spec = core.Spec17
+	if err := machine.AttachDevice(serial); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(10e6); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-machine.ErrorC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the program to halt")
+	}
+	if err := machine.Stop(); err != ErrHalted {
+		t.Errorf("Expected ErrHalted, found %v", err)
+	}
+	if found := output.String(); found != "HI THERE\nbye" {
+		t.Errorf("Unexpected output %q", found)
+	}
+}
@@ -0,0 +1,282 @@
+package dcpu
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io"
+	"time"
+)
+
+// SnapshotVersion is the version of the file format written by WriteSnapshot.
+// ReadSnapshot refuses files with any other version.
+const SnapshotVersion = 1
+
+// snapshotMagic starts the first line of a snapshot file, which is followed
+// by the version. The rest of the file is the gzipped Snapshot, encoded by gob.
+const snapshotMagic = "DCPU-16 snapshot"
+
+var ErrNotSnapshot = errors.New("not a snapshot file")
+
+// Snapshot holds everything needed to resume a Machine where it left off.
+// Debugging state, such as breakpoints, isn't included.
+type Snapshot struct {
+	State      *core.Snapshot
+	CycleCount uint
+	Video      VideoState
+	Keyboard   KeyboardState
+	Clock      ClockState
+	SPED3      *SPED3State // only if the machine has a SPED-3
+	Devices    [][]byte    // the state of each attached device, if it's a SnapshotDevice
+}
+
+// VideoState is the part of a Snapshot that holds the state of the display
+type VideoState struct {
+	Words                         []core.Word // the legacy video memory
+	Screen, Font, Palette, Border core.Word   // the LEM1802 mappings
+}
+
+// KeyboardState is the part of a Snapshot that holds the state of the keyboard.
+// Keys that were typed but not yet put in the buffer are lost.
+type KeyboardState struct {
+	Words   []core.Word
+	Offset  int
+	Queued  []rune
+	Buffer  []core.Word        // the Generic Keyboard's typed keys
+	Held    map[core.Word]bool // the Generic Keyboard's pressed keys
+	Message core.Word
+}
+
+// ClockState is the part of a Snapshot that holds the state of the clock
+type ClockState struct {
+	Divisor core.Word
+	Start   uint
+	Ticks   uint
+	Message core.Word
+}
+
+// SPED3State is the part of a Snapshot that holds the state of the SPED-3
+type SPED3State struct {
+	Address, Count, Target core.Word
+	Angle, TurnFrom        float64
+	Turning                bool
+	Start                  uint
+}
+
+// SnapshotDevice is implemented by attached devices whose state should be
+// saved in snapshots.
+type SnapshotDevice interface {
+	core.Device
+	SaveState() ([]byte, error)
+	RestoreState(data []byte) error
+}
+
+// Snapshot returns the current state of the machine. It's safe to call
+// while the machine is running, in which case the snapshot is taken between
+// cycles, which may be in the middle of an instruction.
+func (m *Machine) Snapshot() (snap *Snapshot, err error) {
+	m.Do(func() {
+		snap = &Snapshot{
+			State:      m.State.Snapshot(),
+			CycleCount: m.cycleCount,
+			Video:      m.Video.snapshot(),
+			Keyboard:   m.Keyboard.snapshot(),
+			Clock:      m.Clock.snapshot(),
+		}
+		if m.SPED3 != nil {
+			state := m.SPED3.snapshot()
+			snap.SPED3 = &state
+		}
+		for _, dev := range m.devices {
+			var data []byte
+			if dev, ok := dev.(SnapshotDevice); ok {
+				if data, err = dev.SaveState(); err != nil {
+					return
+				}
+			}
+			snap.Devices = append(snap.Devices, data)
+		}
+	})
+	return
+}
+
+// Restore replaces the state of the machine with the snapshot. A running
+// machine can only restore snapshots taken with the same spec and devices.
+// If the snapshot is rejected, the machine is left as it was.
+func (m *Machine) Restore(snap *Snapshot) (err error) {
+	m.Do(func() {
+		if m.active && snap.State.Spec != m.State.Spec {
+			err = fmt.Errorf("the snapshot is for the %v spec, not %v", snap.State.Spec, m.State.Spec)
+			return
+		}
+		if len(snap.Devices) != len(m.devices) {
+			err = fmt.Errorf("the snapshot has %d attached devices, not %d", len(snap.Devices), len(m.devices))
+			return
+		}
+		if (snap.SPED3 != nil) != (m.SPED3 != nil) {
+			err = errors.New("the snapshot and the machine don't both have a SPED-3")
+			return
+		}
+		if err = snap.State.Validate(); err != nil {
+			return
+		}
+		if err = m.Keyboard.validate(&snap.Keyboard); err != nil {
+			return
+		}
+		if err = m.restoreDevices(snap.Devices); err != nil {
+			return
+		}
+		// nothing can fail from here on
+		if err = m.State.Restore(snap.State); err != nil {
+			return
+		}
+		m.cycleCount = snap.CycleCount
+		if m.rate > 0 {
+			// keep EffectiveClockRate sensible
+			m.startTime = time.Now().Add(-time.Duration(m.cycleCount) * m.rate.ToDuration())
+		}
+		m.Video.restore(&snap.Video)
+		m.Keyboard.restore(&snap.Keyboard)
+		m.Clock.restore(&snap.Clock, m.cycleCount)
+		if m.SPED3 != nil {
+			m.SPED3.restore(snap.SPED3, m.cycleCount)
+		}
+		// an access noticed before restoring didn't happen
+		m.watchHit = nil
+	})
+	return
+}
+
+// restoreDevices restores the state of each attached device. Devices can only
+// check their data by restoring it, so if one rejects its data, those already
+// restored are put back the way they were.
+func (m *Machine) restoreDevices(states [][]byte) error {
+	saved := make([][]byte, len(m.devices))
+	for i, dev := range m.devices {
+		if dev, ok := dev.(SnapshotDevice); ok {
+			data, err := dev.SaveState()
+			if err != nil {
+				return err
+			}
+			saved[i] = data
+		}
+	}
+	for i, dev := range m.devices {
+		if dev, ok := dev.(SnapshotDevice); ok {
+			if err := dev.RestoreState(states[i]); err != nil {
+				for j := 0; j < i; j++ {
+					if dev, ok := m.devices[j].(SnapshotDevice); ok {
+						dev.RestoreState(saved[j])
+					}
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteSnapshot writes the snapshot to w in a versioned file format
+func WriteSnapshot(w io.Writer, snap *Snapshot) error {
+	if _, err := fmt.Fprintf(w, "%s %d\n", snapshotMagic, SnapshotVersion); err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	if err := gob.NewEncoder(zw).Encode(snap); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var version int
+	if n, _ := fmt.Sscanf(line, snapshotMagic+" %d\n", &version); n != 1 {
+		return nil, ErrNotSnapshot
+	}
+	if version != SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if err := gob.NewDecoder(zr).Decode(&snap); err != nil {
+		return nil, err
+	}
+	if snap.State == nil {
+		return nil, ErrNotSnapshot
+	}
+	return &snap, nil
+}
+
+func (v *Video) snapshot() VideoState {
+	return VideoState{append([]core.Word(nil), v.words[:]...), v.screen, v.font, v.palette, v.border}
+}
+
+func (v *Video) restore(state *VideoState) {
+	copy(v.words[:], state.Words)
+	v.screen, v.font, v.palette, v.border = state.Screen, state.Font, state.Palette, state.Border
+}
+
+func (k *Keyboard) snapshot() KeyboardState {
+	state := KeyboardState{
+		Words:   append([]core.Word(nil), k.words[:]...),
+		Offset:  k.offset,
+		Queued:  append([]rune(nil), k.queued...),
+		Buffer:  append([]core.Word(nil), k.buffer...),
+		Held:    make(map[core.Word]bool),
+		Message: k.message,
+	}
+	for key := range k.held {
+		state.Held[key] = true
+	}
+	return state
+}
+
+func (k *Keyboard) validate(state *KeyboardState) error {
+	if state.Offset < 0 || state.Offset >= len(k.words) {
+		return errors.New("invalid keyboard state")
+	}
+	return nil
+}
+
+func (k *Keyboard) restore(state *KeyboardState) {
+	copy(k.words[:], state.Words)
+	k.offset = state.Offset
+	k.queued = append([]rune(nil), state.Queued...)
+	k.buffer = append([]core.Word(nil), state.Buffer...)
+	k.held = make(map[core.Word]bool)
+	for key := range state.Held {
+		k.held[key] = true
+	}
+	k.message = state.Message
+}
+
+func (c *Clock) snapshot() ClockState {
+	return ClockState{c.divisor, c.start, c.ticks, c.message}
+}
+
+func (c *Clock) restore(state *ClockState, cycle uint) {
+	c.divisor, c.start, c.ticks, c.message = state.Divisor, state.Start, state.Ticks, state.Message
+	c.cycle = cycle
+}
+
+func (d *SPED3) snapshot() SPED3State {
+	return SPED3State{d.address, d.count, d.target, d.angle, d.turnFrom, d.turning, d.start}
+}
+
+func (d *SPED3) restore(state *SPED3State, cycle uint) {
+	d.address, d.count, d.target = state.Address, state.Count, state.Target
+	d.angle, d.turnFrom, d.turning, d.start = state.Angle, state.TurnFrom, state.Turning, state.Start
+	d.cycle = cycle
+}
@@ -0,0 +1,132 @@
+package dcpu
+
+import (
+	"bytes"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	machine := new(Machine)
+	if err := machine.State.LoadProgram(loadSample(t, "hello.obj"), 0); err != nil {
+		t.Fatal(err)
+	}
+	machine.Keyboard.QueueKeys([]rune("hi"))
+	for i := 0; i < 5; i++ {
+		if err := machine.StepCycle(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if machine.State.AtInstructionBoundary() {
+		t.Fatal("Expected to be in the middle of an instruction")
+	}
+	snap, err := machine.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap, err = ReadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := new(Machine)
+	if err := restored.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if restored.cycleCount != 5 {
+		t.Errorf("Expected 5 cycles, found %d", restored.cycleCount)
+	}
+	// both machines should now run identically
+	for i := 0; i < 200; i++ {
+		if err := machine.StepCycle(); err != nil {
+			t.Fatal(err)
+		}
+		if err := restored.StepCycle(); err != nil {
+			t.Fatal(err)
+		}
+		if machine.State.Registers != restored.State.Registers {
+			t.Fatalf("Registers differ after %d cycles: %v, %v", i+1, machine.State.Registers, restored.State.Registers)
+		}
+	}
+	if a, b := machine.State.Ram.GetSlice(0, 0xffff), restored.State.Ram.GetSlice(0, 0xffff); !wordsEqual(a, b) {
+		t.Error("Memory differs")
+	}
+	if string(restored.Keyboard.queued) != string(machine.Keyboard.queued) {
+		t.Errorf("Expected queued keys %q, found %q", string(machine.Keyboard.queued), string(restored.Keyboard.queued))
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	machine := new(Machine)
+	first, second := NewSerial(nil, nil), NewSerial(nil, nil)
+	machine.AttachDevice(first)
+	machine.AttachDevice(second)
+	snap, err := machine.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.State.Registers[0] = 1
+	snap.Devices[0] = []byte{0, 1}
+	snap.Devices[1] = nil
+	if err := machine.Restore(snap); err == nil {
+		t.Error("Expected an invalid device state to be rejected")
+	}
+	if machine.State.A() != 0 || first.message != 0 {
+		t.Error("Expected a rejected snapshot to leave the machine alone")
+	}
+	snap.Devices[1] = []byte{0, 0}
+	snap.State.Address = core.SnapshotAddress{Type: 1, Index: 0x20}
+	if err := machine.Restore(snap); err != core.ErrInvalidSnapshot {
+		t.Errorf("Expected ErrInvalidSnapshot for an invalid register, found %v", err)
+	}
+	snap.State.Address = core.SnapshotAddress{}
+	// executing an opcode the spec doesn't define
+	snap.State.Step, snap.State.Op = 3, 0
+	if err := machine.Restore(snap); err != core.ErrInvalidSnapshot {
+		t.Errorf("Expected ErrInvalidSnapshot for an invalid opcode, found %v", err)
+	}
+	// decoding an operand code that doesn't exist
+	snap.State.Step, snap.State.Op, snap.State.A = 1, 1, 0x40
+	if err := machine.Restore(snap); err != core.ErrInvalidSnapshot {
+		t.Errorf("Expected ErrInvalidSnapshot for an invalid operand, found %v", err)
+	}
+	snap.State.Step, snap.State.Op, snap.State.A = 0, 0, 0
+	snap.Keyboard.Offset = -1
+	if err := machine.Restore(snap); err == nil {
+		t.Error("Expected an invalid keyboard offset to be rejected")
+	}
+	if machine.State.A() != 0 || first.message != 0 {
+		t.Error("Expected a rejected snapshot to leave the machine alone")
+	}
+	snap.Keyboard.Offset = 0
+	if err := machine.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if machine.State.A() != 1 || first.message != 1 {
+		t.Error("Expected the snapshot to be restored")
+	}
+}
+
+func TestReadSnapshotVersion(t *testing.T) {
+	if _, err := ReadSnapshot(strings.NewReader("DCPU-16 snapshot 99\n")); err == nil || !strings.Contains(err.Error(), "version 99") {
+		t.Errorf("Expected a version error, found %v", err)
+	}
+	if _, err := ReadSnapshot(strings.NewReader("not a snapshot\n")); err != ErrNotSnapshot {
+		t.Errorf("Expected ErrNotSnapshot, found %v", err)
+	}
+}
+
+func wordsEqual(a, b []core.Word) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
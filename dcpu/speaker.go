@@ -0,0 +1,189 @@
+// Two-channel speaker implementation
+// Each channel plays a square wave at the frequency the program sets with HWI,
+// or nothing if the frequency is 0. Rather than playing through the host's
+// audio hardware, the speaker writes what it plays to a WAV file. Samples are
+// timed by the machine's cycle counter, so the file is the same no matter how
+// fast the emulator actually runs.
+
+package dcpu
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io"
+)
+
+const (
+	speakerHardwareID      = 0x02060001
+	speakerHardwareVersion = 1
+)
+
+// HWI messages understood by the speaker, passed in register A. The frequency
+// is passed in B, in Hz.
+const (
+	speakerSetChannel1 = 0
+	speakerSetChannel2 = 1
+)
+
+const (
+	SpeakerSampleRate = 44100  // samples per second of emulated time
+	speakerAmplitude  = 0x2000 // of each channel, in 16-bit samples
+	wavHeaderSize     = 44
+)
+
+var ErrSpeakerTooLong = errors.New("speaker output is too long for a WAV file")
+
+// Speaker is a two-channel square wave speaker that writes 16-bit mono WAV
+// files. Attach it to a Machine running the 1.7 spec with AttachDevice. The
+// file is finished when the machine stops, or when Flush is called.
+// Running the machine backwards doesn't take back what was already played.
+type Speaker struct {
+	w         io.WriteSeeker
+	bw        *bufio.Writer
+	err       error // the first error writing the file
+	frequency [2]core.Word
+	phase     [2]uint32 // how far through its period each channel is
+	samples   uint64    // the number of samples written
+}
+
+// NewSpeaker returns a Speaker that writes a WAV file to w, starting with the
+// header
+func NewSpeaker(w io.WriteSeeker) (*Speaker, error) {
+	s := &Speaker{w: w, bw: bufio.NewWriter(w)}
+	if err := s.writeHeader(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// writeHeader writes the WAV header for the samples written so far
+func (s *Speaker) writeHeader() error {
+	dataSize := s.samples * 2
+	if dataSize > 0xffffffff-wavHeaderSize {
+		return ErrSpeakerTooLong
+	}
+	header := []interface{}{
+		[4]byte{'R', 'I', 'F', 'F'},
+		uint32(wavHeaderSize - 8 + dataSize),
+		[4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '},
+		uint32(16),                    // size of the format chunk
+		uint16(1),                     // PCM
+		uint16(1),                     // channels
+		uint32(SpeakerSampleRate),     // samples per second
+		uint32(SpeakerSampleRate * 2), // bytes per second
+		uint16(2),                     // bytes per sample
+		uint16(16),                    // bits per sample
+		[4]byte{'d', 'a', 't', 'a'},
+		uint32(dataSize),
+	}
+	for _, field := range header {
+		if err := binary.Write(s.bw, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return s.bw.Flush()
+}
+
+// Err returns the first error that occurred writing the file
+func (s *Speaker) Err() error {
+	return s.err
+}
+
+// Samples returns the number of samples written so far
+func (s *Speaker) Samples() uint64 {
+	return s.samples
+}
+
+// Flush writes any buffered samples, and updates the header to include them.
+// The file is left ready for more samples.
+func (s *Speaker) Flush() error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.err = s.bw.Flush(); s.err != nil {
+		return s.err
+	}
+	if _, s.err = s.w.Seek(0, io.SeekStart); s.err != nil {
+		return s.err
+	}
+	if s.err = s.writeHeader(); s.err != nil {
+		return s.err
+	}
+	_, s.err = s.w.Seek(0, io.SeekEnd)
+	return s.err
+}
+
+func (s *Speaker) HardwareID() uint32 {
+	return speakerHardwareID
+}
+
+func (s *Speaker) HardwareVersion() core.Word {
+	return speakerHardwareVersion
+}
+
+func (s *Speaker) Manufacturer() uint32 {
+	return 0
+}
+
+func (s *Speaker) HandleInterrupt(state *core.State) (uint, error) {
+	switch state.A() {
+	case speakerSetChannel1, speakerSetChannel2:
+		s.frequency[state.A()] = state.B()
+	}
+	return 0, nil
+}
+
+// Tick writes every sample that's due by the machine's current cycle.
+// Sample n is due at cycle n * clock rate / SpeakerSampleRate.
+func (s *Speaker) Tick(m *Machine) error {
+	if s.err != nil || m.rate <= 0 {
+		return nil
+	}
+	for s.samples*uint64(m.rate) <= uint64(m.cycleCount)*SpeakerSampleRate {
+		if s.err = binary.Write(s.bw, binary.LittleEndian, s.sample()); s.err != nil {
+			// the program can keep running without sound
+			return nil
+		}
+		s.samples++
+	}
+	return nil
+}
+
+// sample returns the next sample, mixing the channels
+func (s *Speaker) sample() int16 {
+	var sample int16
+	for i, frequency := range s.frequency {
+		if frequency == 0 {
+			s.phase[i] = 0
+			continue
+		}
+		if s.phase[i] < 1<<31 {
+			sample += speakerAmplitude
+		} else {
+			sample -= speakerAmplitude
+		}
+		s.phase[i] += uint32((uint64(frequency)<<32 + SpeakerSampleRate/2) / SpeakerSampleRate)
+	}
+	return sample
+}
+
+// SaveState returns the frequencies of the channels. The samples already
+// written aren't part of it.
+func (s *Speaker) SaveState() ([]byte, error) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data, uint16(s.frequency[0]))
+	binary.BigEndian.PutUint16(data[2:], uint16(s.frequency[1]))
+	return data, nil
+}
+
+func (s *Speaker) RestoreState(data []byte) error {
+	if len(data) != 4 {
+		return errors.New("invalid speaker state")
+	}
+	s.frequency[0] = core.Word(binary.BigEndian.Uint16(data))
+	s.frequency[1] = core.Word(binary.BigEndian.Uint16(data[2:]))
+	return nil
+}
@@ -0,0 +1,88 @@
+package dcpu
+
+import (
+	"encoding/binary"
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSpeaker(t *testing.T) {
+	f, err := ioutil.TempFile("", "speaker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	speaker, err := NewSpeaker(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// play 441Hz, which is 100 samples per period, on the first channel
+	prog, err := asm.Assemble([]byte(`
+		      IAS 1
+		      SET A, 0
+		      SET B, 441
+		      HWI 3
+		:loop SET PC, loop`), core.Spec17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two cycles per sample
+	machine := &Machine{Headless: true, VirtualTime: true, CycleLimit: 1000}
+	machine.State.Spec = core.Spec17
+	if err := machine.AttachDevice(speaker); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(2 * SpeakerSampleRate); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-machine.ErrorC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the cycle limit")
+	}
+	if err := machine.Stop(); err != ErrCycleLimit {
+		t.Errorf("Expected ErrCycleLimit, found %v", err)
+	}
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// samples 0 through 500 are due by cycle 1000
+	if len(data) != wavHeaderSize+501*2 {
+		t.Fatalf("Unexpected file size %d", len(data))
+	}
+	if riff, size := string(data[:4]), binary.LittleEndian.Uint32(data[40:]); riff != "RIFF" || size != 501*2 {
+		t.Errorf("Unexpected header %q with data size %d", riff, size)
+	}
+	samples := make([]int16, 501)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(data[wavHeaderSize+i*2:]))
+	}
+	// the tone starts once HWI runs, then alternates every 50 samples
+	start := 0
+	for start < len(samples) && samples[start] == 0 {
+		start++
+	}
+	if start == 0 || start > 5 {
+		t.Fatalf("Unexpected start of the tone at sample %d", start)
+	}
+	for i, sample := range samples[start:] {
+		expected := int16(speakerAmplitude)
+		if i%100 >= 50 {
+			expected = -speakerAmplitude
+		}
+		if sample != expected {
+			t.Fatalf("Unexpected sample %d; expected %d, found %d", start+i, expected, sample)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+// SPED-3 Suspended Particle Exciter Display implementation
+// The display projects up to 128 vertices out of main RAM, drawing a line
+// from each vertex to the next, and slowly turns the whole image around its
+// vertical axis to face whatever rotation the program asks for. Like the
+// clock, the rotation is derived from the machine's cycle counter, so it
+// doesn't depend on how fast the emulator actually runs.
+//
+// Each vertex is two words: YYYYYYYYXXXXXXXX, followed by 00000ICCZZZZZZZZ,
+// where C is the color (black, red, green or blue) and I the intensity. Z is
+// the vertical axis. We draw the image as seen from slightly above, either
+// as ASCII line art in a terminal pane or into an image.
+
+package dcpu
+
+import (
+	"github.com/kballard/dcpu16/dcpu/core"
+	"github.com/kballard/termbox-go"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+const (
+	sped3HardwareID      = 0x42babf3c
+	sped3HardwareVersion = 0x0003
+	sped3Manufacturer    = 0x1eb37e91 // MACKAPAR
+)
+
+// HWI messages understood by the SPED-3, passed in register A
+const (
+	sped3Poll   = 0
+	sped3Map    = 1
+	sped3Rotate = 2
+)
+
+const (
+	SPED3MaxVertices = 128
+	sped3TurnRate    = 50 // degrees per second
+	sped3Elevation   = 30 // degrees above the horizon that we look from
+)
+
+// SPED3Status is the state of the display, as reported to the program
+type SPED3Status core.Word
+
+const (
+	SPED3NoData  SPED3Status = 0 // there are no vertices to project
+	SPED3Running SPED3Status = 1 // the display is projecting the vertices
+	SPED3Turning SPED3Status = 2 // the display is projecting the vertices and turning
+)
+
+// the display never breaks, so this is the only error it reports
+const sped3ErrorNone = 0
+
+// SPED3 is a SPED-3 display. Set Machine.SPED3 to attach one to a machine
+// running the 1.7 spec.
+type SPED3 struct {
+	ram      *core.Memory // main RAM, which holds the vertices
+	address  core.Word    // address of the vertices
+	count    core.Word    // number of vertices, or 0 if disconnected
+	angle    float64      // the current rotation, in degrees
+	target   core.Word    // the rotation we're turning to, in degrees
+	turning  bool
+	turnFrom float64   // the rotation the turn started at
+	start    uint      // the cycle the turn started at
+	cycle    uint      // the current cycle, as of the last Tick
+	rate     ClockRate // the clock rate of the machine
+}
+
+// sped3Vertex is a vertex as it's stored in RAM
+type sped3Vertex struct {
+	x, y, z byte
+	color   byte // black, red, green or blue
+	intense bool
+}
+
+// sped3Line is a line between two projected vertices, in the coordinates
+// of whatever it's drawn on, with the color of the vertex it ends at
+type sped3Line struct {
+	x0, y0, x1, y1 float64
+	color          byte
+	intense        bool
+}
+
+func (d *SPED3) HardwareID() uint32 {
+	return sped3HardwareID
+}
+
+func (d *SPED3) HardwareVersion() core.Word {
+	return sped3HardwareVersion
+}
+
+func (d *SPED3) Manufacturer() uint32 {
+	return sped3Manufacturer
+}
+
+func (d *SPED3) HandleInterrupt(s *core.State) (uint, error) {
+	switch s.A() {
+	case sped3Poll:
+		s.SetB(core.Word(d.Status()))
+		s.SetC(sped3ErrorNone)
+	case sped3Map:
+		d.address, d.count = s.X(), s.Y()
+		if d.count > SPED3MaxVertices {
+			d.count = SPED3MaxVertices
+		}
+	case sped3Rotate:
+		d.target = s.X() % 360
+		d.turnFrom, d.start = d.angle, d.cycle
+		d.turning = float64(d.target) != d.angle
+	}
+	return 0, nil
+}
+
+func (d *SPED3) Status() SPED3Status {
+	switch {
+	case d.count == 0:
+		return SPED3NoData
+	case d.turning:
+		return SPED3Turning
+	}
+	return SPED3Running
+}
+
+// Rotation returns the current rotation of the image, in degrees
+func (d *SPED3) Rotation() float64 {
+	return d.angle
+}
+
+// Tick turns the display towards its target rotation, the short way around
+func (d *SPED3) Tick(m *Machine) error {
+	d.cycle, d.rate = m.cycleCount, m.rate
+	if !d.turning || d.rate <= 0 {
+		return nil
+	}
+	if d.cycle < d.start {
+		// the machine was run backwards to before the turn started
+		d.start = d.cycle
+	}
+	distance := math.Mod(float64(d.target)-d.turnFrom+540, 360) - 180
+	turned := float64(d.cycle-d.start) * sped3TurnRate / float64(d.rate)
+	if turned >= math.Abs(distance) {
+		d.angle, d.turning = float64(d.target), false
+		return nil
+	}
+	if distance < 0 {
+		turned = -turned
+	}
+	d.angle = math.Mod(d.turnFrom+turned+360, 360)
+	return nil
+}
+
+// vertices reads the vertices out of RAM
+func (d *SPED3) vertices() []sped3Vertex {
+	if d.ram == nil {
+		return nil
+	}
+	vertices := make([]sped3Vertex, d.count)
+	for i := range vertices {
+		address := d.address + core.Word(i*2)
+		xy, z := d.ram.Load(address), d.ram.Load(address+1)
+		vertices[i] = sped3Vertex{
+			x:       byte(xy),
+			y:       byte(xy >> 8),
+			z:       byte(z),
+			color:   byte(z>>8) & 3,
+			intense: z&0x400 != 0,
+		}
+	}
+	return vertices
+}
+
+// lines projects the lines onto a width x height surface, with the origin at
+// the top left. Cells that aren't square are accounted for by aspect, their
+// height divided by their width.
+func (d *SPED3) lines(width, height int, aspect float64) []sped3Line {
+	// the corners of the volume stay inside the surface at any rotation
+	radius := 127.5 * math.Sqrt(3)
+	scale := math.Min(float64(width)/aspect, float64(height)) / (2 * radius)
+	sin, cos := math.Sincos(d.angle * math.Pi / 180)
+	esin, ecos := math.Sincos(sped3Elevation * math.Pi / 180)
+	project := func(v sped3Vertex) (x, y float64) {
+		dx, dy, dz := float64(v.x)-127.5, float64(v.y)-127.5, float64(v.z)-127.5
+		// turn around the vertical axis, then tilt towards the viewer
+		rx, ry := dx*cos-dy*sin, dx*sin+dy*cos
+		up := dz*ecos + ry*esin
+		return float64(width)/2 + rx*scale*aspect, float64(height)/2 - up*scale
+	}
+	vertices := d.vertices()
+	var lines []sped3Line
+	for i, v := range vertices {
+		x1, y1 := project(v)
+		x0, y0 := x1, y1
+		if i > 0 {
+			x0, y0 = project(vertices[i-1])
+		} else if len(vertices) > 1 {
+			// the first vertex is only where the first line starts
+			continue
+		}
+		lines = append(lines, sped3Line{x0, y0, x1, y1, v.color, v.intense})
+	}
+	return lines
+}
+
+// sped3Colors are the colors of the vertices, dim and intense. Black lines
+// are drawn dark gray, so they can be seen.
+var sped3Colors = [4][2]color.RGBA{
+	{{0x22, 0x22, 0x22, 0xff}, {0x44, 0x44, 0x44, 0xff}},
+	{{0x88, 0, 0, 0xff}, {0xff, 0x44, 0x44, 0xff}},
+	{{0, 0x88, 0, 0xff}, {0x44, 0xff, 0x44, 0xff}},
+	{{0, 0, 0x88, 0xff}, {0x44, 0x44, 0xff, 0xff}},
+}
+
+// Frame renders the wireframe into a new size x size image, on black.
+// Frame reads the vertices out of RAM, so it must not race with a running
+// machine.
+func (d *SPED3) Frame(size int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	black := color.RGBA{0, 0, 0, 0xff}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetRGBA(x, y, black)
+		}
+	}
+	for _, line := range d.lines(size, size, 1) {
+		c := sped3Colors[line.color][0]
+		if line.intense {
+			c = sped3Colors[line.color][1]
+		}
+		plotLine(line, func(x, y int, _ rune) {
+			img.SetRGBA(x, y, c)
+		})
+	}
+	return img
+}
+
+// sped3Attrs are the terminal colors of the vertices
+var sped3Attrs = [4]termbox.Attribute{termbox.ColorBlack, termbox.ColorRed, termbox.ColorGreen, termbox.ColorBlue}
+
+// LineArt draws the wireframe as ASCII line art, width x height characters,
+// one line per row. Each character is assumed to be twice as tall as it is
+// wide.
+func (d *SPED3) LineArt(width, height int) []string {
+	art := make([][]rune, height)
+	for row := range art {
+		art[row] = []rune(strings.Repeat(" ", width))
+	}
+	for _, line := range d.lines(width, height, 2) {
+		plotLine(line, func(x, y int, ch rune) {
+			if y >= 0 && y < height && x >= 0 && x < width {
+				art[y][x] = ch
+			}
+		})
+	}
+	lines := make([]string, height)
+	for row := range art {
+		lines[row] = string(art[row])
+	}
+	return lines
+}
+
+// drawPane draws the wireframe into the terminal, in a width x height pane
+// whose top left corner is at x, y
+func (d *SPED3) drawPane(x, y, width, height int) {
+	for row := 0; row < height; row++ {
+		for col := 0; col < width; col++ {
+			termbox.SetCell(x+col, y+row, ' ', termbox.ColorDefault, termbox.ColorDefault)
+		}
+	}
+	for _, line := range d.lines(width, height, 2) {
+		attr := sped3Attrs[line.color]
+		if line.intense || line.color == 0 {
+			// bold black is dark gray
+			attr |= termbox.AttrBold
+		}
+		plotLine(line, func(col, row int, ch rune) {
+			if row >= 0 && row < height && col >= 0 && col < width {
+				termbox.SetCell(x+col, y+row, ch, attr, termbox.ColorDefault)
+			}
+		})
+	}
+}
+
+// plotLine calls plot for each pixel or cell along the line, along with the
+// character that best matches the line's slope
+func plotLine(line sped3Line, plot func(x, y int, ch rune)) {
+	dx, dy := line.x1-line.x0, line.y1-line.y0
+	steps := int(math.Ceil(math.Max(math.Abs(dx), math.Abs(dy))))
+	ch := '+'
+	if steps > 0 {
+		// cells are twice as tall as they're wide
+		switch slope := math.Abs(dy*2) / math.Max(math.Abs(dx), 1e-9); {
+		case slope < 0.5:
+			ch = '-'
+		case slope > 4:
+			ch = '|'
+		case (dx > 0) == (dy > 0):
+			ch = '\\'
+		default:
+			ch = '/'
+		}
+	}
+	for i := 0; i <= steps; i++ {
+		t := 0.0
+		if steps > 0 {
+			t = float64(i) / float64(steps)
+		}
+		x, y := line.x0+dx*t, line.y0+dy*t
+		plot(int(math.Floor(x)), int(math.Floor(y)), ch)
+	}
+}
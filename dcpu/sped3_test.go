@@ -0,0 +1,96 @@
+package dcpu
+
+import (
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"image/color"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSPED3(t *testing.T) {
+	// poll with no data, map two vertices, then turn a quarter of the way around
+	prog, err := asm.Assemble([]byte(`
+		      SET A, 0
+		      HWI 3
+		      SET [0x1000], B
+		      SET A, 1
+		      SET X, vertices
+		      SET Y, 2
+		      HWI 3
+		      SET A, 0
+		      HWI 3
+		      SET [0x1001], B
+		      SET A, 2
+		      SET X, 450
+		      HWI 3
+		      SET A, 0
+		      HWI 3
+		      SET [0x1002], B
+		:loop SET PC, loop
+		:vertices
+		      DAT 0x7f7f, 0x0100, 0x7f7f, 0x05ff`), core.Spec17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// turning 90 degrees takes 1.8 seconds, or 900 cycles at 500Hz
+	machine := &Machine{Headless: true, VirtualTime: true, CycleLimit: 1000}
+	machine.State.Spec = core.Spec17
+	machine.SPED3 = new(SPED3)
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(500); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-machine.ErrorC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the cycle limit")
+	}
+	if err := machine.Stop(); err != ErrCycleLimit {
+		t.Errorf("Expected ErrCycleLimit, found %v", err)
+	}
+	expected := []core.Word{core.Word(SPED3NoData), core.Word(SPED3Running), core.Word(SPED3Turning)}
+	if results := machine.State.Ram.GetSlice(0x1000, 0x1003); !wordsEqual(results, expected) {
+		t.Errorf("Unexpected states %v", results)
+	}
+	if status, rotation := machine.SPED3.Status(), machine.SPED3.Rotation(); status != SPED3Running || rotation != 90 {
+		t.Errorf("Expected to be running at 90 degrees, found %v at %v", status, rotation)
+	}
+
+	// the line runs straight up the middle at any rotation
+	art := machine.SPED3.LineArt(20, 10)
+	if len(art) != 10 || !strings.Contains(art[5], "|") {
+		t.Errorf("Unexpected line art\n%s", strings.Join(art, "\n"))
+	}
+	img := machine.SPED3.Frame(100)
+	bright := color.RGBA{0xff, 0x44, 0x44, 0xff}
+	if found := img.RGBAAt(50, 50); found != bright {
+		t.Errorf("Unexpected pixel at the center; expected %v, found %v", bright, found)
+	}
+	if found, black := img.RGBAAt(10, 50), (color.RGBA{0, 0, 0, 0xff}); found != black {
+		t.Errorf("Unexpected background; expected %v, found %v", black, found)
+	}
+}
+
+func TestSPED3Turning(t *testing.T) {
+	d := &SPED3{count: 1}
+	machine := &Machine{rate: 100}
+	// 350 degrees is closer going backwards
+	state := new(core.State)
+	state.SetA(sped3Rotate)
+	state.SetX(350)
+	d.HandleInterrupt(state)
+	machine.cycleCount = 10
+	d.Tick(machine)
+	if d.Status() != SPED3Turning || d.Rotation() != 355 {
+		t.Errorf("Expected to be turning at 355 degrees, found %v at %v", d.Status(), d.Rotation())
+	}
+	machine.cycleCount = 20
+	d.Tick(machine)
+	if d.Status() != SPED3Running || d.Rotation() != 350 {
+		t.Errorf("Expected to be running at 350 degrees, found %v at %v", d.Status(), d.Rotation())
+	}
+}
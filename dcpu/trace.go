@@ -0,0 +1,184 @@
+package dcpu
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"github.com/kballard/dcpu16/dcpu/disasm"
+	"io"
+	"strings"
+)
+
+// TraceEntry describes a single instruction executed by a traced Machine
+type TraceEntry struct {
+	Cycle       uint                 `json:"cycle"` // the machine's cycle count once the instruction finished
+	PC          core.Word            `json:"pc"`    // the address of the instruction
+	Disassembly string               `json:"disasm"`
+	Registers   map[string]core.Word `json:"regs,omitempty"` // the new value of every register that changed
+	Writes      []MemoryWrite        `json:"writes,omitempty"`
+	Error       string               `json:"error,omitempty"` // the error that stopped the machine
+}
+
+// MemoryWrite is a word stored to memory while an instruction executed. That
+// includes pushing the PC and A when an interrupt is triggered before it, and
+// words stored by devices handling HWI.
+type MemoryWrite struct {
+	Address core.Word `json:"addr"`
+	Value   core.Word `json:"value"`
+}
+
+// String formats the entry on a single line. PC isn't listed with the changed
+// registers unless the instruction jumped.
+func (e *TraceEntry) String() string {
+	var changes []string
+	for _, name := range core.RegisterNames {
+		if val, ok := e.Registers[name]; ok {
+			changes = append(changes, fmt.Sprintf("%s=%04x", name, val))
+		}
+	}
+	for _, write := range e.Writes {
+		changes = append(changes, fmt.Sprintf("[%04x]=%04x", write.Address, write.Value))
+	}
+	if e.Error != "" {
+		changes = append(changes, "error: "+e.Error)
+	}
+	line := fmt.Sprintf("%10d  %04x: %-24s %s", e.Cycle, e.PC, e.Disassembly, strings.Join(changes, " "))
+	return strings.TrimRight(line, " ")
+}
+
+// Tracer records every instruction executed by a Machine as a TraceEntry,
+// and writes them to a file as JSON, one entry per line. Set Machine.Tracer
+// before starting the machine to use it.
+type Tracer struct {
+	w       *bufio.Writer
+	enc     *json.Encoder
+	err     error          // the first error writing the trace
+	regs    core.Registers // the registers when the current instruction started
+	fetched []core.Word    // the words of the current instruction, as they were fetched
+	writes  []MemoryWrite  // the words stored by the current instruction so far
+	watches []int          // the watches that report fetches and stores
+	ring    []TraceEntry   // the last entries, if only some are kept
+	next    int            // the index of the oldest entry in ring, once it's full
+	keep    int
+}
+
+// NewTracer returns a Tracer that writes to w. If keep is 0 every entry is
+// written as soon as it's recorded. Otherwise only the last keep entries are
+// remembered, and they're written if the machine stops with a MachineError.
+func NewTracer(w io.Writer, keep int) *Tracer {
+	bw := bufio.NewWriter(w)
+	return &Tracer{w: bw, enc: json.NewEncoder(bw), keep: keep}
+}
+
+// Err returns the first error that occurred writing the trace
+func (t *Tracer) Err() error {
+	return t.err
+}
+
+// watch starts watching every fetch and store the CPU makes
+func (t *Tracer) watch(ram *core.Memory) {
+	// a region can't cover all of memory
+	for _, region := range []core.Region{{Start: 0, Length: 0x8000}, {Start: 0x8000, Length: 0x8000}} {
+		t.watches = append(t.watches, ram.Watch(region, core.AccessWrite|core.AccessExecute, t.access))
+	}
+}
+
+// unwatch undoes watch
+func (t *Tracer) unwatch(ram *core.Memory) {
+	for _, id := range t.watches {
+		ram.Unwatch(id)
+	}
+	t.watches = nil
+}
+
+func (t *Tracer) access(acc core.MemoryAccess) {
+	if acc.Access == core.AccessExecute {
+		t.fetched = append(t.fetched, acc.Value)
+	} else {
+		t.writes = append(t.writes, MemoryWrite{acc.Address, acc.Value})
+	}
+}
+
+// start notes the registers at the start of an instruction
+func (t *Tracer) start(state *core.State) {
+	t.regs = state.Registers
+	t.fetched, t.writes = nil, nil
+}
+
+// finish records the instruction that just finished or failed
+func (t *Tracer) finish(m *Machine, err error) {
+	inst := m.State.LastInstruction()
+	// the instruction is decoded as it was run, even if it overwrote itself
+	var decoded disasm.Instruction
+	if insts := disasm.Disassemble(t.fetched, inst.Address, m.State.Spec); len(insts) > 0 {
+		decoded = insts[0]
+	} else {
+		// it failed before it was fetched
+		decoded = disasm.Decode(&m.State.Ram, inst.Address, m.State.Spec)
+	}
+	entry := TraceEntry{Cycle: m.cycleCount, PC: inst.Address, Disassembly: decoded.String(), Writes: t.writes}
+	next := inst.Address + core.Word(len(decoded.Words))
+	for i, val := range m.State.Registers {
+		if val != t.regs[i] && !(core.RegisterNames[i] == "PC" && val == next) {
+			if entry.Registers == nil {
+				entry.Registers = make(map[string]core.Word)
+			}
+			entry.Registers[core.RegisterNames[i]] = val
+		}
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	t.record(entry)
+}
+
+func (t *Tracer) record(entry TraceEntry) {
+	if t.keep == 0 {
+		t.write(&entry)
+		return
+	}
+	if len(t.ring) < t.keep {
+		t.ring = append(t.ring, entry)
+		return
+	}
+	t.ring[t.next] = entry
+	t.next = (t.next + 1) % t.keep
+}
+
+func (t *Tracer) write(entry *TraceEntry) {
+	if t.err == nil {
+		t.err = t.enc.Encode(entry)
+	}
+}
+
+// stop writes any remembered entries if err is a MachineError, and flushes
+// the trace.
+func (t *Tracer) stop(err error) {
+	if _, ok := err.(*MachineError); ok {
+		for i := range t.ring {
+			t.write(&t.ring[(t.next+i)%len(t.ring)])
+		}
+	}
+	t.ring, t.next = nil, 0
+	if t.err == nil {
+		t.err = t.w.Flush()
+	}
+}
+
+// ReadTrace reads the entries written by a Tracer, calling f with each one
+// in order.
+func ReadTrace(r io.Reader, f func(*TraceEntry) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var entry TraceEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := f(&entry); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package dcpu
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"testing"
+	"time"
+)
+
+// runTraced runs program until it fails, and returns the trace entries
+func runTraced(t *testing.T, program []core.Word, spec core.SpecVersion, keep int) []*TraceEntry {
+	var buf bytes.Buffer
+	machine := &Machine{Headless: true, Tracer: NewTracer(&buf, keep)}
+	machine.State.Spec = spec
+	if err := machine.State.LoadProgram(program, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(10e6); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-machine.ErrorC:
+		if _, ok := err.(*MachineError); !ok {
+			t.Errorf("Expected a MachineError, found %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the program to fail")
+	}
+	machine.Stop()
+	if err := machine.Tracer.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var entries []*TraceEntry
+	if err := ReadTrace(&buf, func(entry *TraceEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestTracer(t *testing.T) {
+	program := []core.Word{
+		0x7c01, 0x0030, // SET A, 0x30
+		0x01e1, 0x1000, // SET [0x1000], A
+		0x0000, // invalid
+	}
+	entries := runTraced(t, program, core.Spec11, 0)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, found %d", len(entries))
+	}
+	if e := entries[0]; e.PC != 0 || e.Cycle != 2 || e.Disassembly != "SET A, 0x0030" || len(e.Registers) != 1 || e.Registers["A"] != 0x30 {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+	if e := entries[1]; e.PC != 2 || len(e.Registers) != 0 || len(e.Writes) != 1 || e.Writes[0] != (MemoryWrite{0x1000, 0x30}) {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+	if e := entries[2]; e.PC != 4 || e.Error == "" {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+	if s := entries[1].String(); s != "         4  0002: SET [0x1000], A          [1000]=0030" {
+		t.Errorf("Unexpected formatting %q", s)
+	}
+
+	// only the last 2 are kept
+	entries = runTraced(t, program, core.Spec11, 2)
+	if len(entries) != 2 || entries[0].PC != 2 || entries[1].PC != 4 {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+}
+
+func TestTracerWrites(t *testing.T) {
+	prog, err := asm.Assemble([]byte(`
+		      IAS handler
+		      INT 7
+		:handler
+		      SET A, 5     ; MEM_DUMP_PALETTE
+		      SET B, 0x2000
+		      HWI 0
+		:self SET [self], 0
+		      DAT 0`), core.Spec17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := runTraced(t, prog.Words, core.Spec17, 0)
+	if len(entries) != 7 {
+		t.Fatalf("Expected 7 entries, found %d", len(entries))
+	}
+	// triggering the interrupt pushes PC and A
+	if e := entries[2]; e.PC != prog.Labels["handler"] || len(e.Writes) != 2 || e.Writes[0] != (MemoryWrite{0xffff, prog.Labels["handler"]}) || e.Writes[1] != (MemoryWrite{0xfffe, 0}) {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+	// the LEM1802 dumps its palette
+	if e := entries[4]; len(e.Writes) != len(defaultPalette) || e.Writes[15] != (MemoryWrite{0x200f, defaultPalette[15]}) {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+	// the instruction is traced as it was before it overwrote itself
+	if e := entries[5]; e.Disassembly != fmt.Sprintf("SET [0x%04x], 0", prog.Labels["self"]) || len(e.Writes) != 1 {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/kballard/dcpu16/dcpu/core"
 	"github.com/kballard/termbox-go"
+	"image"
 	"os"
 	"strings"
 )
@@ -22,6 +23,22 @@ const (
 	backgroundColorAddress = 0x0280
 )
 
+const (
+	lemHardwareID      = 0x7349f615
+	lemHardwareVersion = 0x1802
+	lemManufacturer    = 0x1c6c8b36 // NYA_ELEKTRISKA
+)
+
+// HWI messages understood by the LEM1802, passed in register A
+const (
+	lemMemMapScreen   = 0
+	lemMemMapFont     = 1
+	lemMemMapPalette  = 2
+	lemSetBorderColor = 3
+	lemMemDumpFont    = 4
+	lemMemDumpPalette = 5
+)
+
 const DefaultScreenRefreshRate ClockRate = 60 // 60Hz
 
 var supportsXterm256 bool
@@ -39,18 +56,72 @@ var colorToAnsi [16]byte = [...]byte{
 	/* 1100 */ 203 /* 1101 */, 207 /* 1110 */, 227 /* 1111 */, 231,
 }
 
+// TerminalFont selects how characters are drawn in the terminal
+type TerminalFont int
+
+const (
+	// TerminalFontText draws each character as the closest terminal character,
+	// in a single cell. Custom fonts are ignored.
+	TerminalFontText TerminalFont = iota
+	// TerminalFontBraille draws the pixels of each 4x8 glyph using Unicode
+	// braille patterns, in 2x2 cells. This honors custom fonts.
+	TerminalFontBraille
+)
+
+func (f TerminalFont) String() string {
+	switch f {
+	case TerminalFontText:
+		return "text"
+	case TerminalFontBraille:
+		return "braille"
+	}
+	return fmt.Sprintf("TerminalFont(%d)", int(f))
+}
+
+func (f *TerminalFont) Set(str string) error {
+	switch strings.ToLower(str) {
+	case "text":
+		*f = TerminalFontText
+	case "braille":
+		*f = TerminalFontBraille
+	default:
+		return fmt.Errorf("unknown terminal font %#v", str)
+	}
+	return nil
+}
+
+// Video emulates the LEM1802 when running the 1.7 spec. The screen, font
+// and palette live in main RAM wherever the program maps them using HWI.
+// When running the 1.1 spec, it instead uses the legacy layout, where the
+// display has its own memory mapped at 0x8000, with the font at 0x8180
+// and the border color at 0x8280.
 type Video struct {
-	RefreshRate ClockRate // the refresh rate of the screen
-	words       [0x400]core.Word
-	mapped      bool
+	RefreshRate  ClockRate    // the refresh rate of the screen
+	TerminalFont TerminalFont // how to draw characters in the terminal
+	words        [0x400]core.Word
+	mapped       bool
+	ram          *core.Memory // main RAM for the LEM1802, nil in legacy mode
+	screen       core.Word    // address of the screen, or 0 if disconnected
+	font         core.Word    // address of the font, or 0 for the default
+	palette      core.Word    // address of the palette, or 0 for the default
+	border       core.Word    // palette index of the border
+	headless     bool         // render to frame instead of the terminal
+	frame        *image.RGBA  // the last frame rendered in headless mode
 }
 
 func (v *Video) Init() error {
+	// Default the background to cyan, for the heck of it
+	v.words[0x0280] = 3
+	copy(v.words[characterRangeStart:miscRangeStart], defaultFont[:])
+	v.screen, v.font, v.palette, v.border = 0, 0, 0, 0
+
+	if v.headless {
+		v.frame = v.Frame(false)
+		return nil
+	}
 	if err := termbox.Init(); err != nil {
 		return err
 	}
-	// Default the background to cyan, for the heck of it
-	v.words[0x0280] = 3
 
 	v.clearDisplay()
 	v.drawBorder()
@@ -59,22 +130,84 @@ func (v *Video) Init() error {
 }
 
 func (v *Video) Close() {
-	termbox.Close()
+	if !v.headless {
+		termbox.Close()
+	}
+}
+
+// Draw redraws the display from video memory
+func (v *Video) Draw() {
+	if v.headless {
+		v.RenderFrame(v.frame, false)
+		return
+	}
+	if v.ram != nil && v.screen == 0 {
+		// the LEM1802 is disconnected
+		v.clearDisplay()
+	} else {
+		for i := 0; i < windowWidth*windowHeight; i++ {
+			v.updateCell(i/windowWidth, i%windowWidth, v.cell(i))
+		}
+	}
+	v.drawBorder()
+}
+
+// cell returns the word for the cell at the given index
+func (v *Video) cell(index int) core.Word {
+	if v.ram == nil {
+		return v.words[index]
+	}
+	if v.screen == 0 {
+		return 0
+	}
+	return v.ram.Load(v.screen + core.Word(index))
 }
 
-func (v *Video) handleChange(offset core.Word) {
-	if offset < characterRangeStart {
-		row := int(offset / windowWidth)
-		column := int(offset % windowWidth)
-		v.updateCell(row, column, v.words[offset])
-	} else if offset < miscRangeStart {
-		// we can't handle font stuff with the terminal
-	} else if offset == backgroundColorAddress {
-		v.drawBorder()
+// glyph returns the two words of font data for the given character
+func (v *Video) glyph(ch byte) [2]core.Word {
+	offset := core.Word(ch&0x7F) * 2
+	switch {
+	case v.ram == nil:
+		return [2]core.Word{v.words[characterRangeStart+offset], v.words[characterRangeStart+offset+1]}
+	case v.font != 0:
+		return [2]core.Word{v.ram.Load(v.font + offset), v.ram.Load(v.font + offset + 1)}
 	}
+	return [2]core.Word{defaultFont[offset], defaultFont[offset+1]}
+}
+
+// paletteColor returns the 0x0rgb color for the given palette index
+func (v *Video) paletteColor(index byte) core.Word {
+	index &= 0xf
+	if v.ram != nil && v.palette != 0 {
+		return v.ram.Load(v.palette+core.Word(index)) & 0xfff
+	}
+	return defaultPalette[index]
+}
+
+// borderColor returns the palette index of the border
+func (v *Video) borderColor() byte {
+	if v.ram == nil {
+		// we have no good information on the background color lookup at the moment
+		// So instead just treat the low 4 bits
+		return byte(v.words[backgroundColorAddress] & 0xf)
+	}
+	return byte(v.border & 0xf)
+}
+
+// glyphSize returns the number of terminal cells used for each character
+func (v *Video) glyphSize() (width, height int) {
+	if v.TerminalFont == TerminalFontBraille {
+		return 2, 2
+	}
+	return 1, 1
 }
 
 func (v *Video) updateCell(row, column int, word core.Word) {
+	if v.TerminalFont == TerminalFontBraille {
+		v.updateBrailleCell(row, column, word)
+		return
+	}
+
 	// account for the border
 	row++
 	column++
@@ -87,7 +220,7 @@ func (v *Video) updateCell(row, column int, word core.Word) {
 	colors := byte((word & 0xFF00) >> 8)
 	fgNibble := (colors & 0xF0) >> 4
 	bgNibble := colors & 0x0F
-	fg, bg := colorToAttr(fgNibble), colorToAttr(bgNibble)
+	fg, bg := v.colorToAttr(fgNibble), v.colorToAttr(bgNibble)
 	if flag {
 		fg |= termbox.AttrBlink
 	}
@@ -114,6 +247,46 @@ func (v *Video) updateCell(row, column int, word core.Word) {
 	termbox.SetCell(column, row, ch, fg, bg)
 }
 
+// brailleDots maps glyph pixels within a 2x4 terminal cell to the bits of
+// a Unicode braille pattern, indexed by [row][column]
+var brailleDots = [4][2]rune{
+	{0x01, 0x08},
+	{0x02, 0x10},
+	{0x04, 0x20},
+	{0x40, 0x80},
+}
+
+// updateBrailleCell draws the glyph of a character into 2x2 terminal cells,
+// each of which covers 2x4 pixels.
+func (v *Video) updateBrailleCell(row, column int, word core.Word) {
+	fg, bg := v.colorToAttr(byte(word>>12)), v.colorToAttr(byte(word>>8))
+	if word&0x80 != 0 {
+		fg |= termbox.AttrBlink
+	}
+	glyph := v.glyph(byte(word))
+	for cy := 0; cy < 2; cy++ {
+		for cx := 0; cx < 2; cx++ {
+			// account for the border
+			termbox.SetCell(column*2+cx+1, row*2+cy+1, glyphBraille(glyph, cx, cy), fg, bg)
+		}
+	}
+}
+
+// glyphBraille returns the braille pattern for the 2x4 pixels of the glyph
+// that are drawn in terminal cell (cx, cy)
+func glyphBraille(glyph [2]core.Word, cx, cy int) rune {
+	ch := rune(0x2800)
+	for x := 0; x < 2; x++ {
+		bits := glyphColumn(glyph, cx*2+x) >> uint(cy*4)
+		for y := 0; y < 4; y++ {
+			if bits&(1<<uint(y)) != 0 {
+				ch |= brailleDots[y][x]
+			}
+		}
+	}
+	return ch
+}
+
 var glyphMap = map[rune]rune{
 	0: 'm',
 	1: 'v',
@@ -121,6 +294,39 @@ var glyphMap = map[rune]rune{
 	3: 't',
 }
 
+// colorToAttr returns the attribute for the given palette index
+func (v *Video) colorToAttr(index byte) termbox.Attribute {
+	rgb := v.paletteColor(index)
+	for i, c := range defaultPalette {
+		if c == rgb {
+			return colorToAttr(byte(i))
+		}
+	}
+	return rgbToAttr(rgb)
+}
+
+// rgbToAttr approximates a 0x0rgb color that isn't in the default palette
+func rgbToAttr(rgb core.Word) termbox.Attribute {
+	r, g, b := int(rgb>>8&0xf), int(rgb>>4&0xf), int(rgb&0xf)
+	if supportsXterm256 {
+		// the xterm-256 color cube has 6 levels per channel
+		level := func(c int) int {
+			return (c*5 + 7) / 15
+		}
+		ansi := 16 + 36*level(r) + 6*level(g) + level(b)
+		return termbox.ColorXterm256 | termbox.Attribute(ansi)<<termbox.XtermColorShift
+	}
+	// fall back on the closest color in the default palette
+	best, bestDistance := 0, -1
+	for i, c := range defaultPalette {
+		dr, dg, db := r-int(c>>8&0xf), g-int(c>>4&0xf), b-int(c&0xf)
+		if distance := dr*dr + dg*dg + db*db; bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+	return colorToAttr(byte(best))
+}
+
 func colorToAttr(color byte) termbox.Attribute {
 	var attr termbox.Attribute
 	if supportsXterm256 {
@@ -168,20 +374,19 @@ func colorToAttr(color byte) termbox.Attribute {
 }
 
 func (v *Video) drawBorder() {
-	// we have no good information on the background color lookup at the moment
-	// So instead just treat the low 4 bits
-	color := byte(v.words[backgroundColorAddress] & 0xf)
-	attr := colorToAttr(color)
+	attr := v.colorToAttr(v.borderColor())
+	gw, gh := v.glyphSize()
+	width, height := windowWidth*gw, windowHeight*gh
 
 	// draw top/bottom
-	for _, row := range [2]int{0, windowHeight + 1} {
-		for col := 0; col < windowWidth+2; col++ {
+	for _, row := range [2]int{0, height + 1} {
+		for col := 0; col < width+2; col++ {
 			termbox.SetCell(col, row, ' ', termbox.ColorDefault, attr)
 		}
 	}
 	// draw left/right
-	for _, col := range [2]int{0, windowWidth + 1} {
-		for row := 1; row < windowHeight+1; row++ {
+	for _, col := range [2]int{0, width + 1} {
+		for row := 1; row < height+1; row++ {
 			termbox.SetCell(col, row, ' ', termbox.ColorDefault, attr)
 		}
 	}
@@ -190,26 +395,73 @@ func (v *Video) drawBorder() {
 func (v *Video) clearDisplay() {
 	// clear all cells inside of the border
 	attr := termbox.ColorBlack
+	gw, gh := v.glyphSize()
 
-	for row := 1; row <= windowHeight; row++ {
-		for col := 1; col <= windowWidth; col++ {
+	for row := 1; row <= windowHeight*gh; row++ {
+		for col := 1; col <= windowWidth*gw; col++ {
 			termbox.SetCell(col, row, ' ', termbox.ColorDefault, attr)
 		}
 	}
 }
 
 func (v *Video) Flush() {
-	termbox.Flush()
+	if !v.headless {
+		termbox.Flush()
+	}
+}
+
+// Framebuffer returns the display as of the last refresh when running
+// headless. It's updated by the machine, so it should only be read once
+// the machine has stopped.
+func (v *Video) Framebuffer() image.Image {
+	return v.frame
+}
+
+// Text returns the characters on the display, one line per row,
+// with trailing spaces removed.
+func (v *Video) Text() string {
+	var lines []string
+	for row := 0; row < windowHeight; row++ {
+		line := make([]rune, windowWidth)
+		for col := range line {
+			ch := rune(v.cell(row*windowWidth+col) & 0x7F)
+			if ch < 0x20 || ch == 0x7F {
+				ch = ' '
+			}
+			line[col] = ch
+		}
+		lines = append(lines, strings.TrimRight(string(line), " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// TerminalSize returns the number of terminal columns and rows used by the
+// display, including its border, and the stats drawn below it.
+func (v *Video) TerminalSize() (width, height int) {
+	width, height = v.displaySize()
+	return width, height + 1 + 4
+}
+
+// displaySize returns the number of terminal columns and rows used by the
+// display, including its border
+func (v *Video) displaySize() (width, height int) {
+	gw, gh := v.glyphSize()
+	return windowWidth*gw + 2, windowHeight*gh + 2
 }
 
 func (v *Video) UpdateStats(state *core.State, cycleCount uint) {
+	if v.headless {
+		return
+	}
 	// draw stats below the display
 	// Cycles: ###########  PC: 0x####
 	// A: 0x####  B: 0x####  C: 0x####  I: 0x####
 	// X: 0x####  Y: 0x####  Z: 0x####  J: 0x####
 	// O: 0x#### SP: 0x####
+	// (O is shown as EX, followed by IA, when running the 1.7 spec)
 
-	row := windowHeight + 2 /* border */ + 1 /* spacing */
+	_, gh := v.glyphSize()
+	row := windowHeight*gh + 2 /* border */ + 1 /* spacing */
 	fg, bg := termbox.ColorDefault, termbox.ColorDefault
 	termbox.DrawString(1, row, fg, bg, fmt.Sprintf("Cycles: %-11d  PC: %#04x", cycleCount, state.PC()))
 	row++
@@ -217,7 +469,11 @@ func (v *Video) UpdateStats(state *core.State, cycleCount uint) {
 	row++
 	termbox.DrawString(1, row, fg, bg, fmt.Sprintf("X: %#04x  Y: %#04x  Z: %#04x  J: %#04x", state.X(), state.Y(), state.Z(), state.J()))
 	row++
-	termbox.DrawString(1, row, fg, bg, fmt.Sprintf("O: %#04x SP: %#04x", state.O(), state.SP()))
+	if state.Spec == core.Spec17 {
+		termbox.DrawString(1, row, fg, bg, fmt.Sprintf("EX: %#04x SP: %#04x IA: %#04x", state.EX(), state.SP(), state.IA()))
+	} else {
+		termbox.DrawString(1, row, fg, bg, fmt.Sprintf("O: %#04x SP: %#04x", state.O(), state.SP()))
+	}
 }
 
 func (v *Video) MapToMachine(offset core.Word, m *Machine) error {
@@ -229,7 +485,6 @@ func (v *Video) MapToMachine(offset core.Word, m *Machine) error {
 	}
 	set := func(offset, val core.Word) error {
 		v.words[offset] = val
-		v.handleChange(offset)
 		return nil
 	}
 	if err := m.State.Ram.MapRegion(offset, core.Word(len(v.words)), get, set); err != nil {
@@ -250,6 +505,46 @@ func (v *Video) UnmapFromMachine(offset core.Word, m *Machine) error {
 	return nil
 }
 
+func (v *Video) HardwareID() uint32 {
+	return lemHardwareID
+}
+
+func (v *Video) HardwareVersion() core.Word {
+	return lemHardwareVersion
+}
+
+func (v *Video) Manufacturer() uint32 {
+	return lemManufacturer
+}
+
+func (v *Video) HandleInterrupt(s *core.State) (uint, error) {
+	switch s.A() {
+	case lemMemMapScreen:
+		v.screen = s.B()
+	case lemMemMapFont:
+		v.font = s.B()
+	case lemMemMapPalette:
+		v.palette = s.B()
+	case lemSetBorderColor:
+		v.border = s.B() & 0xf
+	case lemMemDumpFont:
+		for i, w := range defaultFont {
+			if err := s.Ram.Store(s.B()+core.Word(i), w); err != nil {
+				return 0, err
+			}
+		}
+		return 256, nil
+	case lemMemDumpPalette:
+		for i, w := range defaultPalette {
+			if err := s.Ram.Store(s.B()+core.Word(i), w); err != nil {
+				return 0, err
+			}
+		}
+		return 16, nil
+	}
+	return 0, nil
+}
+
 // test for xterm-256 color support
 func init() {
 	// Check $TERM for the -256color suffix
@@ -0,0 +1,106 @@
+package dcpu
+
+import (
+	"github.com/kballard/dcpu16/dcpu/core"
+	"testing"
+)
+
+func TestGlyphBraille(t *testing.T) {
+	// 'A' is drawn as
+	// .#..
+	// #.#.
+	// #.#.
+	// ###.
+	// #.#.
+	// #.#.
+	// #.#.
+	// ....
+	glyph := [2]core.Word{defaultFont['A'*2], defaultFont['A'*2+1]}
+	expected := [2][2]rune{
+		{'\u28ce', '\u2846'},
+		{'\u2807', '\u2807'},
+	}
+	for cy := 0; cy < 2; cy++ {
+		for cx := 0; cx < 2; cx++ {
+			if found := glyphBraille(glyph, cx, cy); found != expected[cy][cx] {
+				t.Errorf("Unexpected braille for cell (%d, %d); expected %c, found %c", cx, cy, expected[cy][cx], found)
+			}
+		}
+	}
+}
+
+// lemInterrupt sends the LEM1802 an HWI with the given A and B
+func lemInterrupt(t *testing.T, v *Video, state *core.State, a, b core.Word) uint {
+	state.SetA(a)
+	state.SetB(b)
+	cycles, err := v.HandleInterrupt(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cycles
+}
+
+func TestLEM1802Mappings(t *testing.T) {
+	var state core.State
+	state.Spec = core.Spec17
+	v := &Video{ram: &state.Ram}
+	state.Ram.Store(0x2000, 0x1234)
+	state.Ram.Store(0x2001, 0x5678)
+	state.Ram.Store(0x3003, 0xfabc)
+	state.Ram.Store(0x8005, 0xf041)
+
+	lemInterrupt(t, v, &state, lemMemMapScreen, 0x8000)
+	lemInterrupt(t, v, &state, lemMemMapFont, 0x2000)
+	lemInterrupt(t, v, &state, lemMemMapPalette, 0x3000)
+	lemInterrupt(t, v, &state, lemSetBorderColor, 0x13)
+	if v.screen != 0x8000 || v.font != 0x2000 || v.palette != 0x3000 {
+		t.Errorf("Unexpected mappings: screen %#x, font %#x, palette %#x", v.screen, v.font, v.palette)
+	}
+	if v.borderColor() != 3 {
+		t.Errorf("Expected border color 3, found %d", v.borderColor())
+	}
+	if cell := v.cell(5); cell != 0xf041 {
+		t.Errorf("Expected cell 5 to be read from the screen, found %#x", cell)
+	}
+	if glyph := v.glyph(0); glyph != [2]core.Word{0x1234, 0x5678} {
+		t.Errorf("Expected glyph 0 to be read from the font, found %#x", glyph)
+	}
+	if color := v.paletteColor(3); color != 0xabc {
+		t.Errorf("Expected color 3 to be read from the palette, found %#x", color)
+	}
+
+	// unmapping falls back to a blank screen and the built-in font and palette
+	lemInterrupt(t, v, &state, lemMemMapScreen, 0)
+	lemInterrupt(t, v, &state, lemMemMapFont, 0)
+	lemInterrupt(t, v, &state, lemMemMapPalette, 0)
+	if cell := v.cell(5); cell != 0 {
+		t.Errorf("Expected a blank cell, found %#x", cell)
+	}
+	if glyph, expected := v.glyph(0), [2]core.Word{defaultFont[0], defaultFont[1]}; glyph != expected {
+		t.Errorf("Expected the built-in glyph %#x, found %#x", expected, glyph)
+	}
+	if color := v.paletteColor(3); color != defaultPalette[3] {
+		t.Errorf("Expected the built-in color %#x, found %#x", defaultPalette[3], color)
+	}
+}
+
+func TestLEM1802Dumps(t *testing.T) {
+	var state core.State
+	state.Spec = core.Spec17
+	v := &Video{ram: &state.Ram}
+	if cycles := lemInterrupt(t, v, &state, lemMemDumpFont, 0x1000); cycles != 256 {
+		t.Errorf("Expected MEM_DUMP_FONT to take 256 cycles, found %d", cycles)
+	}
+	if font := state.Ram.GetSlice(0x1000, 0x1000+core.Word(len(defaultFont))); !wordsEqual(font, defaultFont[:]) {
+		t.Error("Expected the built-in font to be dumped")
+	}
+	if cycles := lemInterrupt(t, v, &state, lemMemDumpPalette, 0x2000); cycles != 16 {
+		t.Errorf("Expected MEM_DUMP_PALETTE to take 16 cycles, found %d", cycles)
+	}
+	if palette := state.Ram.GetSlice(0x2000, 0x2000+core.Word(len(defaultPalette))); !wordsEqual(palette, defaultPalette[:]) {
+		t.Error("Expected the built-in palette to be dumped")
+	}
+	if word := state.Ram.Load(0x2000 + core.Word(len(defaultPalette))); word != 0 {
+		t.Errorf("Expected the palette dump to stop after 16 words, found %#x", word)
+	}
+}
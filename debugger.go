@@ -0,0 +1,391 @@
+package main
+
+// the interactive debugger
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"github.com/kballard/dcpu16/dcpu/disasm"
+	"github.com/kballard/termbox-go"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const debuggerHelp = "c:continue s:step n:next .:cycle b:break ::command"
+
+// debugger draws the debugging panes next to the display and interprets
+// keys while the machine is paused. The panes are drawn on the machine's
+// goroutine, so everything they read from the debugger is guarded by mu.
+type debugger struct {
+	machine     *dcpu.Machine
+	labels      map[string]core.Word
+	names       map[core.Word]string // labels by address
+	mu          sync.Mutex
+	paused      bool
+	reason      dcpu.PauseReason
+	breakpoints map[core.Word]bool
+	memory      core.Word // first address in the memory pane
+	status      string    // result of the last command
+	editing     bool      // whether a command is being typed
+	command     []rune
+	watches     map[watchKey]int // ids of the watchpoints set with the watch command
+}
+
+func newDebugger(machine *dcpu.Machine, labels map[string]core.Word) *debugger {
+	d := &debugger{
+		machine:     machine,
+		labels:      labels,
+		names:       make(map[core.Word]string),
+		breakpoints: make(map[core.Word]bool),
+		watches:     make(map[watchKey]int),
+		status:      debuggerHelp,
+	}
+	for name, addr := range labels {
+		d.names[addr] = name
+	}
+	machine.OnRefresh = d.draw
+	return d
+}
+
+// isPaused returns true if keys should go to the debugger
+func (d *debugger) isPaused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+// handlePause records that the machine paused
+func (d *debugger) handlePause(evt dcpu.PauseEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.paused, d.reason = true, evt.Reason
+	switch evt.Reason {
+	case dcpu.PauseBreakpoint:
+		d.status = fmt.Sprintf("breakpoint at %s", d.describe(evt.PC))
+	case dcpu.PauseWatchpoint:
+		d.status = fmt.Sprintf("%s of %s", evt.Access, d.describe(evt.Address))
+	}
+}
+
+func (d *debugger) setStatus(format string, args ...interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status = fmt.Sprintf(format, args...)
+}
+
+// resume resumes the machine, or steps over the next instruction if next is true
+func (d *debugger) resume(next bool) {
+	d.mu.Lock()
+	d.paused = false
+	d.status = debuggerHelp
+	d.mu.Unlock()
+	if next {
+		if err := d.machine.StepOver(); err != nil {
+			d.setStatus("%v", err)
+		}
+	} else {
+		d.machine.Resume()
+	}
+}
+
+// handleKey handles a key typed while the machine is paused
+func (d *debugger) handleKey(evt termbox.Event) {
+	d.mu.Lock()
+	editing := d.editing
+	d.mu.Unlock()
+	if editing {
+		d.editCommand(evt)
+		return
+	}
+	switch {
+	case evt.Ch == 'c' || evt.Key == termbox.KeyF5:
+		d.resume(false)
+	case evt.Ch == 'n' || evt.Key == termbox.KeyF10:
+		d.resume(true)
+	case evt.Ch == 's' || evt.Key == termbox.KeyF11:
+		d.step(d.machine.StepInstruction)
+	case evt.Ch == '.':
+		d.step(d.machine.StepCycle)
+	case evt.Ch == 'S':
+		d.reverse(d.machine.StepBack)
+	case evt.Ch == 'b' || evt.Key == termbox.KeyF9:
+		var pc core.Word
+		d.machine.Do(func() { pc = d.machine.State.PC() })
+		d.toggleBreakpoint(pc)
+	case evt.Ch == ':':
+		d.mu.Lock()
+		d.editing, d.command = true, nil
+		d.mu.Unlock()
+	}
+}
+
+// step runs a single step. Errors stop the machine, which is
+// reported on its ErrorC, so they're ignored here.
+func (d *debugger) step(f func() error) {
+	f()
+	d.setStatus(debuggerHelp)
+}
+
+// reverse runs the machine backwards. Errors, such as running out of
+// history, don't stop the machine, so they're shown instead.
+func (d *debugger) reverse(f func() error) {
+	if err := f(); err != nil {
+		d.setStatus("%v", err)
+	} else {
+		d.setStatus(debuggerHelp)
+	}
+}
+
+func (d *debugger) editCommand(evt termbox.Event) {
+	d.mu.Lock()
+	switch {
+	case evt.Key == termbox.KeyEsc:
+		d.editing = false
+	case evt.Key == termbox.KeyBackspace || evt.Key == termbox.KeyBackspace2:
+		if len(d.command) > 0 {
+			d.command = d.command[:len(d.command)-1]
+		}
+	case evt.Key == termbox.KeySpace:
+		d.command = append(d.command, ' ')
+	case evt.Key == termbox.KeyEnter:
+		d.editing = false
+		command := string(d.command)
+		d.mu.Unlock()
+		if err := d.execute(command); err != nil {
+			d.setStatus("%s: %v", command, err)
+		}
+		return
+	case evt.Ch != 0:
+		d.command = append(d.command, evt.Ch)
+	}
+	d.mu.Unlock()
+}
+
+// execute runs a command typed at the prompt
+func (d *debugger) execute(command string) error {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil
+	}
+	args := fields[1:]
+	switch fields[0] {
+	case "b", "break", "d", "delete", "m", "mem", "rw", "rwrite":
+		if len(args) != 1 {
+			return errors.New("expected an address or label")
+		}
+		addr, err := d.parseValue(args[0])
+		if err != nil {
+			return err
+		}
+		switch fields[0] {
+		case "b", "break":
+			d.toggleBreakpoint(addr)
+		case "rw", "rwrite":
+			d.reverse(func() error { return d.machine.StepBackToWrite(addr) })
+		case "d", "delete":
+			d.machine.ClearBreakpoint(addr)
+			d.mu.Lock()
+			delete(d.breakpoints, addr)
+			d.mu.Unlock()
+			d.setStatus("cleared breakpoint at %s", d.describe(addr))
+		default:
+			d.mu.Lock()
+			d.memory = addr
+			d.mu.Unlock()
+		}
+	case "w", "watch":
+		if len(args) != 1 {
+			return errors.New("usage: watch loc[:words][:rwx]")
+		}
+		region, access, err := parseWatch(args[0], d.labels)
+		if err != nil {
+			return err
+		}
+		d.toggleWatchpoint(watchKey{region, access})
+	case "set":
+		if len(args) != 2 {
+			return errors.New("usage: set register|[address] value")
+		}
+		return d.set(args[0], args[1])
+	case "c", "continue":
+		d.resume(false)
+	case "n", "next":
+		d.resume(true)
+	case "s", "step":
+		d.step(d.machine.StepInstruction)
+	case "rs", "rstep":
+		d.reverse(d.machine.StepBack)
+	case "rc", "rcontinue":
+		d.reverse(d.machine.ReverseContinue)
+	default:
+		return errors.New("unknown command")
+	}
+	return nil
+}
+
+// set changes a register, or a word of memory
+func (d *debugger) set(dest, value string) error {
+	val, err := d.parseValue(value)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(dest, "[") && strings.HasSuffix(dest, "]") {
+		addr, err := d.parseValue(dest[1 : len(dest)-1])
+		if err != nil {
+			return err
+		}
+		d.machine.Do(func() { err = d.machine.State.Ram.Store(addr, val) })
+		return err
+	}
+	index, ok := core.RegisterIndex(dest)
+	if !ok {
+		return fmt.Errorf("unknown register %s", dest)
+	}
+	d.machine.Do(func() { d.machine.State.Registers[index] = val })
+	return nil
+}
+
+// parseValue parses a number or a label
+func (d *debugger) parseValue(str string) (core.Word, error) {
+	if addr, ok := d.labels[str]; ok {
+		return addr, nil
+	}
+	val, err := strconv.ParseUint(str, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %s", str)
+	}
+	return core.Word(val), nil
+}
+
+func (d *debugger) toggleBreakpoint(addr core.Word) {
+	d.mu.Lock()
+	set := !d.breakpoints[addr]
+	if set {
+		d.breakpoints[addr] = true
+		d.status = fmt.Sprintf("set breakpoint at %s", d.describe(addr))
+	} else {
+		delete(d.breakpoints, addr)
+		d.status = fmt.Sprintf("cleared breakpoint at %s", d.describe(addr))
+	}
+	d.mu.Unlock()
+	if set {
+		d.machine.SetBreakpoint(addr)
+	} else {
+		d.machine.ClearBreakpoint(addr)
+	}
+}
+
+// watchKey identifies a watchpoint set with the watch command
+type watchKey struct {
+	region core.Region
+	access core.Access
+}
+
+func (d *debugger) toggleWatchpoint(key watchKey) {
+	d.mu.Lock()
+	id, set := d.watches[key]
+	delete(d.watches, key)
+	d.mu.Unlock()
+	if set {
+		d.machine.RemoveWatchpoint(id)
+		d.setStatus("cleared %s watchpoint at %s", key.access, d.describe(key.region.Start))
+		return
+	}
+	id = d.machine.AddWatchpoint(key.region, key.access, dcpu.WatchPause)
+	d.mu.Lock()
+	d.watches[key] = id
+	d.status = fmt.Sprintf("set %s watchpoint at %s", key.access, d.describe(key.region.Start))
+	d.mu.Unlock()
+}
+
+// describe formats an address, along with its label if it has one
+func (d *debugger) describe(addr core.Word) string {
+	if name, ok := d.names[addr]; ok {
+		return fmt.Sprintf("%#04x (%s)", addr, name)
+	}
+	return fmt.Sprintf("%#04x", addr)
+}
+
+// draw draws the debugger panes. It's called on the machine's goroutine.
+func (d *debugger) draw() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state := &d.machine.State
+	width, height := d.machine.TerminalSize()
+	fg, bg := termbox.ColorDefault, termbox.ColorDefault
+
+	// disassembly to the right of the display
+	x := width + 2
+	title := "running"
+	if d.paused {
+		title = d.reason.String()
+	}
+	drawLine(x, 0, 40, "-- "+title+" --", fg, bg)
+	pc := state.PC()
+	if !state.AtInstructionBoundary() {
+		pc = state.InstructionAddress()
+	}
+	var lines []string
+	var current int
+	for _, inst := range disasm.Around(&state.Ram, pc, height/2, height, state.Spec) {
+		if name, ok := d.names[inst.Address]; ok {
+			lines = append(lines, ":"+name)
+		}
+		marker := "  "
+		if inst.Address == pc {
+			marker = "=>"
+			current = len(lines)
+		}
+		bp := " "
+		if d.breakpoints[inst.Address] {
+			bp = "*"
+		}
+		lines = append(lines, fmt.Sprintf("%s%s %04x: %s", bp, marker, inst.Address, inst.Format(d.names)))
+	}
+	// keep the current instruction in the top half of the pane
+	if start := current - height/2 + 1; start > 0 {
+		lines = lines[start:]
+	}
+	for row := 1; row < height; row++ {
+		line := ""
+		if row-1 < len(lines) {
+			line = lines[row-1]
+		}
+		drawLine(x, row, 40, line, fg, bg)
+	}
+
+	// memory below the stats
+	row := height + 1
+	for i := 0; i < 8; i++ {
+		addr := d.memory + core.Word(i*8)
+		words := make([]string, 8)
+		for j := range words {
+			words[j] = fmt.Sprintf("%04x", state.Ram.Load(addr+core.Word(j)))
+		}
+		drawLine(1, row, width+40, fmt.Sprintf("%04x: %s", addr, strings.Join(words, " ")), fg, bg)
+		row++
+	}
+	row++
+	drawLine(1, row, width+40, d.status, fg, bg)
+	row++
+	prompt := ""
+	if d.editing {
+		prompt = ":" + string(d.command)
+	}
+	drawLine(1, row, width+40, prompt, fg, bg)
+}
+
+// drawLine draws the string, padding it with spaces to the given width
+func drawLine(x, y, width int, str string, fg, bg termbox.Attribute) {
+	runes := []rune(str)
+	for i := 0; i < width; i++ {
+		ch := ' '
+		if i < len(runes) {
+			ch = runes[i]
+		}
+		termbox.SetCell(x+i, y, ch, fg, bg)
+	}
+}
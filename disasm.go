@@ -0,0 +1,42 @@
+package main
+
+// the disasm subcommand
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"github.com/kballard/dcpu16/dcpu/disasm"
+	"os"
+)
+
+func disasmMain(args []string) {
+	flags := flag.NewFlagSet("disasm", flag.ExitOnError)
+	spec := core.Spec11
+	flags.Var(&spec, "spec", "DCPU-16 spec version the program targets (1.1 or 1.7)")
+	littleEndian := flags.Bool("littleEndian", false, "Interpret the input file as little endian")
+	labels := flags.Bool("labels", true, "Synthesize labels for jump targets")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s disasm [flags] program\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	prog, err := loadProgram(flags.Arg(0), spec, *littleEndian)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	insts := disasm.Disassemble(prog.Words, 0, spec)
+	var names map[core.Word]string
+	if *labels {
+		names = disasm.Labels(insts)
+	}
+	if err := disasm.Write(os.Stdout, insts, names, -1); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+// the floppy drive
+
+import (
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"github.com/kballard/termbox-go"
+)
+
+// floppyDrive ejects the disk when F4 is pressed, and inserts it again when
+// it's pressed again
+type floppyDrive struct {
+	machine   *dcpu.Machine
+	floppy    *dcpu.Floppy
+	path      string
+	protected bool
+}
+
+// attachFloppy attaches a drive to the machine, with the disk image at path
+// inserted
+func attachFloppy(machine *dcpu.Machine, path string, protected bool) (*floppyDrive, error) {
+	if machine.State.Spec != core.Spec17 {
+		return nil, fmt.Errorf("the floppy drive needs -spec 1.7")
+	}
+	floppy := new(dcpu.Floppy)
+	if err := floppy.Insert(path, protected); err != nil {
+		return nil, err
+	}
+	if err := machine.AttachDevice(floppy); err != nil {
+		return nil, err
+	}
+	return &floppyDrive{machine, floppy, path, protected}, nil
+}
+
+// handleKey returns a message if the key was the eject hotkey
+func (d *floppyDrive) handleKey(evt termbox.Event) (message string, handled bool) {
+	if d == nil || evt.Key != termbox.KeyF4 {
+		return "", false
+	}
+	var err error
+	d.machine.Do(func() {
+		if _, inserted := d.floppy.Inserted(); inserted {
+			err = d.floppy.Eject()
+			message = "ejected " + d.path
+		} else {
+			err = d.floppy.Insert(d.path, d.protected)
+			message = "inserted " + d.path
+		}
+	})
+	if err != nil {
+		message = err.Error()
+	}
+	return message, true
+}
@@ -0,0 +1,50 @@
+package main
+
+// serving GDB clients
+
+import (
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"github.com/kballard/dcpu16/dcpu/gdb"
+	"net"
+	"os"
+)
+
+// acceptGDB waits for a single GDB client to connect to addr
+func acceptGDB(addr string) (net.Conn, error) {
+	l, err := gdb.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	fmt.Fprintf(os.Stderr, "Waiting for GDB on %s\n", l.Addr())
+	return l.Accept()
+}
+
+// serveGDB lets the client debug the machine. The result of gdb.Serve is sent
+// on the returned channel once the client is done.
+func serveGDB(conn net.Conn, machine *dcpu.Machine) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- gdb.Serve(conn, machine)
+		conn.Close()
+	}()
+	return done
+}
+
+// finishGDB handles the end of a debugging session. If the client detached
+// from a machine that's still running, it returns false. Otherwise the machine
+// is stopped, and the error that stopped it is returned.
+func finishGDB(machine *dcpu.Machine, err error) (bool, error) {
+	if err == nil {
+		if err := machine.HasError(); err != nil {
+			return true, err
+		}
+		return false, nil
+	}
+	stopErr := machine.Stop()
+	if err != gdb.ErrKilled {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return true, stopErr
+}
@@ -5,21 +5,103 @@ package main
 import (
 	"github.com/kballard/dcpu16/dcpu"
 	"github.com/kballard/termbox-go"
+	"strings"
+	"sync"
+	"time"
 )
 
-var keymapTermboxKeyToRune = map[termbox.Key]rune{
-	termbox.KeyDelete: 127,
-	termbox.KeySpace:  0x20,
-}
-
 var keymapTermboxKeyToKey = map[termbox.Key]dcpu.Key{
+	termbox.KeyBackspace:  dcpu.KeyBackspace,
+	termbox.KeyBackspace2: dcpu.KeyBackspace,
+	termbox.KeyEnter:      dcpu.KeyReturn,
+	termbox.KeyInsert:     dcpu.KeyInsert,
+	termbox.KeyDelete:     dcpu.KeyDelete,
+	termbox.KeySpace:      ' ',
 	termbox.KeyArrowUp:    dcpu.KeyArrowUp,
 	termbox.KeyArrowDown:  dcpu.KeyArrowDown,
 	termbox.KeyArrowLeft:  dcpu.KeyArrowLeft,
 	termbox.KeyArrowRight: dcpu.KeyArrowRight,
 }
 
-var keymapRuneToRune = map[rune]rune{
-	'\x7F': '\x08', // fix delete on OS X
-	'\x0D': '\x0A', // fix return on OS X
+var keymapRuneToKey = map[rune]dcpu.Key{
+	'\x7F': dcpu.KeyBackspace, // fix delete on OS X
+	'\x0D': dcpu.KeyReturn,    // fix return on OS X
+}
+
+// shiftedRunes are the characters typed with shift held, on a US layout
+const shiftedRunes = "ABCDEFGHIJKLMNOPQRSTUVWXYZ~!@#$%^&*()_+{}|:\"<>?"
+
+// keymapEventToKeys returns the keys that are held down to type a termbox
+// event, with any modifier first
+func keymapEventToKeys(evt termbox.Event) []dcpu.Key {
+	if evt.Ch != 0 {
+		if k, ok := keymapRuneToKey[evt.Ch]; ok {
+			return []dcpu.Key{k}
+		}
+		if evt.Ch < 0x20 || evt.Ch >= 0x7F {
+			return nil
+		}
+		if strings.ContainsRune(shiftedRunes, evt.Ch) {
+			return []dcpu.Key{dcpu.KeyShift, dcpu.Key(evt.Ch)}
+		}
+		return []dcpu.Key{dcpu.Key(evt.Ch)}
+	}
+	if k, ok := keymapTermboxKeyToKey[evt.Key]; ok {
+		return []dcpu.Key{k}
+	}
+	if evt.Key >= termbox.KeyCtrlA && evt.Key <= termbox.KeyCtrlZ {
+		return []dcpu.Key{dcpu.KeyControl, dcpu.Key('a' + evt.Key - termbox.KeyCtrlA)}
+	}
+	return nil
+}
+
+// keyHoldTime is how long a key stays pressed after the terminal last
+// reported it
+const keyHoldTime = 250 * time.Millisecond
+
+// keyHolder presses keys on the keyboard as the terminal reports them.
+// Terminals don't report releases, but they do repeat a key while it's held,
+// so a key is released once it stops repeating.
+type keyHolder struct {
+	keyboard *dcpu.Keyboard
+	mu       sync.Mutex
+	timers   map[dcpu.Key]*time.Timer // releases each pressed key
+}
+
+func newKeyHolder(keyboard *dcpu.Keyboard) *keyHolder {
+	return &keyHolder{keyboard: keyboard, timers: make(map[dcpu.Key]*time.Timer)}
+}
+
+// handleKey presses the keys for a termbox event
+func (h *keyHolder) handleKey(evt termbox.Event) {
+	for _, key := range keymapEventToKeys(evt) {
+		h.press(key)
+	}
+}
+
+func (h *keyHolder) press(key dcpu.Key) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if timer, ok := h.timers[key]; ok && timer.Stop() {
+		if key == dcpu.KeyShift || key == dcpu.KeyControl {
+			// modifiers don't repeat
+			timer.Reset(keyHoldTime)
+			return
+		}
+	}
+	h.keyboard.RegisterKeyPressed(key)
+	var timer *time.Timer
+	timer = time.AfterFunc(keyHoldTime, func() {
+		h.mu.Lock()
+		current := h.timers[key] == timer
+		if current {
+			delete(h.timers, key)
+		}
+		h.mu.Unlock()
+		// this may wait for the machine, so it's done without the lock
+		if current {
+			h.keyboard.RegisterKeyReleased(key)
+		}
+	})
+	h.timers[key] = timer
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/kballard/dcpu16/dcpu"
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"github.com/kballard/termbox-go"
+	"testing"
+	"time"
+)
+
+func TestKeyHolderShift(t *testing.T) {
+	// records the first typed key, and whether shift is held after it, then
+	// waits for both keys to be released
+	prog, err := asm.Assemble([]byte(`
+		      SET A, 1
+		:loop HWI 2
+		      IFE C, 0
+		      SET PC, loop
+		      SET [0x1000], C
+		      SET A, 2
+		      SET B, 0x90
+		      HWI 2
+		      SET [0x1001], C
+		:wait SET B, 0x90
+		      HWI 2
+		      IFE C, 0
+		      SET B, 'A'
+		      HWI 2
+		      IFN C, 0
+		      SET PC, wait
+		:done SET PC, done`), core.Spec17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := &dcpu.Machine{Headless: true, StartPaused: true, StopOnHalt: true}
+	machine.State.Spec = core.Spec17
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Start(dcpu.DefaultClockRate); err != nil {
+		t.Fatal(err)
+	}
+	// both keys are pressed before the machine can take either
+	newKeyHolder(&machine.Keyboard).handleKey(termbox.Event{Ch: 'A'})
+	machine.Resume()
+	select {
+	case err := <-machine.ErrorC:
+		if err != dcpu.ErrHalted {
+			t.Errorf("Expected ErrHalted, found %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the key")
+	}
+	machine.Stop()
+	if key := machine.State.Ram.Load(0x1000); key != 'A' {
+		t.Errorf("Expected 'A' to be typed, found %#x", key)
+	}
+	if held := machine.State.Ram.Load(0x1001); held != 1 {
+		t.Error("Expected shift to be held")
+	}
+}
@@ -5,23 +5,73 @@ import (
 	"fmt"
 	"github.com/kballard/dcpu16/dcpu"
 	"github.com/kballard/dcpu16/dcpu/core"
+	"github.com/kballard/dcpu16/dcpu/disasm"
 	"github.com/kballard/termbox-go"
-	"io/ioutil"
+	"image"
+	"image/png"
+	"net"
 	"os"
+	"time"
 )
 
 var requestedRate dcpu.ClockRate = dcpu.DefaultClockRate
 var printRate *bool = flag.Bool("printRate", false, "Print the effective clock rate at termination")
 var screenRefreshRate dcpu.ClockRate = dcpu.DefaultScreenRefreshRate
 var littleEndian *bool = flag.Bool("littleEndian", false, "Interpret the input file as little endian")
+var specVersion core.SpecVersion = core.Spec11
+var terminalFont dcpu.TerminalFont = dcpu.TerminalFontText
+var watches watchList
+var headless *bool = flag.Bool("headless", false, "Run without the terminal until the program halts, or a limit is reached")
+var cycleLimit *uint = flag.Uint("cycles", 0, "Stop after this many cycles (0 for no limit)")
+var virtualTime *bool = flag.Bool("virtualTime", false, "Time everything by the cycle count, so runs are reproducible (headless runs go as fast as possible)")
+var timeout *time.Duration = flag.Duration("timeout", 0, "Stop after this much time (0 for no limit)")
+var input *string = flag.String("input", "", "Keys to type into the keyboard, in order, as the program reads them")
+var screenshot *string = flag.String("screenshot", "", "Write the final display to this PNG file when running headless")
+var debug *bool = flag.Bool("debug", false, "Start paused in the interactive debugger")
+var historyLen *int = flag.Int("history", 0, "Remember this many instructions, so the debugger can run backwards")
+var gdbAddr *string = flag.String("gdb", "", "Wait for a GDB client on this address (host:port or unix:path) before starting")
+var tracePath *string = flag.String("trace", "", "Write a trace of every executed instruction to this file")
+var traceLast *int = flag.Int("traceLast", 0, "Only write the last N instructions of the trace, when the program fails")
+var recordPath *string = flag.String("recordInput", "", "Record every key the program receives, and when, to this file")
+var replayPath *string = flag.String("replayInput", "", "Replay the keys recorded in this file, instead of reading the keyboard")
+var floppyPath *string = flag.String("floppy", "", "Attach an M35FD floppy drive with this disk image inserted (F4 ejects it)")
+var floppyProtect *bool = flag.Bool("floppyProtect", false, "Write-protect the floppy disk")
+var speakerPath *string = flag.String("speaker", "", "Attach a speaker, and write what it plays to this WAV file")
+var serialPath *string = flag.String("serial", "", "Attach a serial port, bridged to this named pipe or PTY (- for stdin and stdout with -headless)")
+var sped3 *bool = flag.Bool("sped3", false, "Attach a SPED-3 display, drawn as a wireframe to the right of the screen")
+var sped3Screenshot *string = flag.String("sped3Screenshot", "", "Write the final SPED-3 wireframe to this PNG file when running headless")
+var snapshotPath *string = flag.String("snapshot", "", "File that F2 saves a snapshot to, and F3 restores it from (default program.snapshot)")
+var restorePath *string = flag.String("restore", "", "Resume from this snapshot instead of starting the program afresh")
+
+// subcommands maps the first argument to an alternative entry point
+var subcommands = map[string]func(args []string){
+	"asm":    asmMain,
+	"dap":    dapMain,
+	"disasm": disasmMain,
+	"trace":  traceMain,
+}
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
 	// command-line flags
 	flag.Var(&requestedRate, "rate", "Clock rate to run the machine at")
 	flag.Var(&screenRefreshRate, "screenRefreshRate", "Clock rate to refresh the screen at")
+	flag.Var(&specVersion, "spec", "DCPU-16 spec version the program targets (1.1 or 1.7)")
+	flag.Var(&terminalFont, "font", "How to draw characters in the terminal (text or braille)")
+	flag.Var(&watches, "watch", "Log accesses to address[:words][:rwx] to stderr (may be repeated)")
 	// update usage
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "usage: %s [flags] program\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s asm [flags] input.asm\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s disasm [flags] program\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s dap [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s trace file\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Programs ending in .asm are assembled when loaded.")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -29,36 +79,122 @@ func main() {
 		flag.Usage()
 		os.Exit(2)
 	}
-	program := flag.Arg(0)
-	data, err := ioutil.ReadFile(program)
+	if *debug && *gdbAddr != "" {
+		fmt.Fprintln(os.Stderr, "-debug and -gdb can't be used together")
+		os.Exit(2)
+	}
+	prog, err := loadProgram(flag.Arg(0), specVersion, *littleEndian)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	// Interpret the file as Words
-	words := make([]core.Word, len(data)/2)
-	for i := 0; i < len(data)/2; i++ {
-		b1, b2 := core.Word(data[i*2]), core.Word(data[i*2+1])
-		var w core.Word
-		if *littleEndian {
-			w = b2<<8 + b1
-		} else {
-			w = b1<<8 + b2
-		}
-		words[i] = w
-	}
 
 	// Set up a machine
 	machine := new(dcpu.Machine)
+	machine.State.Spec = specVersion
 	machine.Video.RefreshRate = screenRefreshRate
-	if err := machine.State.LoadProgram(words, 0); err != nil {
+	machine.Video.TerminalFont = terminalFont
+	machine.Headless = *headless
+	machine.StopOnHalt = *headless
+	machine.CycleLimit = *cycleLimit
+	machine.VirtualTime = *virtualTime
+	machine.Keyboard.QueueKeys([]rune(*input))
+	var dbg *debugger
+	if *debug && !*headless {
+		machine.StartPaused = true
+		dbg = newDebugger(machine, prog.Labels)
+	}
+	if err := machine.State.LoadProgram(prog.Words, 0); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := addWatches(machine, watches, prog.Labels); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	var drive *floppyDrive
+	if *floppyPath != "" {
+		if drive, err = attachFloppy(machine, *floppyPath, *floppyProtect); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *speakerPath != "" {
+		if err := attachSpeaker(machine, *speakerPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *serialPath != "" {
+		if err := attachSerial(machine, *serialPath, *headless); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *sped3 || *sped3Screenshot != "" {
+		if specVersion != core.Spec17 {
+			fmt.Fprintln(os.Stderr, "the SPED-3 needs -spec 1.7")
+			os.Exit(1)
+		}
+		machine.SPED3 = new(dcpu.SPED3)
+	}
+	if *historyLen > 0 {
+		// checkpoints keep rewinding a long way cheap
+		machine.State.EnableHistory(*historyLen, *historyLen/10)
+	}
+	if *restorePath != "" {
+		if err := restoreSnapshot(machine, *restorePath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	var snapshots *snapshotter
+	if !*headless {
+		path := *snapshotPath
+		if path == "" {
+			path = flag.Arg(0) + ".snapshot"
+		}
+		snapshots = newSnapshotter(machine, path)
+	}
+	if *recordPath != "" {
+		if err := startRecording(machine, *recordPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *replayPath != "" {
+		if err := replayInput(machine, *replayPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *tracePath != "" {
+		if err := startTrace(machine, *tracePath, *traceLast); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	var gdbConn net.Conn
+	if *gdbAddr != "" {
+		if gdbConn, err = acceptGDB(*gdbAddr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		machine.StartPaused = true
+	}
 	if err := machine.Start(requestedRate); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	// while GDB is connected, it gets the machine's errors and pauses
+	var gdbDone <-chan error
+	if gdbConn != nil {
+		gdbDone = serveGDB(gdbConn, machine)
+	}
+	if *headless {
+		runHeadless(machine, gdbDone)
+		return
+	}
 	// convert termbox event polling into a channel
 	events := make(chan termbox.Event)
 	go func() {
@@ -66,11 +202,15 @@ func main() {
 			events <- termbox.PollEvent()
 		}
 	}()
+	keys := newKeyHolder(&machine.Keyboard)
 	var effectiveRate dcpu.ClockRate
-	printErr := func(err error) {
-		fmt.Fprintln(os.Stderr, err)
-		machine.State.Ram.DumpMemory(os.Stderr, []int{int(machine.State.PC())})
-		os.Exit(1)
+	var timer <-chan time.Time
+	if *timeout > 0 {
+		timer = time.After(*timeout)
+	}
+	errorC, pauseC := machine.ErrorC, machine.PauseC
+	if gdbDone != nil {
+		errorC, pauseC = nil, nil
 	}
 	// now wait for keyboard events
 loop:
@@ -81,34 +221,168 @@ loop:
 				if evt.Key == termbox.KeyCtrlC {
 					effectiveRate = machine.EffectiveClockRate()
 					if err := machine.Stop(); err != nil {
-						printErr(err)
+						printErr(machine, err)
 					}
 					break loop
 				}
-				// else pass it to the keyboard
-				if evt.Ch == 0 {
-					// it's a key constant
-					key := evt.Key
-					if r, ok := keymapTermboxKeyToRune[key]; ok {
-						machine.Keyboard.RegisterKeyTyped(r)
-					} else if k, ok := keymapTermboxKeyToKey[key]; ok {
-						machine.Keyboard.RegisterKeyPressed(k)
-						machine.Keyboard.RegisterKeyReleased(k)
-					}
-				} else {
-					ch := evt.Ch
-					if r, ok := keymapRuneToRune[evt.Ch]; ok {
-						ch = r
+				if snapshots.handleKey(evt) {
+					continue
+				}
+				if message, ok := drive.handleKey(evt); ok {
+					snapshots.setMessage("%s", message)
+					continue
+				}
+				if dbg != nil {
+					if dbg.isPaused() {
+						dbg.handleKey(evt)
+						continue
+					} else if evt.Key == termbox.KeyF5 {
+						machine.Pause()
+						continue
 					}
-					machine.Keyboard.RegisterKeyTyped(ch)
 				}
+				// else pass it to the keyboard
+				keys.handleKey(evt)
+			}
+		case evt := <-pauseC:
+			if dbg != nil {
+				dbg.handlePause(evt)
+			}
+		case err := <-gdbDone:
+			gdbDone = nil
+			effectiveRate = machine.EffectiveClockRate()
+			stopped, err := finishGDB(machine, err)
+			if !stopped {
+				errorC, pauseC = machine.ErrorC, machine.PauseC
+				continue
 			}
-		case err := <-machine.ErrorC:
+			if !normalStop(err) {
+				printErr(machine, err)
+			}
+			break loop
+		case err := <-errorC:
+			effectiveRate = machine.EffectiveClockRate()
+			machine.Stop() // unlike HasError(), ErrorC doesn't shut down the machine
+			if !normalStop(err) {
+				printErr(machine, err)
+			}
+			break loop
+		case <-timer:
+			effectiveRate = machine.EffectiveClockRate()
+			if err := machine.Stop(); err != nil {
+				printErr(machine, err)
+			}
+			break loop
+		}
+	}
+	finishTrace(machine)
+	finishRecording(machine)
+	finishSpeaker()
+	finishDevices(machine)
+	if *printRate {
+		fmt.Printf("Effective clock rate: %s\n", effectiveRate)
+	}
+}
+
+// runHeadless waits for the machine to halt, hit the cycle limit, or time out.
+// If GDB is connected, it also waits for the client to kill the program, or
+// detach and let it finish. It then prints the contents of the display.
+func runHeadless(machine *dcpu.Machine, gdbDone <-chan error) {
+	var timer <-chan time.Time
+	if *timeout > 0 {
+		timer = time.After(*timeout)
+	}
+	errorC := machine.ErrorC
+	if gdbDone != nil {
+		errorC = nil
+	}
+	var err error
+wait:
+	for {
+		select {
+		case err = <-errorC:
 			machine.Stop() // unlike HasError(), ErrorC doesn't shut down the machine
-			printErr(err)
+			break wait
+		case err = <-gdbDone:
+			gdbDone = nil
+			var stopped bool
+			if stopped, err = finishGDB(machine, err); stopped {
+				break wait
+			}
+			errorC = machine.ErrorC
+		case <-timer:
+			err = machine.Stop()
+			break wait
+		}
+	}
+	effectiveRate := machine.EffectiveClockRate()
+	if !serialStdio {
+		fmt.Println(machine.Video.Text())
+	}
+	if *screenshot != "" {
+		if err := writePNG(*screenshot, machine.Video.Framebuffer()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *sped3Screenshot != "" {
+		if err := writePNG(*sped3Screenshot, machine.SPED3.Frame(sped3FrameSize)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
 	}
+	finishTrace(machine)
+	finishRecording(machine)
+	finishSpeaker()
+	finishDevices(machine)
+	if !normalStop(err) {
+		printErr(machine, err)
+	}
 	if *printRate {
 		fmt.Printf("Effective clock rate: %s\n", effectiveRate)
 	}
 }
+
+// sped3FrameSize is the width and height of -sped3Screenshot images
+const sped3FrameSize = 256
+
+func writePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// normalStop returns whether the machine stopped without anything going wrong,
+// either by halting or by reaching the cycle limit
+func normalStop(err error) bool {
+	return err == nil || err == dcpu.ErrHalted || err == dcpu.ErrCycleLimit
+}
+
+// finishDevices reports an error writing out what the attached devices kept
+// in memory, such as floppy disk writes, once the machine has stopped
+func finishDevices(machine *dcpu.Machine) {
+	if err := machine.FlushErr(); err != nil {
+		fmt.Fprintln(os.Stderr, "error flushing devices:", err)
+	}
+}
+
+func printErr(machine *dcpu.Machine, err error) {
+	finishTrace(machine)
+	finishRecording(machine)
+	finishSpeaker()
+	finishDevices(machine)
+	fmt.Fprintln(os.Stderr, err)
+	machine.State.Ram.DumpMemory(os.Stderr, []int{int(machine.State.PC())})
+	// show the instructions around the one that failed
+	pc := machine.State.InstructionAddress()
+	fmt.Fprintln(os.Stderr)
+	insts := disasm.Around(&machine.State.Ram, pc, 5, 5, machine.State.Spec)
+	disasm.Write(os.Stderr, insts, nil, int(pc))
+	os.Exit(1)
+}
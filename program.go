@@ -0,0 +1,65 @@
+package main
+
+// loading and saving programs
+
+import (
+	"github.com/kballard/dcpu16/dcpu/asm"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"io/ioutil"
+	"strings"
+)
+
+// loadProgram reads a program from disk. Files ending in .asm are assembled,
+// anything else is interpreted as a compiled program, which has no labels.
+func loadProgram(path string, spec core.SpecVersion, littleEndian bool) (*asm.Program, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".asm") {
+		prog, err := asm.Assemble(data, spec)
+		if err != nil {
+			return nil, &assemblyError{path, err}
+		}
+		return prog, nil
+	}
+	return &asm.Program{Words: decodeWords(data, littleEndian)}, nil
+}
+
+type assemblyError struct {
+	path string
+	err  error
+}
+
+func (err *assemblyError) Error() string {
+	return err.path + ":" + err.err.Error()
+}
+
+// decodeWords interprets the data as Words
+func decodeWords(data []byte, littleEndian bool) []core.Word {
+	words := make([]core.Word, len(data)/2)
+	for i := 0; i < len(data)/2; i++ {
+		b1, b2 := core.Word(data[i*2]), core.Word(data[i*2+1])
+		var w core.Word
+		if littleEndian {
+			w = b2<<8 + b1
+		} else {
+			w = b1<<8 + b2
+		}
+		words[i] = w
+	}
+	return words
+}
+
+// encodeWords is the inverse of decodeWords
+func encodeWords(words []core.Word, littleEndian bool) []byte {
+	data := make([]byte, len(words)*2)
+	for i, w := range words {
+		b1, b2 := byte(w>>8), byte(w)
+		if littleEndian {
+			b1, b2 = b2, b1
+		}
+		data[i*2], data[i*2+1] = b1, b2
+	}
+	return data
+}
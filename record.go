@@ -0,0 +1,52 @@
+package main
+
+// recording and replaying keyboard input
+
+import (
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"os"
+)
+
+var recordFile *os.File
+
+// startRecording sets up the machine to record its input to path
+func startRecording(machine *dcpu.Machine, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	recordFile = f
+	machine.InputRecorder = dcpu.NewInputRecorder(f)
+	return nil
+}
+
+// finishRecording closes the recording, once the machine has stopped
+func finishRecording(machine *dcpu.Machine) {
+	if recordFile == nil {
+		return
+	}
+	err := machine.InputRecorder.Err()
+	if cerr := recordFile.Close(); err == nil {
+		err = cerr
+	}
+	recordFile = nil
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error writing input recording:", err)
+	}
+}
+
+// replayInput makes the machine replay the input recorded in path
+func replayInput(machine *dcpu.Machine, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	events, err := dcpu.ReadInputEvents(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	machine.Keyboard.Replay(events)
+	return nil
+}
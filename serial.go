@@ -0,0 +1,35 @@
+package main
+
+// bridging the serial port to the host
+
+import (
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"os"
+)
+
+// serialStdio is whether the serial port uses stdin and stdout, in which case
+// nothing else should be printed to stdout
+var serialStdio bool
+
+// attachSerial attaches a serial port to the machine, bridged to stdin and
+// stdout if path is "-", or else to the file at path, such as a named pipe or
+// a PTY. The file is left open until the emulator exits.
+func attachSerial(machine *dcpu.Machine, path string, headless bool) error {
+	if machine.State.Spec != core.Spec17 {
+		return fmt.Errorf("the serial port needs -spec 1.7")
+	}
+	if path == "-" {
+		if !headless {
+			return fmt.Errorf("the serial port can only use stdin and stdout with -headless")
+		}
+		serialStdio = true
+		return machine.AttachDevice(dcpu.NewSerial(os.Stdin, os.Stdout))
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	return machine.AttachDevice(dcpu.NewSerial(f, f))
+}
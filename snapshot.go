@@ -0,0 +1,97 @@
+package main
+
+// saving and restoring snapshots from the terminal
+
+import (
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"github.com/kballard/termbox-go"
+	"os"
+	"sync"
+)
+
+// snapshotter saves a snapshot when F2 is pressed, and restores it when F3
+// is pressed. The result is shown below the display.
+type snapshotter struct {
+	machine *dcpu.Machine
+	path    string
+	mu      sync.Mutex
+	message string
+}
+
+func newSnapshotter(machine *dcpu.Machine, path string) *snapshotter {
+	s := &snapshotter{machine: machine, path: path}
+	refresh := machine.OnRefresh
+	machine.OnRefresh = func() {
+		if refresh != nil {
+			refresh()
+		}
+		s.draw()
+	}
+	return s
+}
+
+// handleKey returns true if the key was one of the snapshot hotkeys
+func (s *snapshotter) handleKey(evt termbox.Event) bool {
+	var err error
+	switch evt.Key {
+	case termbox.KeyF2:
+		if err = saveSnapshot(s.machine, s.path); err == nil {
+			s.setMessage("saved snapshot to %s", s.path)
+		}
+	case termbox.KeyF3:
+		if err = restoreSnapshot(s.machine, s.path); err == nil {
+			s.setMessage("restored snapshot from %s", s.path)
+		}
+	default:
+		return false
+	}
+	if err != nil {
+		s.setMessage("%v", err)
+	}
+	return true
+}
+
+func (s *snapshotter) setMessage(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.message = fmt.Sprintf(format, args...)
+}
+
+// draw draws the message on the row below the stats. It's called on the
+// machine's goroutine.
+func (s *snapshotter) draw() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	width, height := s.machine.TerminalSize()
+	drawLine(1, height, width, s.message, termbox.ColorDefault, termbox.ColorDefault)
+}
+
+func saveSnapshot(machine *dcpu.Machine, path string) error {
+	snap, err := machine.Snapshot()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := dcpu.WriteSnapshot(f, snap); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func restoreSnapshot(machine *dcpu.Machine, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	snap, err := dcpu.ReadSnapshot(f)
+	if err != nil {
+		return err
+	}
+	return machine.Restore(snap)
+}
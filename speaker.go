@@ -0,0 +1,52 @@
+package main
+
+// writing what the speaker plays to a WAV file
+
+import (
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"os"
+)
+
+var (
+	speaker     *dcpu.Speaker
+	speakerFile *os.File
+)
+
+// attachSpeaker attaches a speaker to the machine that writes to path
+func attachSpeaker(machine *dcpu.Machine, path string) error {
+	if machine.State.Spec != core.Spec17 {
+		return fmt.Errorf("the speaker needs -spec 1.7")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	s, err := dcpu.NewSpeaker(f)
+	if err == nil {
+		err = machine.AttachDevice(s)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	speaker, speakerFile = s, f
+	return nil
+}
+
+// finishSpeaker closes the WAV file. Stopping the machine already finished
+// writing it, unless writing failed.
+func finishSpeaker() {
+	if speakerFile == nil {
+		return
+	}
+	err := speaker.Err()
+	if cerr := speakerFile.Close(); err == nil {
+		err = cerr
+	}
+	speaker, speakerFile = nil, nil
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error writing speaker output:", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+// the trace subcommand, and tracing the machine
+
+import (
+	"flag"
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"os"
+)
+
+var traceFile *os.File
+
+// startTrace sets up the machine to write a trace to path
+func startTrace(machine *dcpu.Machine, path string, keep int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	traceFile = f
+	machine.Tracer = dcpu.NewTracer(f, keep)
+	return nil
+}
+
+// finishTrace closes the trace file, once the machine has stopped
+func finishTrace(machine *dcpu.Machine) {
+	if traceFile == nil {
+		return
+	}
+	err := machine.Tracer.Err()
+	if cerr := traceFile.Close(); err == nil {
+		err = cerr
+	}
+	traceFile = nil
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error writing trace:", err)
+	}
+}
+
+func traceMain(args []string) {
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s trace file\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	if err := dcpu.ReadTrace(f, func(entry *dcpu.TraceEntry) error {
+		_, err := fmt.Println(entry)
+		return err
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+// memory watchpoints given on the command line
+
+import (
+	"fmt"
+	"github.com/kballard/dcpu16/dcpu"
+	"github.com/kballard/dcpu16/dcpu/core"
+	"strconv"
+	"strings"
+)
+
+// watchList is a flag that can be repeated, each one giving a watchpoint
+// as address[:words][:rwx]. Addresses may be labels, so they're resolved
+// once the program is loaded.
+type watchList []string
+
+func (w *watchList) String() string {
+	return strings.Join(*w, " ")
+}
+
+func (w *watchList) Set(str string) error {
+	*w = append(*w, str)
+	return nil
+}
+
+// addWatches makes every watchpoint in the list log its accesses
+func addWatches(machine *dcpu.Machine, list watchList, labels map[string]core.Word) error {
+	for _, str := range list {
+		region, access, err := parseWatch(str, labels)
+		if err != nil {
+			return fmt.Errorf("invalid watchpoint %s: %v", str, err)
+		}
+		machine.AddWatchpoint(region, access, dcpu.WatchLog)
+	}
+	return nil
+}
+
+// parseWatch parses address[:words][:rwx], which watches a single word
+// for writes by default.
+func parseWatch(str string, labels map[string]core.Word) (region core.Region, access core.Access, err error) {
+	parts := strings.Split(str, ":")
+	if len(parts) > 3 {
+		return region, 0, fmt.Errorf("too many fields")
+	}
+	if addr, ok := labels[parts[0]]; ok {
+		region.Start = addr
+	} else if region.Start, err = parseWord(parts[0]); err != nil {
+		return
+	}
+	region.Length, access = 1, core.AccessWrite
+	for _, part := range parts[1:] {
+		if length, err := parseWord(part); err == nil && length > 0 {
+			region.Length = length
+		} else if access, err = parseAccess(part); err != nil {
+			return region, 0, err
+		}
+	}
+	return
+}
+
+func parseWord(str string) (core.Word, error) {
+	val, err := strconv.ParseUint(str, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %s", str)
+	}
+	return core.Word(val), nil
+}
+
+// parseAccess parses some of the letters r, w and x
+func parseAccess(str string) (access core.Access, err error) {
+	for _, c := range str {
+		switch c {
+		case 'r':
+			access |= core.AccessRead
+		case 'w':
+			access |= core.AccessWrite
+		case 'x':
+			access |= core.AccessExecute
+		default:
+			return 0, fmt.Errorf("unknown access %c, expected r, w or x", c)
+		}
+	}
+	if access == 0 {
+		return 0, fmt.Errorf("no access given")
+	}
+	return
+}